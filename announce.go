@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"slices"
+	"text/template"
+
+	"github.com/maxsupermanhd/lac/v2"
+)
+
+type announceTeam struct {
+	Team    int
+	Players []string
+	Won     bool
+}
+
+type announceData struct {
+	Instance int64
+	Queue    string
+	Map      string
+	Players  int
+	Port     int
+	LobbyId  int
+	GameId   int
+	GameUrl  string
+	Teams    []announceTeam
+	Winners  []string
+}
+
+type announceDefaults struct {
+	title       string
+	description string
+	color       int
+}
+
+var announceKinds = map[instanceEventType]announceDefaults{
+	instanceEventLobbyAssigned: {
+		title:       "{{.Queue}} room is open",
+		description: "Map **{{.Map}}**, {{.Players}} players\nJoin with host.wz2100-autohost.net:{{.Port}}",
+		color:       0x3498db,
+	},
+	instanceEventGameStarted: {
+		title:       "{{.Queue}} game started",
+		description: "Map **{{.Map}}**, {{.Players}} players",
+		color:       0xf1c40f,
+	},
+	instanceEventReportSubmitted: {
+		title:       "{{.Queue}} game finished",
+		description: "Map **{{.Map}}**\n{{range .Teams}}Team {{.Team}}{{if .Won}} (won){{end}}: {{range $i, $p := .Players}}{{if $i}}, {{end}}{{$p}}{{end}}\n{{end}}",
+		color:       0x2ecc71,
+	},
+}
+
+// config key for every announced event kind
+var announceKindKeys = map[instanceEventType]string{
+	instanceEventLobbyAssigned:   "roomOpen",
+	instanceEventGameStarted:     "gameStarted",
+	instanceEventReportSubmitted: "gameResult",
+}
+
+func routineAnnouncer(closechan <-chan struct{}) {
+	c := events.subscribe()
+	defer events.unsubscribe(c)
+	for {
+		select {
+		case <-closechan:
+			return
+		case e := <-c:
+			announceEvent(e)
+		}
+	}
+}
+
+func announceEvent(e instanceEvent) {
+	kindKey, ok := announceKindKeys[e.Type]
+	if !ok {
+		return
+	}
+	data, _ := e.Data.(map[string]any)
+	if e.Type == instanceEventReportSubmitted {
+		if final, _ := data["final"].(bool); !final {
+			return
+		}
+	}
+	inst := findInstance(e.Instance)
+	if inst == nil {
+		return
+	}
+	if !tryCfgGetD(tryGetBoolGen("announce", "enabled"), false, inst.cfgs...) {
+		return
+	}
+	if !tryCfgGetD(tryGetBoolGen("announce", kindKey, "enabled"), true, inst.cfgs...) {
+		return
+	}
+	webhookUrl := tryCfgGetD(tryGetStringGen("announce", "webhook"), "", inst.cfgs...)
+	if webhookUrl == "" {
+		inst.logger.Println("Announcements enabled but announce.webhook is not set")
+		return
+	}
+	ad := announceData{
+		Instance: inst.Id,
+		Queue:    inst.QueueName,
+		Map:      inst.Settings.MapName,
+		Players:  inst.Settings.PlayerCount,
+		Port:     inst.Settings.GamePort,
+		LobbyId:  inst.LobbyId,
+		GameId:   inst.GameId,
+	}
+	if ad.Queue == "" {
+		ad.Queue = "Requested"
+	}
+	if ad.GameId > 0 {
+		ad.GameUrl = fmt.Sprintf(tryCfgGetD(tryGetStringGen("announce", "gameUrlFmt"), "https://wz2100-autohost.net/games/%d", inst.cfgs...), ad.GameId)
+	}
+	if players, ok := data["players"].([]map[string]any); ok {
+		ad.Teams, ad.Winners = announceCollectTeams(players)
+	}
+	embed, err := announceRender(inst.cfgs, kindKey, announceKinds[e.Type], ad)
+	if err != nil {
+		inst.logger.Printf("Failed to render %s announcement: %s", kindKey, err.Error())
+		notifyErrorf("Failed to render %s announcement: %s (instance %d)", kindKey, err.Error(), inst.Id)
+		return
+	}
+	go func() {
+		err := discordSendEmbed(webhookUrl, embed)
+		if err != nil {
+			log.Printf("Failed to send %s announcement of instance %d: %s", kindKey, inst.Id, err.Error())
+		}
+	}()
+}
+
+func announceCollectTeams(players []map[string]any) ([]announceTeam, []string) {
+	teams := []announceTeam{}
+	winners := []string{}
+	for _, p := range players {
+		name, _ := p["name"].(string)
+		team, _ := p["team"].(int)
+		usertype, _ := p["usertype"].(string)
+		i := slices.IndexFunc(teams, func(t announceTeam) bool {
+			return t.Team == team
+		})
+		if i < 0 {
+			teams = append(teams, announceTeam{Team: team})
+			i = len(teams) - 1
+		}
+		teams[i].Players = append(teams[i].Players, name)
+		if usertype == "winner" {
+			teams[i].Won = true
+			winners = append(winners, name)
+		}
+	}
+	slices.SortFunc(teams, func(a, b announceTeam) int {
+		return a.Team - b.Team
+	})
+	return teams, winners
+}
+
+func announceRender(cfgs []lac.Conf, kindKey string, d announceDefaults, ad announceData) (map[string]any, error) {
+	render := func(field, def string) (string, error) {
+		tmpls := tryCfgGetD(tryGetStringGen("announce", kindKey, field), def, cfgs...)
+		t, err := template.New(kindKey + "." + field).Parse(tmpls)
+		if err != nil {
+			return "", err
+		}
+		var b bytes.Buffer
+		err = t.Execute(&b, ad)
+		return b.String(), err
+	}
+	title, err := render("title", d.title)
+	if err != nil {
+		return nil, err
+	}
+	description, err := render("description", d.description)
+	if err != nil {
+		return nil, err
+	}
+	embed := map[string]any{
+		"title":       title,
+		"description": description,
+		"color":       tryCfgGetD(tryGetIntGen("announce", kindKey, "color"), d.color, cfgs...),
+		"footer": map[string]any{
+			"text": fmt.Sprintf("Instance %d", ad.Instance),
+		},
+	}
+	if ad.GameUrl != "" {
+		embed["url"] = ad.GameUrl
+	}
+	return embed, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type apiRole string
+
+const (
+	apiRoleView     apiRole = "view"
+	apiRoleModerate apiRole = "moderate"
+	apiRoleAdmin    apiRole = "admin"
+)
+
+// apiTokenLookup finds token in config and returns its name and roles,
+// tokens are declared as apiTokens.<name>.token and apiTokens.<name>.roles
+func apiTokenLookup(token string) (string, []string, bool) {
+	if token == "" {
+		return "", nil, false
+	}
+	names, ok := cfg.GetKeys("apiTokens")
+	if !ok {
+		return "", nil, false
+	}
+	for _, name := range names {
+		t, ok := cfg.GetString("apiTokens", name, "token")
+		if !ok || t == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) != 1 {
+			continue
+		}
+		roles, ok := cfg.GetSliceString("apiTokens", name, "roles")
+		if !ok {
+			roles = []string{}
+		}
+		return name, roles, true
+	}
+	return "", nil, false
+}
+
+func apiAuth(role apiRole, next func(w http.ResponseWriter, r *http.Request, tokenName string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiRespondError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+		name, roles, ok := apiTokenLookup(token)
+		if !ok {
+			log.Printf("API: rejected request %s %s from %s with invalid token", r.Method, r.URL.Path, r.RemoteAddr)
+			apiRespondError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		if !slices.Contains(roles, string(role)) && !slices.Contains(roles, string(apiRoleAdmin)) {
+			log.Printf("API: token %q lacks role %q for %s %s", name, role, r.Method, r.URL.Path)
+			apiRespondError(w, http.StatusForbidden, "token lacks role "+string(role))
+			return
+		}
+		next(w, r, name)
+	}
+}
+
+func apiRespondJSON(w http.ResponseWriter, code int, v any) {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		w.Write([]byte("\n"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+func apiRespondError(w http.ResponseWriter, code int, msg string) {
+	apiRespondJSON(w, code, map[string]any{"error": msg})
+}
+
+func apiGetInstance(w http.ResponseWriter, r *http.Request) *instance {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiRespondError(w, http.StatusBadRequest, "invalid instance id")
+		return nil
+	}
+	inst := findInstance(id)
+	if inst == nil {
+		apiRespondError(w, http.StatusNotFound, "instance not found")
+		return nil
+	}
+	return inst
+}
+
+// apiGetRunningInstance only returns instances that still have a runner processing commands
+func apiGetRunningInstance(w http.ResponseWriter, r *http.Request) *instance {
+	inst := apiGetInstance(w, r)
+	if inst == nil {
+		return nil
+	}
+	if inst.state.Load() >= int64(instanceStateExiting) {
+		apiRespondError(w, http.StatusConflict, "instance is exiting")
+		return nil
+	}
+	return inst
+}
+
+func apiReadStringField(w http.ResponseWriter, r *http.Request, field string) (string, bool) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		apiRespondError(w, http.StatusBadRequest, "failed to read body: "+err.Error())
+		return "", false
+	}
+	var body map[string]any
+	err = json.Unmarshal(b, &body)
+	if err != nil {
+		apiRespondError(w, http.StatusBadRequest, "failed to unmarshal json: "+err.Error())
+		return "", false
+	}
+	s, ok := body[field].(string)
+	if !ok || s == "" {
+		apiRespondError(w, http.StatusBadRequest, "field "+field+" must be a non-empty string")
+		return "", false
+	}
+	return s, true
+}
+
+func apiSendCommand(w http.ResponseWriter, inst *instance, cmd instanceCommand) bool {
+	select {
+	case inst.commands <- cmd:
+		return true
+	default:
+		apiRespondError(w, http.StatusServiceUnavailable, "instance command queue is full")
+		return false
+	}
+}
+
+func apiHandleInstance(w http.ResponseWriter, r *http.Request, tokenName string) {
+	inst := apiGetInstance(w, r)
+	if inst == nil {
+		return
+	}
+	instancesLock.Lock()
+	ret := instanceDescribe(inst)
+	instancesLock.Unlock()
+	ret["id"] = inst.Id
+	apiRespondJSON(w, http.StatusOK, ret)
+}
+
+func apiHandleInstanceShutdown(w http.ResponseWriter, r *http.Request, tokenName string) {
+	inst := apiGetRunningInstance(w, r)
+	if inst == nil {
+		return
+	}
+	log.Printf("API: token %q ordered shutdown of instance %d", tokenName, inst.Id)
+	if !apiSendCommand(w, inst, instanceCommand{command: icShutdown}) {
+		return
+	}
+	apiRespondJSON(w, http.StatusAccepted, map[string]any{"result": "shutdown ordered"})
+}
+
+func apiHandleInstanceBroadcast(w http.ResponseWriter, r *http.Request, tokenName string) {
+	inst := apiGetRunningInstance(w, r)
+	if inst == nil {
+		return
+	}
+	msg, ok := apiReadStringField(w, r, "message")
+	if !ok {
+		return
+	}
+	log.Printf("API: token %q broadcasts to instance %d: %q", tokenName, inst.Id, msg)
+	if !apiSendCommand(w, inst, instanceCommand{command: icBroadcast, data: msg}) {
+		return
+	}
+	apiRespondJSON(w, http.StatusAccepted, map[string]any{"result": "broadcast queued"})
+}
+
+func apiHandleInstanceCommand(w http.ResponseWriter, r *http.Request, tokenName string) {
+	inst := apiGetRunningInstance(w, r)
+	if inst == nil {
+		return
+	}
+	cmd, ok := apiReadStringField(w, r, "command")
+	if !ok {
+		return
+	}
+	if strings.ContainsAny(cmd, "\r\n") {
+		apiRespondError(w, http.StatusBadRequest, "command must be a single line")
+		return
+	}
+	log.Printf("API: token %q sends command to instance %d: %q", tokenName, inst.Id, cmd)
+	if !apiSendCommand(w, inst, instanceCommand{command: icRawCommand, data: cmd}) {
+		return
+	}
+	apiRespondJSON(w, http.StatusAccepted, map[string]any{"result": "command queued"})
+}
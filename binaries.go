@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// binary registry maps version labels to game binaries:
+//
+//	"binaries": {
+//		"4.5.0": {"path": "/opt/wz/4.5.0/bin/warzone2100", "sha256": "..."},
+//		"4.5.1-beta1": {"path": "/opt/wz/beta/bin/warzone2100", "sha256": "..."}
+//	}
+//
+// queues select binary with "version" set to a label or a semver constraint
+// ("^4.5", ">=4.5.0 <4.6.0"), highest matching version wins. Every binary is
+// checksummed and asked for --version at startup and on reload, broken ones are never picked.
+// Without "version" the old "binary" path setting is used as is.
+
+type binaryInfo struct {
+	Label    string    `json:"label"`
+	Path     string    `json:"path"`
+	Sha256   string    `json:"sha256"`
+	Reported string    `json:"reportedVersion"`
+	Checked  time.Time `json:"checked"`
+	Error    string    `json:"error,omitempty"`
+	size     int64
+	modTime  time.Time
+}
+
+var (
+	binariesLock sync.Mutex
+	binaries     map[string]*binaryInfo
+
+	binaryVersionRegexp = regexp.MustCompile(`[Vv]ersion:?\s*v?([0-9]+\.[0-9]+\.[0-9]+[0-9A-Za-z.+-]*)`)
+)
+
+func binarySha256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func binaryReportedVersion(p string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.GetDSInt(15, "binaryVersionTimeoutSeconds"))*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, p, "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("running --version: %w (output %q)", err, string(out))
+	}
+	if m := binaryVersionRegexp.FindSubmatch(out); m != nil {
+		return strings.TrimSuffix(string(m[1]), ","), nil
+	}
+	first, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	if first == "" {
+		return "", errors.New("--version printed nothing")
+	}
+	return first, nil
+}
+
+func binaryValidate(label, p, expectedSum string) *binaryInfo {
+	bi := &binaryInfo{
+		Label:   label,
+		Path:    p,
+		Checked: time.Now(),
+	}
+	err := func() error {
+		if p == "" {
+			return errors.New("no path set")
+		}
+		st, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		bi.size = st.Size()
+		bi.modTime = st.ModTime()
+		bi.Sha256, err = binarySha256(p)
+		if err != nil {
+			return fmt.Errorf("checksumming: %w", err)
+		}
+		if expectedSum == "" {
+			log.Printf("Binary %q has no sha256 set, it is %s", label, bi.Sha256)
+		} else if !strings.EqualFold(expectedSum, bi.Sha256) {
+			return fmt.Errorf("checksum mismatch, expected %s got %s", expectedSum, bi.Sha256)
+		}
+		bi.Reported, err = binaryReportedVersion(p)
+		if err != nil {
+			return err
+		}
+		lv, lerr := parseSemver(label)
+		rv, rerr := parseSemver(bi.Reported)
+		if lerr == nil && rerr == nil && lv.compare(rv) != 0 {
+			return fmt.Errorf("labeled %s but reports %s", lv, rv)
+		}
+		return nil
+	}()
+	if err != nil {
+		bi.Error = err.Error()
+	}
+	return bi
+}
+
+// binaryRegistryValidate checks every registry entry, unchanged files are not checked again
+func binaryRegistryValidate() []error {
+	labels, _ := cfg.GetKeys("binaries")
+	sort.Strings(labels)
+	binariesLock.Lock()
+	old := binaries
+	binariesLock.Unlock()
+
+	errs := []error{}
+	next := map[string]*binaryInfo{}
+	for _, label := range labels {
+		p := cfg.GetDSString("", "binaries", label, "path")
+		sum := cfg.GetDSString("", "binaries", label, "sha256")
+		if prev, ok := old[label]; ok && prev.Error == "" && prev.Path == p && (sum == "" || strings.EqualFold(sum, prev.Sha256)) {
+			if st, err := os.Stat(p); err == nil && st.Size() == prev.size && st.ModTime().Equal(prev.modTime) {
+				next[label] = prev
+				continue
+			}
+		}
+		bi := binaryValidate(label, p, sum)
+		if bi.Error != "" {
+			log.Printf("Binary %q (%s) is not usable: %s", label, p, bi.Error)
+			errs = append(errs, fmt.Errorf("binary %q: %s", label, bi.Error))
+		} else {
+			log.Printf("Binary %q (%s) reports version %q", label, p, bi.Reported)
+		}
+		next[label] = bi
+	}
+	binariesLock.Lock()
+	binaries = next
+	binariesLock.Unlock()
+	return errs
+}
+
+func binaryRegistryStartup() {
+	for _, err := range binaryRegistryValidate() {
+		notifyErrorf("Binary registry: %s", err.Error())
+	}
+}
+
+// binaryPick selects registry entry by label or semver constraint
+func binaryPick(spec string) (*binaryInfo, error) {
+	binariesLock.Lock()
+	loaded := binaries != nil
+	binariesLock.Unlock()
+	if !loaded {
+		binaryRegistryValidate()
+	}
+	binariesLock.Lock()
+	defer binariesLock.Unlock()
+	if bi, ok := binaries[spec]; ok {
+		if bi.Error != "" {
+			return nil, fmt.Errorf("binary %q is not usable: %s", spec, bi.Error)
+		}
+		return bi, nil
+	}
+	constraint, err := parseSemverConstraint(spec)
+	if err != nil {
+		return nil, fmt.Errorf("version %q is neither a known label nor a constraint: %w", spec, err)
+	}
+	var best *binaryInfo
+	var bestV semver
+	for label, bi := range binaries {
+		if bi.Error != "" {
+			continue
+		}
+		v, err := parseSemver(label)
+		if err != nil || !constraint.matches(v) {
+			continue
+		}
+		if best == nil || v.compare(bestV) > 0 {
+			best, bestV = bi, v
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no usable binary matches %q", spec)
+	}
+	return best, nil
+}
+
+// binaryResolve returns binary path and resolved version label for the instance
+func binaryResolve(inst *instance) (string, string, error) {
+	spec := tryCfgGet(tryGetStringGen("version"), inst.cfgs...)
+	if spec == nil {
+		return tryCfgGetD(tryGetStringGen("binary"), "warzone2100", inst.cfgs...), "", nil
+	}
+	bi, err := binaryPick(*spec)
+	if err != nil {
+		return "", "", err
+	}
+	st, err := os.Stat(bi.Path)
+	if err != nil {
+		return "", "", err
+	}
+	if st.Size() != bi.size || !st.ModTime().Equal(bi.modTime) {
+		return "", "", fmt.Errorf("binary %q changed since validation, reload config to revalidate", bi.Label)
+	}
+	return bi.Path, bi.Label, nil
+}
+
+func apiHandleBinaries(w http.ResponseWriter, r *http.Request, _ string) {
+	binariesLock.Lock()
+	ret := make([]binaryInfo, 0, len(binaries))
+	for _, bi := range binaries {
+		ret = append(ret, *bi)
+	}
+	binariesLock.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Label < ret[j].Label
+	})
+	apiRespondJSON(w, http.StatusOK, ret)
+}
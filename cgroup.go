@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// every game process gets own cgroup v2 at <cgroupParent>/<instance id>,
+// limits are taken from the "limits" object of queue/map/settingsFallback:
+//
+//	"limits": {
+//		"cpuPercent": 150,   // cpu.max, 100 is one full core
+//		"memoryMB": 1024,    // memory.max
+//		"pidsMax": 64,       // pids.max
+//		"ioWeight": 50       // io.weight, 1-10000
+//	}
+//
+// without cgroupParent set processes are left where backend itself is
+
+var cgroupControllers = []string{"cpu", "memory", "pids", "io"}
+
+func cgroupParent() string {
+	return cfg.GetDSString("", "cgroupParent")
+}
+
+func cgroupInstancePath(instanceID int64) string {
+	p := cgroupParent()
+	if p == "" {
+		return ""
+	}
+	return path.Join(p, fmt.Sprint(instanceID))
+}
+
+// cgroupCreate prepares cgroup with limits for the instance, returns empty path if cgroups are disabled
+func cgroupCreate(inst *instance) (string, error) {
+	cgpath := cgroupInstancePath(inst.Id)
+	if cgpath == "" {
+		return "", nil
+	}
+	parent := cgroupParent()
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return "", err
+	}
+	err = cgroupEnableControllers(parent)
+	if err != nil {
+		return "", fmt.Errorf("enabling controllers: %w", err)
+	}
+	err = os.Mkdir(cgpath, 0755)
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		return "", err
+	}
+
+	limits := map[string]string{
+		// whole room goes down together instead of kernel picking random thread
+		"memory.oom.group": "1",
+	}
+	if v := tryCfgGetD(tryGetIntGen("limits", "cpuPercent"), 0, inst.cfgs...); v > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d 100000", v*1000)
+	}
+	if v := tryCfgGetD(tryGetIntGen("limits", "memoryMB"), 0, inst.cfgs...); v > 0 {
+		limits["memory.max"] = fmt.Sprint(int64(v) * 1024 * 1024)
+	}
+	if v := tryCfgGetD(tryGetIntGen("limits", "pidsMax"), 0, inst.cfgs...); v > 0 {
+		limits["pids.max"] = fmt.Sprint(v)
+	}
+	if v := tryCfgGetD(tryGetIntGen("limits", "ioWeight"), 0, inst.cfgs...); v > 0 {
+		if v > 10000 {
+			v = 10000
+		}
+		limits["io.weight"] = fmt.Sprintf("default %d", v)
+	}
+	for k, v := range limits {
+		err = os.WriteFile(path.Join(cgpath, k), []byte(v), 0)
+		if err != nil {
+			cgroupRemove(cgpath)
+			return "", fmt.Errorf("setting %s: %w", k, err)
+		}
+	}
+	inst.logger.Printf("Created cgroup %q with limits %v", cgpath, limits)
+	return cgpath, nil
+}
+
+// cgroupEnableControllers delegates controllers to children of parent
+func cgroupEnableControllers(parent string) error {
+	b, err := os.ReadFile(path.Join(parent, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	enabled := strings.Fields(string(b))
+	toEnable := []string{}
+	for _, c := range cgroupControllers {
+		if !slices.Contains(enabled, c) {
+			toEnable = append(toEnable, "+"+c)
+		}
+	}
+	if len(toEnable) == 0 {
+		return nil
+	}
+	return os.WriteFile(path.Join(parent, "cgroup.subtree_control"), []byte(strings.Join(toEnable, " ")), 0)
+}
+
+func cgroupRemove(cgpath string) error {
+	if cgpath == "" {
+		return nil
+	}
+	err := os.Remove(cgpath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func cgroupReadInt(cgpath, file string) (int64, bool) {
+	b, err := os.ReadFile(path.Join(cgpath, file))
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	return v, err == nil
+}
+
+// cgroupReadKeyed parses flat keyed files like cpu.stat and memory.events
+func cgroupReadKeyed(cgpath, file string) map[string]int64 {
+	ret := map[string]int64{}
+	f, err := os.Open(path.Join(cgpath, file))
+	if err != nil {
+		return ret
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		k, v, ok := strings.Cut(s.Text(), " ")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err == nil {
+			ret[k] = n
+		}
+	}
+	return ret
+}
+
+type cgroupUsage struct {
+	CPUSeconds    float64 `json:"cpuSeconds"`
+	CPUThrottled  int64   `json:"cpuThrottledPeriods"`
+	MemoryBytes   int64   `json:"memoryBytes"`
+	MemoryPeak    int64   `json:"memoryPeakBytes,omitempty"`
+	MemoryMax     int64   `json:"memoryMaxBytes,omitempty"`
+	Pids          int64   `json:"pids"`
+	OOMKills      int64   `json:"oomKills"`
+	MemoryHighHit int64   `json:"memoryHighEvents"`
+}
+
+func cgroupReadUsage(cgpath string) *cgroupUsage {
+	if cgpath == "" {
+		return nil
+	}
+	if _, err := os.Stat(cgpath); err != nil {
+		return nil
+	}
+	cpu := cgroupReadKeyed(cgpath, "cpu.stat")
+	mev := cgroupReadKeyed(cgpath, "memory.events")
+	u := &cgroupUsage{
+		CPUSeconds:    float64(cpu["usage_usec"]) / 1e6,
+		CPUThrottled:  cpu["nr_throttled"],
+		OOMKills:      mev["oom_kill"],
+		MemoryHighHit: mev["high"],
+	}
+	u.MemoryBytes, _ = cgroupReadInt(cgpath, "memory.current")
+	u.MemoryPeak, _ = cgroupReadInt(cgpath, "memory.peak")
+	u.MemoryMax, _ = cgroupReadInt(cgpath, "memory.max") // "max" fails to parse and stays 0
+	u.Pids, _ = cgroupReadInt(cgpath, "pids.current")
+	return u
+}
@@ -7,6 +7,7 @@ const (
 	icShutdown
 	icBroadcast
 	icRunnerStop
+	icRawCommand
 )
 
 type instanceCommand struct {
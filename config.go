@@ -24,6 +24,17 @@ func loadConfig() {
 	if err != nil {
 		log.Fatalf("Failed to read config: %s", err.Error())
 	}
+	// same as /reload, rather not start than run with half of the config ignored
+	errs, warnings := configSplitWarnings(configValidateFile("config.json"))
+	for _, err := range warnings {
+		log.Printf("Config warning: %s", err.Error())
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Config problem: %s", err.Error())
+		}
+		log.Fatalf("Config has %d problems, refusing to start", len(errs))
+	}
 	ms, err = mapstorage.NewMapstorage(cfg.LinkSubTree("mapstorage"))
 	if err != nil {
 		log.Fatalf("Failed to init map storage: %s", err.Error())
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"autohoster-backend/mapstorage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// config is read lazily with defaults all over the place, so a typo silently
+// falls back to a default. Schema below describes every key backend reads,
+// configValidate walks parsed config.json against it and reports unknown
+// keys and wrong types with their full path.
+//
+// Queue, map and settingsFallback objects share instance settings since they
+// are layered on top of each other (map > queue > settingsFallback).
+
+type cfgKind int
+
+const (
+	cfgKindObject cfgKind = iota
+	cfgKindMap
+	cfgKindString
+	cfgKindInt
+	cfgKindNumber
+	cfgKindBool
+	cfgKindStringList
+	cfgKindIntList
+	cfgKindAny
+)
+
+func (k cfgKind) String() string {
+	switch k {
+	case cfgKindObject, cfgKindMap:
+		return "object"
+	case cfgKindString:
+		return "string"
+	case cfgKindInt:
+		return "integer"
+	case cfgKindNumber:
+		return "number"
+	case cfgKindBool:
+		return "boolean"
+	case cfgKindStringList:
+		return "array of strings"
+	case cfgKindIntList:
+		return "array of integers"
+	}
+	return "any"
+}
+
+// cfgWarning is a problem that is reported but does not make config invalid
+type cfgWarning struct {
+	err error
+}
+
+func (w cfgWarning) Error() string {
+	return w.err.Error()
+}
+
+func (w cfgWarning) Unwrap() error {
+	return w.err
+}
+
+func cfgWarnf(format string, args ...any) error {
+	return cfgWarning{err: fmt.Errorf(format, args...)}
+}
+
+// configSplitWarnings separates warnings from problems that make config invalid
+func configSplitWarnings(errs []error) (problems []error, warnings []error) {
+	for _, err := range errs {
+		if _, ok := err.(cfgWarning); ok {
+			warnings = append(warnings, err)
+		} else {
+			problems = append(problems, err)
+		}
+	}
+	return problems, warnings
+}
+
+type cfgSchema struct {
+	kind cfgKind
+	// object fields
+	fields   map[string]*cfgSchema
+	required []string
+	// map values and optional key check
+	elem     *cfgSchema
+	keyCheck func(k string) error
+	// null is accepted to unset value of lower layer
+	nullable bool
+	check    func(v any) error
+}
+
+func cfgObject(fields map[string]*cfgSchema, required ...string) *cfgSchema {
+	return &cfgSchema{kind: cfgKindObject, fields: fields, required: required}
+}
+
+func cfgMapOf(elem *cfgSchema) *cfgSchema {
+	return &cfgSchema{kind: cfgKindMap, elem: elem}
+}
+
+func cfgOf(kind cfgKind) *cfgSchema {
+	return &cfgSchema{kind: kind}
+}
+
+func (s *cfgSchema) withCheck(check func(v any) error) *cfgSchema {
+	s.check = check
+	return s
+}
+
+func (s *cfgSchema) withKeyCheck(check func(k string) error) *cfgSchema {
+	s.keyCheck = check
+	return s
+}
+
+func (s *cfgSchema) orNull() *cfgSchema {
+	s.nullable = true
+	return s
+}
+
+func cfgEnum(vals ...string) *cfgSchema {
+	return cfgOf(cfgKindString).withCheck(func(v any) error {
+		for _, e := range vals {
+			if v == e {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(vals, ", "))
+	})
+}
+
+func cfgIntMin(min int) *cfgSchema {
+	return cfgOf(cfgKindInt).withCheck(func(v any) error {
+		if int(v.(float64)) < min {
+			return fmt.Errorf("must be at least %d", min)
+		}
+		return nil
+	})
+}
+
+// numbers or ranges "1,3,5-7" as used by ports and pickNumber
+var cfgNumbersRegexp = regexp.MustCompile(`^\s*[0-9]+(\s*-\s*[0-9]+)?(\s*,\s*[0-9]+(\s*-\s*[0-9]+)?)*\s*$`)
+
+func cfgNumbers() *cfgSchema {
+	return cfgOf(cfgKindString).withCheck(func(v any) error {
+		if !cfgNumbersRegexp.MatchString(v.(string)) {
+			return errors.New("must be comma separated numbers, like \"0,1,2\"")
+		}
+		return nil
+	})
+}
+
+func cfgCheckCIDR(k string) error {
+	_, _, err := net.ParseCIDR(k)
+	return err
+}
+
+func cfgInstanceSettingsFields() map[string]*cfgSchema {
+	announceKind := cfgObject(map[string]*cfgSchema{
+		"enabled":     cfgOf(cfgKindBool),
+		"title":       cfgOf(cfgKindString),
+		"description": cfgOf(cfgKindString),
+		"color":       cfgOf(cfgKindInt),
+	})
+	announce := map[string]*cfgSchema{
+		"enabled":    cfgOf(cfgKindBool),
+		"webhook":    cfgOf(cfgKindString),
+		"gameUrlFmt": cfgOf(cfgKindString),
+	}
+	for _, k := range announceKindKeys {
+		announce[k] = announceKind
+	}
+	return map[string]*cfgSchema{
+		"binary":                    cfgOf(cfgKindString),
+		"version":                   cfgOf(cfgKindString),
+		"players":                   cfgIntMin(2),
+		"startPlayers":              cfgIntMin(0),
+		"timelimit":                 cfgIntMin(0),
+		"displayCategory":           cfgOf(cfgKindInt),
+		"ratingCategories":          cfgOf(cfgKindIntList),
+		"roomName":                  cfgOf(cfgKindString),
+		"spectatorHost":             cfgOf(cfgKindBool),
+		"allowPositionChange":       cfgOf(cfgKindBool),
+		"submitGames":               cfgOf(cfgKindBool),
+		"settingsScavs":             cfgNumbers(),
+		"settingsAlliance":          cfgNumbers(),
+		"settingsPower":             cfgNumbers(),
+		"settingsBase":              cfgNumbers(),
+		"settingsTechLevel":         cfgNumbers(),
+		"settingsSpecSlots":         cfgNumbers(),
+		"adminsPolicy":              cfgEnum("nobody", "moderators", "whitelist"),
+		"admins":                    cfgOf(cfgKindStringList),
+		"fetchBanlist":              cfgOf(cfgKindString),
+		"allowNonLinkedChat":        cfgOf(cfgKindBool),
+		"allowNonLinkedHide":        cfgOf(cfgKindBool),
+		"allowNonLinkedJoin":        cfgOf(cfgKindBool),
+		"allowNonLinkedPlay":        cfgOf(cfgKindBool),
+		"antiSpamThresholdCount":    cfgIntMin(0),
+		"antiSpamThresholdDuration": cfgIntMin(0),
+		"shutdownTimeoutSeconds":    cfgIntMin(1),
+		"terminateGraceSeconds":     cfgIntMin(0),
+		"bannedASNs":                cfgOf(cfgKindStringList),
+		"ipmute":                    cfgMapOf(cfgOf(cfgKindBool)).withKeyCheck(cfgCheckCIDR),
+		"ipnoplay":                  cfgMapOf(cfgOf(cfgKindBool)).withKeyCheck(cfgCheckCIDR),
+		"motds":                     cfgMapOf(cfgOf(cfgKindString).orNull()),
+		"config":                    cfgMapOf(cfgOf(cfgKindString).orNull()),
+		"presetOverride":            cfgMapOf(cfgOf(cfgKindAny)),
+		"joinRules": cfgOf(cfgKindAny).withCheck(func(v any) error {
+			rules, err := parseJoinRules(v)
+			if err != nil {
+				return err
+			}
+			if !joinRulesHandleBans(rules) {
+				return cfgWarnf(`rules do not handle bans, banned players can join, add {"defaults": ["ban"]} to keep them out`)
+			}
+			return nil
+		}),
+		"autoBalance": cfgObject(map[string]*cfgSchema{
+			"enabled":       cfgOf(cfgKindBool),
+			"category":      cfgIntMin(0),
+			"unratedRating": cfgIntMin(0),
+			"teamCommand": cfgOf(cfgKindString).withCheck(func(v any) error {
+				_, err := template.New("teamCommand").Parse(v.(string))
+				return err
+			}),
+		}),
+		"ratingBounds": cfgMapOf(cfgObject(map[string]*cfgSchema{
+			"min":          cfgOf(cfgKindInt),
+			"max":          cfgOf(cfgKindInt),
+			"allowUnrated": cfgOf(cfgKindBool),
+			"message": cfgOf(cfgKindString).withCheck(func(v any) error {
+				_, err := joinParseTemplate("message", v.(string))
+				return err
+			}),
+		})).withKeyCheck(func(k string) error {
+			_, err := strconv.Atoi(k)
+			if err != nil {
+				return errors.New("must be a rating category number")
+			}
+			return nil
+		}),
+		"blacklist": cfgObject(map[string]*cfgSchema{
+			"name":    cfgOf(cfgKindStringList),
+			"message": cfgOf(cfgKindStringList),
+		}),
+		"locked": cfgObject(map[string]*cfgSchema{
+			"power":      cfgOf(cfgKindBool),
+			"alliances":  cfgOf(cfgKindBool),
+			"teams":      cfgOf(cfgKindBool),
+			"difficulty": cfgOf(cfgKindBool),
+			"ai":         cfgOf(cfgKindBool),
+			"scavengers": cfgOf(cfgKindBool),
+			"position":   cfgOf(cfgKindBool),
+			"bases":      cfgOf(cfgKindBool),
+		}),
+		"actions": cfgMapOf(cfgObject(map[string]*cfgSchema{
+			"op":   cfgEnum("copy"),
+			"from": cfgOf(cfgKindString),
+			"to":   cfgOf(cfgKindString),
+		}, "op", "from", "to").orNull()),
+		"limits": cfgObject(map[string]*cfgSchema{
+			"cpuPercent": cfgIntMin(1),
+			"memoryMB":   cfgIntMin(1),
+			"pidsMax":    cfgIntMin(1),
+			"ioWeight":   cfgIntMin(1),
+		}),
+		"sandbox": cfgObject(map[string]*cfgSchema{
+			"enabled":       cfgOf(cfgKindBool),
+			"dataDir":       cfgOf(cfgKindString),
+			"readOnlyPaths": cfgOf(cfgKindStringList),
+			"seccomp":       cfgOf(cfgKindBool),
+			"seccompDeny":   cfgOf(cfgKindStringList),
+		}),
+		"announce": cfgObject(announce),
+	}
+}
+
+func cfgWithFields(base map[string]*cfgSchema, extra map[string]*cfgSchema) map[string]*cfgSchema {
+	for k, v := range extra {
+		base[k] = v
+	}
+	return base
+}
+
+func cfgQueueSchema() *cfgSchema {
+	mapSchema := cfgObject(cfgWithFields(cfgInstanceSettingsFields(), map[string]*cfgSchema{
+		"hash": cfgOf(cfgKindString),
+		"weight": cfgOf(cfgKindNumber).withCheck(func(v any) error {
+			if v.(float64) < 0 {
+				return errors.New("must not be negative")
+			}
+			return nil
+		}),
+	}), "hash")
+	return cfgObject(cfgWithFields(cfgInstanceSettingsFields(), map[string]*cfgSchema{
+		"disabled":                cfgOf(cfgKindBool),
+		"priority":                cfgOf(cfgKindInt),
+		"minLobbyRooms":           cfgIntMin(0),
+		"maxLobbyRooms":           cfgIntMin(0),
+		"scaleUpThresholdPercent": cfgIntMin(0),
+		"ports":                   cfgNumbers(),
+		"maps":                    cfgMapOf(mapSchema),
+		"mapRotation": cfgObject(map[string]*cfgSchema{
+			"noRepeatWithin":  cfgIntMin(0),
+			"mode":            cfgEnum("random", "leastPlayed"),
+			"leastPlayedDays": cfgIntMin(1),
+		}),
+		"schedule": cfgObject(map[string]*cfgSchema{
+			"timezone": cfgOf(cfgKindString).withCheck(func(v any) error {
+				_, err := time.LoadLocation(v.(string))
+				return err
+			}),
+			"windows": cfgOf(cfgKindAny).withCheck(func(v any) error {
+				windows, ok := v.([]any)
+				if !ok {
+					return errors.New("must be an array")
+				}
+				for i, w := range windows {
+					_, err := parseScheduleWindow(w)
+					if err != nil {
+						return fmt.Errorf("window %d: %w", i, err)
+					}
+				}
+				return nil
+			}),
+		}, "windows"),
+	}))
+}
+
+func cfgRootSchema() *cfgSchema {
+	return cfgObject(map[string]*cfgSchema{
+		"databaseConnString":          cfgOf(cfgKindString),
+		"migrateOnStartup":            cfgEnum("off", "check", "apply"),
+		"listenAddr":                  cfgOf(cfgKindString),
+		"instancesPath":               cfgOf(cfgKindString),
+		"archivesPath":                cfgOf(cfgKindString),
+		"replayStorage":               cfgOf(cfgKindString),
+		"filePerms":                   cfgIntMin(0),
+		"dirPerms":                    cfgIntMin(0),
+		"ports":                       cfgNumbers(),
+		"portProbe":                   cfgOf(cfgKindBool),
+		"portCooldownSeconds":         cfgIntMin(0),
+		"allowSpawn":                  cfgOf(cfgKindBool),
+		"shutdownHostsOnExit":         cfgOf(cfgKindBool),
+		"recordInstances":             cfgOf(cfgKindBool),
+		"recordJoinDecisions":         cfgOf(cfgKindBool),
+		"joinDecisionsRetentionDays":  cfgIntMin(0),
+		"spawnScaleReserve":           cfgIntMin(0),
+		"spawnCutoutLobbyRooms":       cfgIntMin(0),
+		"spawnCutoutRunningRooms":     cfgIntMin(0),
+		"lobbyPollInterval":           cfgIntMin(1),
+		"instanceCleanupTimer":        cfgIntMin(1),
+		"binaryVersionTimeoutSeconds": cfgIntMin(1),
+		"cgroupParent":                cfgOf(cfgKindString),
+		"drainSignalMode": cfgOf(cfgKindString).withCheck(func(v any) error {
+			_, err := parseDrainMode(v.(string))
+			return err
+		}),
+		"discordErrorsWebhook": cfgOf(cfgKindString),
+		"logs": cfgObject(map[string]*cfgSchema{
+			"filename": cfgOf(cfgKindString),
+			"maxsize":  cfgIntMin(1),
+		}),
+		"mapstorage": cfgObject(map[string]*cfgSchema{
+			"root":      cfgOf(cfgKindString),
+			"filePerms": cfgIntMin(0),
+			"dirPerms":  cfgIntMin(0),
+			"maxSizeMB": cfgIntMin(0),
+			"backends": cfgOf(cfgKindAny).withCheck(func(v any) error {
+				_, err := mapstorage.ParseBackends(v)
+				return err
+			}),
+		}),
+		"ispcheck": cfgObject(map[string]*cfgSchema{
+			"cachePath":          cfgOf(cfgKindString),
+			"urlFmt":             cfgOf(cfgKindString),
+			"httpTimeoutSeconds": cfgIntMin(1),
+			"filePerms":          cfgIntMin(0),
+		}),
+		"apiTokens": cfgMapOf(cfgObject(map[string]*cfgSchema{
+			"token": cfgOf(cfgKindString),
+			"roles": cfgOf(cfgKindStringList).withCheck(func(v any) error {
+				for _, r := range v.([]any) {
+					switch apiRole(r.(string)) {
+					case apiRoleView, apiRoleModerate, apiRoleAdmin:
+					default:
+						return fmt.Errorf("unknown role %q", r)
+					}
+				}
+				return nil
+			}),
+		}, "token")),
+		"notifiers": cfgMapOf(cfgObject(map[string]*cfgSchema{
+			"type":       cfgEnum("discord", "webhook", "slack", "matrix", "file"),
+			"url":        cfgOf(cfgKindString),
+			"path":       cfgOf(cfgKindString),
+			"categories": cfgOf(cfgKindStringList),
+			"minSeverity": cfgOf(cfgKindString).withCheck(func(v any) error {
+				if _, ok := parseNotifySeverity(v.(string)); !ok {
+					return errors.New("must be one of info, warning, error")
+				}
+				return nil
+			}),
+			"disabled":           cfgOf(cfgKindBool),
+			"dedupSeconds":       cfgIntMin(0),
+			"rateLimitPerMinute": cfgIntMin(0),
+			"aggregateSeconds":   cfgIntMin(0),
+		}, "type")),
+		"binaries": cfgMapOf(cfgObject(map[string]*cfgSchema{
+			"path":   cfgOf(cfgKindString),
+			"sha256": cfgOf(cfgKindString),
+		}, "path")),
+		"settingsFallback": cfgObject(cfgInstanceSettingsFields()),
+		"queues":           cfgMapOf(cfgQueueSchema()),
+	})
+}
+
+func cfgPathJoin(p, k string) string {
+	if strings.ContainsAny(k, ". \"") || k == "" {
+		k = strconv.Quote(k)
+	}
+	if p == "" {
+		return k
+	}
+	return p + "." + k
+}
+
+func cfgJSONTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func cfgIsInt(v any) bool {
+	f, ok := v.(float64)
+	return ok && f == math.Trunc(f) && !math.IsInf(f, 0)
+}
+
+func (s *cfgSchema) typeMatches(v any) bool {
+	switch s.kind {
+	case cfgKindObject, cfgKindMap:
+		_, ok := v.(map[string]any)
+		return ok
+	case cfgKindString:
+		_, ok := v.(string)
+		return ok
+	case cfgKindInt:
+		return cfgIsInt(v)
+	case cfgKindNumber:
+		_, ok := v.(float64)
+		return ok
+	case cfgKindBool:
+		_, ok := v.(bool)
+		return ok
+	case cfgKindStringList, cfgKindIntList:
+		a, ok := v.([]any)
+		if !ok {
+			return false
+		}
+		for _, e := range a {
+			if s.kind == cfgKindStringList {
+				if _, ok := e.(string); !ok {
+					return false
+				}
+			} else if !cfgIsInt(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return true
+}
+
+func (s *cfgSchema) validate(p string, v any, errs []error) []error {
+	if v == nil && s.nullable {
+		return errs
+	}
+	if !s.typeMatches(v) {
+		return append(errs, fmt.Errorf("%s: expected %s, got %s", p, s.kind, cfgJSONTypeName(v)))
+	}
+	if s.check != nil {
+		if err := s.check(v); err != nil {
+			if w, ok := err.(cfgWarning); ok {
+				errs = append(errs, cfgWarning{err: fmt.Errorf("%s: %w", p, w.err)})
+			} else {
+				errs = append(errs, fmt.Errorf("%s: %w", p, err))
+			}
+		}
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return errs
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	switch s.kind {
+	case cfgKindObject:
+		for _, k := range s.required {
+			if _, ok := m[k]; !ok {
+				errs = append(errs, fmt.Errorf("%s: missing required key", cfgPathJoin(p, k)))
+			}
+		}
+		for _, k := range keys {
+			fs, ok := s.fields[k]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown key", cfgPathJoin(p, k)))
+				continue
+			}
+			errs = fs.validate(cfgPathJoin(p, k), m[k], errs)
+		}
+	case cfgKindMap:
+		for _, k := range keys {
+			if s.keyCheck != nil {
+				if err := s.keyCheck(k); err != nil {
+					errs = append(errs, fmt.Errorf("%s: invalid key: %w", cfgPathJoin(p, k), err))
+				}
+			}
+			errs = s.elem.validate(cfgPathJoin(p, k), m[k], errs)
+		}
+	}
+	return errs
+}
+
+// configValidate checks config.json contents against the schema, returns every problem found
+func configValidate(b []byte) []error {
+	var v any
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return []error{fmt.Errorf("parsing json: %w", err)}
+	}
+	if _, ok := v.(map[string]any); !ok {
+		return []error{fmt.Errorf("config must be an object, got %s", cfgJSONTypeName(v))}
+	}
+	return cfgRootSchema().validate("", v, nil)
+}
+
+func configValidateFile(p string) []error {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return []error{err}
+	}
+	return configValidate(b)
+}
+
+func commandValidate(args []string) {
+	p := "config.json"
+	if len(args) > 0 {
+		p = args[0]
+	}
+	errs, warnings := configSplitWarnings(configValidateFile(p))
+	for _, err := range warnings {
+		fmt.Println("warning: " + err.Error())
+	}
+	for _, err := range errs {
+		fmt.Println(err.Error())
+	}
+	if len(errs) > 0 {
+		fmt.Printf("%s has %d problems\n", p, len(errs))
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid\n", p)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{"empty", `{}`, nil},
+		{"not an object", `[]`, []string{"config must be an object, got array"}},
+		{"broken json", `{"queues": }`, []string{"parsing json: invalid character '}' looking for beginning of value"}},
+
+		{"unknown root key", `{"listenAdr": ":8080"}`, []string{"listenAdr: unknown key"}},
+		{"unknown nested key", `{"queues": {"q": {"playres": 4}}}`, []string{"queues.q.playres: unknown key"}},
+		{"unknown key with dot is quoted", `{"settingsFallback": {"sandbox.enabled": true}}`, []string{`settingsFallback."sandbox.enabled": unknown key`}},
+		{"map key with dot is quoted", `{"queues": {"4.5 ranked": {"players": "4"}}}`, []string{`queues."4.5 ranked".players: expected integer, got string`}},
+		{"empty key is quoted", `{"queues": {"": {"roomName": 1}}}`, []string{`queues."".roomName: expected string, got number`}},
+		{"problems are sorted by key", `{"queues": {"b": {"x": 1}, "a": {"y": 1}}}`, []string{"queues.a.y: unknown key", "queues.b.x: unknown key"}},
+
+		{"fractional integer", `{"settingsFallback": {"players": 2.5}}`, []string{"settingsFallback.players: expected integer, got number"}},
+		{"integer below minimum", `{"settingsFallback": {"players": 1}}`, []string{"settingsFallback.players: must be at least 2"}},
+		{"bool as string", `{"allowSpawn": "true"}`, []string{"allowSpawn: expected boolean, got string"}},
+		{"string list with number", `{"settingsFallback": {"admins": ["a", 1]}}`, []string{"settingsFallback.admins: expected array of strings, got array"}},
+		{"enum", `{"migrateOnStartup": "yes"}`, []string{"migrateOnStartup: must be one of off, check, apply"}},
+		{"numbers", `{"ports": "2100-2200,abc"}`, []string{`ports: must be comma separated numbers, like "0,1,2"`}},
+
+		{"null unsets lower layer", `{"queues": {"q": {"motds": {"welcome": null}, "actions": {"copy": null}}}}`, nil},
+		{"null where not allowed", `{"settingsFallback": {"players": null}}`, []string{"settingsFallback.players: expected integer, got null"}},
+
+		{"required key", `{"binaries": {"4.5.0": {"sha256": "ab"}}}`, []string{`binaries."4.5.0".path: missing required key`}},
+		{"required map hash", `{"queues": {"q": {"maps": {"Sk-Rush": {"weight": 2}}}}}`, []string{"queues.q.maps.Sk-Rush.hash: missing required key"}},
+		{"required keys of actions", `{"settingsFallback": {"actions": {"a": {"op": "copy"}}}}`, []string{
+			"settingsFallback.actions.a.from: missing required key",
+			"settingsFallback.actions.a.to: missing required key",
+		}},
+
+		{"ipmute cidr", `{"settingsFallback": {"ipmute": {"10.0.0.0/8": true, "::1/128": false}}}`, nil},
+		{"ipmute plain address", `{"settingsFallback": {"ipmute": {"10.0.0.1": true}}}`, []string{`settingsFallback.ipmute."10.0.0.1": invalid key: invalid CIDR address: 10.0.0.1`}},
+		{"ipmute value type", `{"queues": {"q": {"ipmute": {"10.0.0.0/8": "yes"}}}}`, []string{`queues.q.ipmute."10.0.0.0/8": expected boolean, got string`}},
+
+		{"ratingBounds", `{"settingsFallback": {"ratingBounds": {"3": {"min": 1200, "allowUnrated": false}}}}`, nil},
+		{"ratingBounds category", `{"settingsFallback": {"ratingBounds": {"elo": {"min": 1200}}}}`, []string{"settingsFallback.ratingBounds.elo: invalid key: must be a rating category number"}},
+		{"ratingBounds value", `{"settingsFallback": {"ratingBounds": {"3": {"max": "1500"}}}}`, []string{"settingsFallback.ratingBounds.3.max: expected integer, got string"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := []string{}
+			for _, err := range configValidate([]byte(tc.config)) {
+				got = append(got, err.Error())
+			}
+			want := tc.want
+			if want == nil {
+				want = []string{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("validating %s\ngot  %q\nwant %q", tc.config, got, want)
+			}
+		})
+	}
+}
@@ -3,93 +3,49 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"time"
 )
 
-var (
-	discordPostErrors = make(chan string, 128)
-)
-
-func routineDiscordErrorReporter() {
-	// lastMessage := time.Now()
-	lastAggregate := ""
-	dflusher := time.NewTicker(time.Second * 60)
-	for {
-		select {
-		case msg := <-discordPostErrors:
-			lastAggregate += msg + "\n"
-			// if time.Since(lastMessage).Seconds() > 2.5*float64(time.Second) {
-			// 	discordSendError(lastAggregate)
-			// 	lastAggregate = ""
-			// 	lastMessage = time.Now()
-			// }
-		case <-dflusher.C:
-			if lastAggregate == "" {
-				continue
-			}
-			discordSendError(lastAggregate)
-			lastAggregate = ""
-			// lastMessage = time.Now()
-		}
-	}
-}
-
-func discordSendError(content string) {
-	webhookUrl, ok := cfg.GetString("discordErrorsWebhook")
-	if !ok {
-		log.Println("Errors discord webhook not set!!!")
-		return
-	}
-	if len(content) < 1995 {
-		discordSendErrorWithContent(webhookUrl, content)
-	} else {
-		discordSendErrorWithFile(webhookUrl, content)
-	}
-}
-
-func discordSendErrorWithContent(webhookUrl, content string) {
+func discordSendWithContent(webhookUrl, content string) error {
 	payload_json, err := json.Marshal(map[string]interface{}{
 		"username": "Backend",
 		"content":  content,
 	})
 	if err != nil {
-		log.Println("Error marshling webhook json payload:", err)
-		return
+		return errors.New("marshling webhook json payload: " + err.Error())
 	}
 	req, err := http.NewRequest("POST", webhookUrl, bytes.NewBuffer(payload_json))
 	if err != nil {
-		log.Println("Error creating webhook request:", err)
-		return
+		return errors.New("creating webhook request: " + err.Error())
 	}
 	req.Header.Add("Content-Type", "application/json")
 	c := http.Client{Timeout: 5 * time.Second}
 	resp, err := c.Do(req)
 	if err != nil {
-		log.Println("Error sending webhook:", err)
-		return
+		return errors.New("sending webhook: " + err.Error())
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 && resp.StatusCode != 204 {
-		defer resp.Body.Close()
 		responseBody, err := io.ReadAll(resp.Body)
 		if err != nil {
-			log.Println("Error sending webhook:", err)
+			return errors.New("reading webhook response: " + err.Error())
 		}
-		log.Println("Error sending webhook:", responseBody)
+		return fmt.Errorf("discord returned %d: %s", resp.StatusCode, string(responseBody))
 	}
+	return nil
 }
 
-func discordSendErrorWithFile(webhookUrl, content string) {
+func discordSendWithFile(webhookUrl, content string) error {
 	payload_json, err := json.Marshal(map[string]interface{}{
 		"username": "Backend",
 	})
 	if err != nil {
-		log.Println("Error marshling webhook json:", err)
-		return
+		return errors.New("marshling webhook json: " + err.Error())
 	}
 
 	var b bytes.Buffer
@@ -97,48 +53,64 @@ func discordSendErrorWithFile(webhookUrl, content string) {
 
 	p1w, err := w.CreateFormField("payload_json")
 	if err != nil {
-		log.Println("Error creating webhook json multipart:", err)
-		return
+		return errors.New("creating webhook json multipart: " + err.Error())
 	}
 	_, err = p1w.Write(payload_json)
 	if err != nil {
-		log.Println("Error writing webhook json multipart:", err)
-		return
+		return errors.New("writing webhook json multipart: " + err.Error())
 	}
 	p2w, err := w.CreateFormFile("file[0]", "msg.txt")
 	if err != nil {
-		log.Println("Error creating webhook content multipart:", err)
-		return
+		return errors.New("creating webhook content multipart: " + err.Error())
 	}
 	_, err = p2w.Write([]byte(content))
 	if err != nil {
-		log.Println("Error writing webhook content multipart:", err)
-		return
+		return errors.New("writing webhook content multipart: " + err.Error())
 	}
 	w.Close()
 
 	req, err := http.NewRequest("POST", webhookUrl, &b)
 	if err != nil {
-		log.Println("Error creating webhook request:", err)
-		return
+		return errors.New("creating webhook request: " + err.Error())
 	}
 	req.Header.Set("Content-Type", w.FormDataContentType())
 
 	c := http.Client{Timeout: 5 * time.Second}
 	res, err := c.Do(req)
 	if err != nil {
-		log.Println("Error sending webhook request:", err)
-		return
+		return errors.New("sending webhook request: " + err.Error())
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
 		rspb, err := io.ReadAll(res.Body)
 		if err != nil {
-			log.Println("Error reading discord's webhook response: ", err)
+			return errors.New("reading discord's webhook response: " + err.Error())
 		}
-		log.Println("Discord returned not 200: ", res.StatusCode, string(rspb))
+		return fmt.Errorf("discord returned %d: %s", res.StatusCode, string(rspb))
 	}
+	return nil
 }
 
-func discordPostError(format string, args ...any) {
-	discordPostErrors <- fmt.Sprintf(format, args...)
+func discordSendEmbed(webhookUrl string, embed map[string]any) error {
+	payload_json, err := json.Marshal(map[string]any{
+		"username": "Autohoster",
+		"embeds":   []map[string]any{embed},
+	})
+	if err != nil {
+		return errors.New("marshling webhook json payload: " + err.Error())
+	}
+	c := http.Client{Timeout: 5 * time.Second}
+	resp, err := c.Post(webhookUrl, "application/json", bytes.NewBuffer(payload_json))
+	if err != nil {
+		return errors.New("sending webhook: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		responseBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return errors.New("reading webhook response: " + err.Error())
+		}
+		return fmt.Errorf("discord returned %d: %s", resp.StatusCode, string(responseBody))
+	}
+	return nil
 }
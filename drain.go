@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// drain mode stops spawning, closes empty lobby rooms and lets games finish.
+// Modes:
+//
+//	drain   - wait for everything to finish and stay idle
+//	exit    - same but exit once nothing is left
+//	handoff - as soon as nothing is in lobby the backend shuts down leaving
+//	          games running and re-executes its own binary in place (same pid,
+//	          so running games stay our children), new process picks them up
+//	          with recoverInstances. Replace the binary on disk before
+//	          starting the drain to upgrade without interrupting games.
+//
+// Toggled with POST/DELETE /drain or SIGUSR1 (mode from drainSignalMode, default drain).
+
+type drainMode string
+
+const (
+	drainModeDrain   drainMode = "drain"
+	drainModeExit    drainMode = "exit"
+	drainModeHandoff drainMode = "handoff"
+)
+
+type drainProgress struct {
+	Draining      bool      `json:"draining"`
+	Mode          drainMode `json:"mode,omitempty"`
+	Since         time.Time `json:"since,omitempty"`
+	Starting      int       `json:"starting"`
+	LobbyEmpty    int       `json:"lobbyEmpty"`
+	LobbyOccupied int       `json:"lobbyOccupied"`
+	InGame        int       `json:"inGame"`
+	Exiting       int       `json:"exiting"`
+	Done          bool      `json:"done"`
+}
+
+var (
+	draining         atomic.Bool
+	drainLock        sync.Mutex
+	drainCurrentMode drainMode
+	drainSince       time.Time
+	drainLast        drainProgress
+
+	// drainExit asks main to shut down, true if runners should be detached instead of stopped
+	drainExit = make(chan bool, 1)
+
+	errDraining = errors.New("backend is draining")
+)
+
+func parseDrainMode(s string) (drainMode, error) {
+	switch m := drainMode(s); m {
+	case drainModeDrain, drainModeExit, drainModeHandoff:
+		return m, nil
+	case "":
+		return drainModeDrain, nil
+	}
+	return "", errors.New("unknown drain mode " + s)
+}
+
+func drainStart(mode drainMode) {
+	drainLock.Lock()
+	defer drainLock.Unlock()
+	if !draining.Load() {
+		drainSince = time.Now()
+	}
+	drainCurrentMode = mode
+	draining.Store(true)
+	log.Printf("Drain started in %s mode", mode)
+	notifyPost(notifySeverityInfo, notifyCategoryInfra, "Backend drain started in %s mode", mode)
+}
+
+func drainCancel() {
+	drainLock.Lock()
+	defer drainLock.Unlock()
+	if !draining.Load() {
+		return
+	}
+	draining.Store(false)
+	drainLast = drainProgress{}
+	log.Printf("Drain cancelled")
+	// rooms that got shutdown ordered are already on their way out, nothing to undo
+}
+
+func drainToggle() {
+	if draining.Load() {
+		drainCancel()
+		return
+	}
+	mode, err := parseDrainMode(cfg.GetDSString("drain", "drainSignalMode"))
+	if err != nil {
+		log.Printf("Invalid drainSignalMode: %s", err)
+		mode = drainModeDrain
+	}
+	drainStart(mode)
+}
+
+// drainStepNOLOCK orders empty lobby rooms to shut down and counts what is left,
+// room is empty when everyone who joined has left again (spectators included)
+func drainStepNOLOCK() drainProgress {
+	p := drainProgress{}
+	for _, inst := range instances {
+		switch instanceState(inst.state.Load()) {
+		case instanceStateInitial, instanceStateStarting, instanceStateInLobby:
+			if inst.lobbyOccupants.Load() > 0 {
+				p.LobbyOccupied++
+				continue
+			}
+			if instanceState(inst.state.Load()) == instanceStateStarting {
+				p.Starting++
+			} else {
+				p.LobbyEmpty++
+			}
+			if inst.drainShutdownSent {
+				continue
+			}
+			select {
+			case inst.commands <- instanceCommand{command: icShutdown}:
+				inst.logger.Println("Draining, shutting down empty room")
+				inst.drainShutdownSent = true
+			default:
+			}
+		case instanceStateInGame:
+			p.InGame++
+		case instanceStateExiting:
+			p.Exiting++
+		}
+	}
+	return p
+}
+
+func drainStatus() drainProgress {
+	drainLock.Lock()
+	defer drainLock.Unlock()
+	p := drainLast
+	p.Draining = draining.Load()
+	if p.Draining {
+		p.Mode = drainCurrentMode
+		p.Since = drainSince
+	}
+	return p
+}
+
+func routineDrainer(closechan <-chan struct{}) {
+	for {
+		select {
+		case <-closechan:
+			return
+		case <-time.After(2 * time.Second):
+		}
+		if !draining.Load() {
+			continue
+		}
+		instancesLock.Lock()
+		p := drainStepNOLOCK()
+		instancesLock.Unlock()
+
+		drainLock.Lock()
+		mode := drainCurrentMode
+		switch mode {
+		case drainModeHandoff:
+			p.Done = p.Starting+p.LobbyEmpty+p.LobbyOccupied == 0
+		default:
+			p.Done = p.Starting+p.LobbyEmpty+p.LobbyOccupied+p.InGame+p.Exiting == 0
+		}
+		changed := p != drainLast
+		drainLast = p
+		drainLock.Unlock()
+
+		if changed {
+			log.Printf("Drain progress: %d starting, %d empty in lobby, %d occupied in lobby, %d in game, %d exiting",
+				p.Starting, p.LobbyEmpty, p.LobbyOccupied, p.InGame, p.Exiting)
+		}
+		if p.Done && mode != drainModeDrain {
+			log.Printf("Drain (%s) complete, requesting exit", mode)
+			select {
+			case drainExit <- mode == drainModeHandoff:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// drainReexec replaces current process with the binary at the path it was
+// started from, only returns if that fails
+func drainReexec() {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("Failed to locate own executable for handoff: %s", err)
+		return
+	}
+	log.Printf("Handing off to %s", exe)
+	err = syscall.Exec(exe, os.Args, os.Environ())
+	log.Printf("Failed to exec %s for handoff: %s", exe, err)
+}
+
+func apiHandleDrainStatus(w http.ResponseWriter, r *http.Request, _ string) {
+	apiRespondJSON(w, http.StatusOK, drainStatus())
+}
+
+func apiHandleDrainStart(w http.ResponseWriter, r *http.Request, tokenName string) {
+	mode, err := parseDrainMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		apiRespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("API: token %q started drain", tokenName)
+	drainStart(mode)
+	apiRespondJSON(w, http.StatusOK, drainStatus())
+}
+
+func apiHandleDrainCancel(w http.ResponseWriter, r *http.Request, tokenName string) {
+	log.Printf("API: token %q cancelled drain", tokenName)
+	drainCancel()
+	apiRespondJSON(w, http.StatusOK, drainStatus())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+func testDrainInstance(state instanceState, occupants int64) *instance {
+	inst := &instance{
+		commands: make(chan instanceCommand, 1),
+		logger:   log.New(io.Discard, "", 0),
+	}
+	inst.state.Store(int64(state))
+	inst.lobbyOccupants.Store(occupants)
+	return inst
+}
+
+func TestDrainStepCounting(t *testing.T) {
+	empty := testDrainInstance(instanceStateInLobby, 0)
+	starting := testDrainInstance(instanceStateStarting, 0)
+	occupied := testDrainInstance(instanceStateInLobby, 2)
+	left := testDrainInstance(instanceStateInLobby, 0)
+	left.joinCount.Store(3) // everyone who joined has left again
+	ingame := testDrainInstance(instanceStateInGame, 4)
+	exiting := testDrainInstance(instanceStateExiting, 0)
+
+	saved := instances
+	instances = []*instance{empty, starting, occupied, left, ingame, exiting}
+	defer func() { instances = saved }()
+
+	want := drainProgress{Starting: 1, LobbyEmpty: 2, LobbyOccupied: 1, InGame: 1, Exiting: 1}
+	p := drainStepNOLOCK()
+	if p != want {
+		t.Fatalf("got %+v want %+v", p, want)
+	}
+	for _, inst := range []*instance{empty, starting, left} {
+		if !inst.drainShutdownSent || len(inst.commands) != 1 {
+			t.Errorf("empty room in state %d was not ordered to shut down", inst.state.Load())
+		}
+	}
+	for _, inst := range []*instance{occupied, ingame, exiting} {
+		if inst.drainShutdownSent || len(inst.commands) != 0 {
+			t.Errorf("room in state %d was ordered to shut down", inst.state.Load())
+		}
+	}
+
+	// second step does not repeat the shutdown order
+	p = drainStepNOLOCK()
+	if p != want {
+		t.Fatalf("second step got %+v want %+v", p, want)
+	}
+	for _, inst := range []*instance{empty, starting, left} {
+		if len(inst.commands) != 1 {
+			t.Errorf("room in state %d got %d shutdown orders", inst.state.Load(), len(inst.commands))
+		}
+	}
+
+	// last player leaving the occupied room makes it drainable
+	occupied.lobbyOccupants.Store(0)
+	p = drainStepNOLOCK()
+	if p.LobbyOccupied != 0 || p.LobbyEmpty != 3 || !occupied.drainShutdownSent {
+		t.Fatalf("after leave got %+v, shutdown sent %v", p, occupied.drainShutdownSent)
+	}
+}
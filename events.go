@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type instanceEventType string
+
+const (
+	instanceEventStateChanged    instanceEventType = "stateChanged"
+	instanceEventLobbyAssigned   instanceEventType = "lobbyAssigned"
+	instanceEventJoinDecision    instanceEventType = "joinDecision"
+	instanceEventPlayerJoined    instanceEventType = "playerJoined"
+	instanceEventTeamsBalanced   instanceEventType = "teamsBalanced"
+	instanceEventGameStarted     instanceEventType = "gameStarted"
+	instanceEventReportSubmitted instanceEventType = "reportSubmitted"
+	instanceEventArchived        instanceEventType = "instanceArchived"
+)
+
+type instanceEvent struct {
+	Type     instanceEventType `json:"type"`
+	Time     time.Time         `json:"time"`
+	Instance int64             `json:"instance"`
+	Queue    string            `json:"queue"`
+	Data     any               `json:"data,omitempty"`
+}
+
+type eventBus struct {
+	lock sync.Mutex
+	subs map[chan instanceEvent]struct{}
+}
+
+var events = eventBus{
+	subs: map[chan instanceEvent]struct{}{},
+}
+
+func (b *eventBus) subscribe() chan instanceEvent {
+	c := make(chan instanceEvent, 128)
+	b.lock.Lock()
+	b.subs[c] = struct{}{}
+	b.lock.Unlock()
+	return c
+}
+
+func (b *eventBus) unsubscribe(c chan instanceEvent) {
+	b.lock.Lock()
+	delete(b.subs, c)
+	b.lock.Unlock()
+}
+
+// publish never blocks, slow subscribers lose events
+func (b *eventBus) publish(e instanceEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for c := range b.subs {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+func publishInstanceEvent(inst *instance, t instanceEventType, data any) {
+	events.publish(instanceEvent{
+		Type:     t,
+		Time:     time.Now(),
+		Instance: inst.Id,
+		Queue:    inst.QueueName,
+		Data:     data,
+	})
+}
+
+func apiHandleEvents(w http.ResponseWriter, r *http.Request, tokenName string) {
+	var filterTypes []string
+	if t := r.URL.Query().Get("types"); t != "" {
+		filterTypes = strings.Split(t, ",")
+	}
+	rc := http.NewResponseController(w)
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		apiRespondError(w, http.StatusInternalServerError, "streaming not supported: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	log.Printf("API: token %q subscribed to events", tokenName)
+	defer log.Printf("API: token %q unsubscribed from events", tokenName)
+	c := events.subscribe()
+	defer events.unsubscribe(c)
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			_, err = w.Write([]byte(": keepalive\n\n"))
+		case e := <-c:
+			if filterTypes != nil && !slices.Contains(filterTypes, string(e.Type)) {
+				continue
+			}
+			var b []byte
+			b, err = json.Marshal(e)
+			if err != nil {
+				log.Printf("Failed to marshal event: %s", err.Error())
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+		}
+		if err != nil {
+			return
+		}
+		err = rc.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -24,7 +24,14 @@ func submitReport(inst *instance, reportBytes []byte) {
 		err := recoverSave(inst)
 		if err != nil {
 			inst.logger.Printf("Failed to save instance recovery json: %s", err.Error())
-			discordPostError("Failed to save instance recovery json: %s (instance %d)", err.Error(), inst.Id)
+			notifyErrorf("Failed to save instance recovery json: %s (instance %d)", err.Error(), inst.Id)
+		}
+		if inst.GameId > 0 {
+			dbInstanceSave(inst)
+			publishInstanceEvent(inst, instanceEventReportSubmitted, map[string]any{
+				"gameId": inst.GameId,
+				"final":  false,
+			})
 		}
 	} else {
 		submitFrame(inst, reportBytes)
@@ -44,7 +51,7 @@ func submitBegin(inst *instance, reportBytes []byte) int {
 	err := json.Unmarshal(reportBytes, &report)
 	if err != nil {
 		inst.logger.Printf("Failed to unmarshal game report: %s report was %q", err.Error(), string(reportBytes))
-		discordPostError("Failed to unmarshal game report: %s report was %q (instance %d)", err.Error(), string(reportBytes), inst.Id)
+		notifyErrorf("Failed to unmarshal game report: %s report was %q (instance %d)", err.Error(), string(reportBytes), inst.Id)
 		return -1
 	}
 	var gid int
@@ -52,11 +59,11 @@ func submitBegin(inst *instance, reportBytes []byte) int {
 	err = dbpool.BeginFunc(ctx, func(tx pgx.Tx) error {
 		err := tx.QueryRow(ctx, `insert into games (version, instance,
 		setting_scavs, setting_alliance, setting_power, setting_base,
-		map_name, map_hash, mods, display_category) values ($1, $2,
+		map_name, map_hash, mods, display_category, binary_version) values ($1, $2,
 		$3, $4, $5, $6,
-		$7, $8, $9, $10) returning id`, report.Game.Version, inst.Id,
+		$7, $8, $9, $10, nullif($11, '')) returning id`, report.Game.Version, inst.Id,
 			report.Game.Scavengers, report.Game.AlliancesType, report.Game.PowerType, report.Game.BaseType,
-			inst.Settings.MapName, inst.Settings.MapHash, inst.Settings.Mods, inst.Settings.DisplayCategory).Scan(&gid)
+			inst.Settings.MapName, inst.Settings.MapHash, inst.Settings.Mods, inst.Settings.DisplayCategory, inst.BinaryVersion).Scan(&gid)
 		if err != nil {
 			return err
 		}
@@ -91,7 +98,7 @@ func submitBegin(inst *instance, reportBytes []byte) int {
 	})
 	if err != nil {
 		inst.logger.Printf("Failed to begin game: %s (gid %d)", err.Error(), inst.GameId)
-		discordPostError("Failed to begin game: %s (gid %d) (instance %d)", err.Error(), inst.GameId, inst.Id)
+		notifyErrorf("Failed to begin game: %s (gid %d) (instance %d)", err.Error(), inst.GameId, inst.Id)
 	}
 	return gid
 }
@@ -105,7 +112,8 @@ func submitFrame(inst *instance, reportBytes []byte) {
 	err := json.Unmarshal(reportBytes, &report)
 	if err != nil {
 		inst.logger.Printf("Failed to unmarshal game report: %s (gid %d) report was %q", err.Error(), inst.GameId, string(reportBytes))
-		discordPostError("Failed to unmarshal game report: %s report was %q (instance %d)", err.Error(), string(reportBytes), inst.Id)
+		notifyErrorf("Failed to unmarshal game report: %s report was %q (instance %d)", err.Error(), string(reportBytes), inst.Id)
+		metricReportFrames.inc("failed")
 		return
 	}
 	frame := gamereport.GameReportGraphFrame{
@@ -159,18 +167,23 @@ func submitFrame(inst *instance, reportBytes []byte) {
 	tag, err := dbpool.Exec(context.Background(), `update games set graphs = coalesce(graphs, '[]'::json)::jsonb || $1::jsonb where id = $2`, frame, inst.GameId)
 	if err != nil {
 		inst.logger.Printf("Failed to add game frame: %s (gid %d)", err.Error(), inst.GameId)
-		discordPostError("Failed to add game frame: %s (gid %d) (instance %d)", err.Error(), inst.GameId, inst.Id)
+		notifyErrorf("Failed to add game frame: %s (gid %d) (instance %d)", err.Error(), inst.GameId, inst.Id)
+	}
+	if err == nil && tag.Update() && tag.RowsAffected() == 1 {
+		metricReportFrames.inc("submitted")
+	} else {
+		metricReportFrames.inc("failed")
 	}
 	if !tag.Update() || tag.RowsAffected() != 1 {
 		inst.logger.Printf("SUS tag while adding game: %s (gid %d)", tag, inst.GameId)
 		errMsgToSend := fmt.Sprintf("SUS tag while adding game: %s (gid %d) (instance %d)", tag, inst.GameId, inst.Id)
 		errMsg, ok := frameErrorSuspends[inst.Id]
 		if !ok {
-			discordPostError(errMsgToSend)
+			notifyErrorf(errMsgToSend)
 			frameErrorSuspends[inst.Id] = errMsgToSend
 		} else {
 			if errMsg != errMsgToSend {
-				discordPostError(errMsgToSend)
+				notifyErrorf(errMsgToSend)
 				frameErrorSuspends[inst.Id] = errMsgToSend
 			}
 		}
@@ -206,26 +219,48 @@ func submitEnd(inst *instance, reportBytes []byte) {
 	})
 	if err != nil {
 		inst.logger.Printf("Failed to finalize: %s (gid %d)", err.Error(), inst.GameId)
-		discordPostError("Failed to finalize: %s (gid %d) (instance %d)", err.Error(), inst.GameId, inst.Id)
+		notifyErrorf("Failed to finalize: %s (gid %d) (instance %d)", err.Error(), inst.GameId, inst.Id)
+		return
 	}
+	players := []map[string]any{}
+	for _, v := range report.PlayerData {
+		if v.PublicKey == "" {
+			continue
+		}
+		players = append(players, map[string]any{
+			"name":     v.Name,
+			"position": v.Position,
+			"team":     v.Team,
+			"usertype": v.Usertype,
+		})
+	}
+	publishInstanceEvent(inst, instanceEventReportSubmitted, map[string]any{
+		"gameId":   inst.GameId,
+		"final":    true,
+		"gameTime": report.GameTime,
+		"players":  players,
+	})
 }
 
 func sendReplayToStorage(inst *instance) {
 	replayPath, err := findReplay(inst)
 	if err != nil {
 		inst.logger.Printf("Failed to find replay: %s", err.Error())
-		discordPostError("Failed to find replay: %s (instance %d)", err.Error(), inst.Id)
+		notifyErrorf("Failed to find replay: %s (instance %d)", err.Error(), inst.Id)
+		metricReplayStorageFailures.inc("find")
 		return
 	}
 	err = copyReplayToStorage(inst, replayPath)
 	if err != nil {
 		inst.logger.Printf("Failed to copy replay: %s", err.Error())
-		discordPostError("Failed to copy replay: %s (instance %d)", err.Error(), inst.Id)
+		notifyErrorf("Failed to copy replay: %s (instance %d)", err.Error(), inst.Id)
+		metricReplayStorageFailures.inc("copy")
 	}
 	err = saveReplayToDatabase(inst, replayPath)
 	if err != nil {
 		inst.logger.Printf("Failed to save replay to database: %s", err.Error())
-		discordPostError("Failed to save replay to database: %s (instance %d)", err.Error(), inst.Id)
+		notifyErrorf("Failed to save replay to database: %s (instance %d)", err.Error(), inst.Id)
+		metricReplayStorageFailures.inc("database")
 	}
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"autohoster-backend/mapstorage"
 	"context"
 	"encoding/json"
 	"errors"
@@ -8,23 +9,30 @@ import (
 	"io"
 	"io/fs"
 	"log"
-	"math/rand"
+	"maps"
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"time"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/maxsupermanhd/lac/v2"
 )
 
-func generateInstance(instcfg lac.Conf) (inst *instance, err error) {
-	inst, err = allocateNewInstance()
+func generateInstance(instcfg lac.Conf, queueName string) (inst *instance, err error) {
+	inst, err = allocateNewInstance(queueName)
 	if err != nil {
 		return
 	}
 	inst.logger = log.New(log.Writer(), fmt.Sprintf("%d ", inst.Id), log.Flags()|log.Lmsgprefix)
 	inst.cfg = instcfg
+	defer func() {
+		if err != nil {
+			inst.ExitReason = "generation failed: " + err.Error()
+		}
+		dbInstanceSave(inst)
+	}()
 
 	inst.ConfDir = geniConfdir(inst)
 	err = makeDirs(fs.FileMode(cfg.GetDInt(755, "dirPerms")), []string{
@@ -36,15 +44,14 @@ func generateInstance(instcfg lac.Conf) (inst *instance, err error) {
 		return
 	}
 
-	err = geniMap(inst)
+	err = geniPickMap(inst)
 	if err != nil {
 		return
 	}
-
-	inst.cfgs = []lac.Conf{
-		inst.cfg.DupSubTree("maps", inst.Settings.MapName),
-		inst.cfg,
-		cfg.LinkSubTree("settingsFallback"),
+	geniLayers(inst)
+	err = geniMap(inst)
+	if err != nil {
+		return
 	}
 
 	inst.RestoreCfgs = []map[string]any{}
@@ -75,7 +82,30 @@ func generateInstance(instcfg lac.Conf) (inst *instance, err error) {
 	return
 }
 
+// geniLayers sets up layered config, first layer has priority for most settings
+func geniLayers(inst *instance) {
+	inst.cfgs = []lac.Conf{
+		inst.cfg.DupSubTree("maps", inst.Settings.MapKey),
+		inst.cfg,
+		cfg.LinkSubTree("settingsFallback"),
+	}
+}
+
+// geniLayerNames describes layers set up by geniLayers
+func geniLayerNames(inst *instance) []string {
+	return []string{
+		fmt.Sprintf("map %q", inst.Settings.MapKey),
+		fmt.Sprintf("queue %q", inst.QueueName),
+		"settingsFallback",
+	}
+}
+
 func geniConfig(inst *instance) error {
+	perm := fs.FileMode(cfg.GetDInt(644, "filePerms"))
+	return os.WriteFile(path.Join(inst.ConfDir, "config"), []byte(geniRenderConfig(inst)), perm)
+}
+
+func geniRenderConfig(inst *instance) string {
 	vals := map[string]string{}
 	for _, v := range inst.cfgs {
 		setKeys, ok := v.GetKeys("config")
@@ -91,15 +121,19 @@ func geniConfig(inst *instance) error {
 			}
 		}
 	}
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 	c := "[General]\n"
-	for k, v := range vals {
-		c += fmt.Sprintf("%s=%s\n", k, v)
+	for _, k := range keys {
+		c += fmt.Sprintf("%s=%s\n", k, vals[k])
 	}
-	perm := fs.FileMode(cfg.GetDInt(644, "filePerms"))
-	return os.WriteFile(path.Join(inst.ConfDir, "config"), []byte(c), perm)
+	return c
 }
 
-func geniActions(inst *instance) error {
+func geniCollectActions(inst *instance) map[string]map[string]any {
 	acts := map[string]map[string]any{}
 	for _, v := range inst.cfgs {
 		actionKeys, ok := v.GetKeys("actions")
@@ -115,7 +149,11 @@ func geniActions(inst *instance) error {
 			}
 		}
 	}
+	return acts
+}
 
+func geniActions(inst *instance) error {
+	acts := geniCollectActions(inst)
 	fperm := fs.FileMode(cfg.GetDInt(644, "filePerms"))
 	dperm := fs.FileMode(cfg.GetDInt(755, "dirPerms"))
 	for _, act := range acts {
@@ -143,7 +181,24 @@ func geniActions(inst *instance) error {
 	return nil
 }
 
+// geniMap fetches picked map, checks it against settings and places it into confdir
 func geniMap(inst *instance) error {
+	mapbytes, err := ms.GetMap(inst.Settings.MapHash)
+	if err != nil {
+		return err
+	}
+	info, err := ms.GetMapInfo(inst.Settings.MapHash)
+	if err != nil {
+		return err
+	}
+	err = geniApplyMapInfo(inst, info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(inst.ConfDir, "maps", inst.Settings.MapHash+".wz"), mapbytes, 0644)
+}
+
+func geniPickMap(inst *instance) error {
 	mapnames, ok := inst.cfg.GetKeys("maps")
 	if !ok {
 		return errors.New("no maps defined for preset")
@@ -151,33 +206,55 @@ func geniMap(inst *instance) error {
 	if len(mapnames) == 0 {
 		return errors.New("map list is empty")
 	}
-	mapn := rand.Intn(len(mapnames))
-	inst.Settings.MapName = mapnames[mapn]
-	inst.Settings.MapHash, ok = inst.cfg.GetString("maps", inst.Settings.MapName, "hash")
-	if !ok {
-		return errors.New("map hash not defined")
+	name, hash, reason, err := mapRotationPick(inst, mapnames)
+	if err != nil {
+		return err
 	}
-	if !ok {
-		return errors.New("map players not defined")
+	inst.Settings.MapKey, inst.Settings.MapName, inst.Settings.MapHash, inst.MapReason = name, name, hash, reason
+	inst.logger.Printf("Picked map %q: %s", name, reason)
+	return nil
+}
+
+// geniApplyMapInfo refuses maps with wrong slot count and takes real map name from metadata
+func geniApplyMapInfo(inst *instance, info *mapstorage.MapInfo) error {
+	players := tryCfgGetD(tryGetIntGen("players"), -1, inst.cfgs...)
+	if info.Players != players {
+		return fmt.Errorf("map %q (%s) has %d slots but %d players are configured", inst.Settings.MapKey, info.Hash, info.Players, players)
+	}
+	if info.Name != inst.Settings.MapName {
+		inst.logger.Printf("Map %q is named %q inside", inst.Settings.MapKey, info.Name)
 	}
+	inst.Settings.MapName = info.Name
+	return nil
+}
 
-	mapbytes, err := ms.GetMap(inst.Settings.MapHash)
+func geniPreset(inst *instance) error {
+	preset, err := geniRenderPreset(inst)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path.Join(inst.ConfDir, "maps", inst.Settings.MapHash+".wz"), mapbytes, 0644)
+	presetB, err := json.MarshalIndent(preset, "", "\t")
+	if err != nil {
+		return err
+	}
+	perm := fs.FileMode(cfg.GetDInt(644, "filePerms"))
+	return os.WriteFile(path.Join(inst.ConfDir, "autohost", "preset.json"), presetB, perm)
 }
 
-func geniPreset(inst *instance) error {
+func geniRenderPreset(inst *instance) (map[string]any, error) {
 	inst.Settings.TimeLimit = tryCfgGetD(tryGetIntGen("timelimit"), 2, inst.cfgs...)
 	inst.Settings.PlayerCount = tryCfgGetD(tryGetIntGen("players"), -1, inst.cfgs...)
 	if inst.Settings.PlayerCount < 2 {
 		inst.logger.Println("Invalid playercount, aborting room creation!!!")
-		return errors.New("invalid playercount")
+		return nil, errors.New("invalid playercount")
 	}
 	inst.Settings.DisplayCategory = tryCfgGetD(tryGetIntGen("displayCategory"), 0, inst.cfgs...)
 	inst.Settings.RatingCategories = tryCfgGetD(tryGetSliceIntGen("ratingCategories"), []int{}, inst.cfgs...)
-	inst.BinPath = tryCfgGetD(tryGetStringGen("binary"), "warzone2100", inst.cfgs...)
+	binPath, binVersion, err := binaryResolve(inst)
+	if err != nil {
+		return nil, err
+	}
+	inst.BinPath, inst.BinaryVersion = binPath, binVersion
 	preset := map[string]any{
 		"locked": map[string]any{
 			"power":      tryCfgGetD(tryGetBoolGen("locked", "power"), true, inst.cfgs...),
@@ -234,14 +311,22 @@ func geniPreset(inst *instance) error {
 			preset[k] = v
 		}
 	}
-
-	presetB, err := json.MarshalIndent(preset, "", "\t")
-	if err != nil {
-		return err
+	if teamBalanceEnabled(inst) {
+		// balancing relies on player index staying the same, copies so config tree is not modified
+		challenge := map[string]any{}
+		if c, ok := preset["challenge"].(map[string]any); ok {
+			maps.Copy(challenge, c)
+		}
+		challenge["allowPositionChange"] = false
+		preset["challenge"] = challenge
+		locked := map[string]any{}
+		if l, ok := preset["locked"].(map[string]any); ok {
+			maps.Copy(locked, l)
+		}
+		locked["position"] = true
+		preset["locked"] = locked
 	}
-
-	perm := fs.FileMode(cfg.GetDInt(644, "filePerms"))
-	return os.WriteFile(path.Join(inst.ConfDir, "autohost", "preset.json"), presetB, perm)
+	return preset, nil
 }
 
 func geniConfdir(inst *instance) string {
@@ -1,17 +1,11 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"log"
-	"os"
-	"path"
 	"regexp"
-	"strings"
-	"sync"
-	"syscall"
 	"time"
 )
 
@@ -25,11 +19,6 @@ func spawnRunner(inst *instance) {
 		return
 	}
 
-	err := createPipes(inst)
-	if err != nil {
-		return
-	}
-
 	args := []string{
 		inst.BinPath,
 		"--configdir=" + inst.ConfDir,
@@ -49,62 +38,48 @@ func spawnRunner(inst *instance) {
 		"--enablecmdinterface=stdin",
 		"--host-chat-config=quickchat",
 	}
-	inst.logger.Printf("Starting %q with args %#+v", inst.BinPath, args)
-	pr, err := os.StartProcess(inst.BinPath, args, &os.ProcAttr{
-		Dir: inst.ConfDir,
-		Files: []*os.File{
-			inst.stdin,
-			inst.stdout,
-			inst.stderr,
-		},
-		Sys: &syscall.SysProcAttr{
-			Setsid: true,  // without it ctrl+c will be sent to wz
-			Noctty: false, // if enabled it will fail with fork/exec : inappropriate ioctl for device
-		},
-	})
+	sandbox, err := sandboxSpecForInstance(inst)
 	if err != nil {
-		inst.logger.Printf("Failed to start: %s", err.Error())
+		inst.logger.Printf("Failed to set up sandbox: %s", err.Error())
+		inst.ExitReason = "failed to set up sandbox: " + err.Error()
+		instanceSetState(inst, instanceStateExited)
+		dbInstanceSave(inst)
 		return
 	}
-	inst.Pid = pr.Pid
-
-	err = os.WriteFile(path.Join(inst.ConfDir, "cmdline"), append([]byte(strings.Join(args, "\x00")), 0), 0644)
-	if err != nil {
-		inst.logger.Println("Error writing cmdline file:", err)
-	}
-	err = os.WriteFile(path.Join(inst.ConfDir, "pid"), []byte(fmt.Sprint(inst.Pid)), 0644)
-	if err != nil {
-		inst.logger.Println("Error writing pid file:", err)
-	}
-
-	pr.Release()
-	inst.logger.Printf("Started with pid %d", inst.Pid)
-
-	inst.logger.Println("Reopening pipes...")
-	err = inst.stdin.Close()
-	if err != nil {
-		inst.logger.Println("Error closing stdin pipe:", err)
-	}
-	err = inst.stdout.Close()
+	cgpath, err := cgroupCreate(inst)
 	if err != nil {
-		inst.logger.Println("Error closing stdout pipe:", err)
-	}
-	err = inst.stderr.Close()
-	if err != nil {
-		inst.logger.Println("Error closing stderr pipe:", err)
+		inst.logger.Printf("Failed to set up cgroup: %s", err.Error())
+		notifyErrorf("Instance %d failed to set up cgroup: %s", inst.Id, err.Error())
+		inst.ExitReason = "failed to set up cgroup: " + err.Error()
+		instanceSetState(inst, instanceStateExited)
+		dbInstanceSave(inst)
+		return
 	}
-	err = openPipes(inst)
+	inst.CgroupPath = cgpath
+	inst.logger.Printf("Starting %q with args %#+v", inst.BinPath, args)
+	proc, err := supervisorStart(inst.ConfDir, inst.BinPath, args, supervisorSpawnOpts{
+		CgroupPath: cgpath,
+		Sandbox:    sandbox,
+	}, inst.logger)
 	if err != nil {
-		inst.logger.Println("Error reopening pipes:", err)
+		cgroupRemove(cgpath)
+		inst.logger.Printf("Failed to start: %s", err.Error())
+		inst.ExitReason = "failed to start: " + err.Error()
+		instanceSetState(inst, instanceStateExited)
+		dbInstanceSave(inst)
+		return
 	}
+	inst.proc = proc
+	inst.Pid = proc.Pid
+	instanceSetState(inst, instanceStateStarting)
+	dbInstanceSave(inst)
 
 	instanceRunner(inst)
 }
 
 func instanceRunner(inst *instance) {
 	defer func() {
-		inst.logger.Printf("atomic state store: %d", int64(instanceStateExited))
-		inst.state.Store(int64(instanceStateExited))
+		instanceSetState(inst, instanceStateExited)
 	}()
 	inst.wg.Add(1)
 	defer inst.wg.Done()
@@ -113,93 +88,32 @@ func instanceRunner(inst *instance) {
 	if err != nil {
 		inst.logger.Printf("Failed to save instance recovery json: %s", err.Error())
 	}
-	var wg sync.WaitGroup
-
-	exitchan := make(chan struct{})
-	pidcheckchan := make(chan struct{})
-	msgchan := make(chan string, 64)
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			time.Sleep(1 * time.Second)
-			// inst.logger.Printf("Checking pid %d", inst.Pid)
-			// if inst.recovered {
-			if !isPidAlive(inst.Pid) {
-				inst.logger.Printf("pid %d closed", inst.Pid)
-				close(pidcheckchan)
-				return
-			}
-			// } else {
-			// No way of unblocking Wait call without process exit it seems
-			// pr, err := os.FindProcess(int(inst.Pid))
-			// if err != nil {
-			// 	inst.logger.Printf("Failed to find process: %s\n", err.Error())
-			// 	continue
-			// }
-			// st, err := pr.Wait()
-			// if err != nil {
-			// 	inst.logger.Printf("Failed to wait process: %s\n", err.Error())
-			// 	continue
-			// }
-			// if st.Exited() {
-			// 	inst.logger.Printf("pid %d closed", inst.Pid)
-			// 	close(pidcheckchan)
-			// 	return
-			// }
-			// }
-			// inst.logger.Printf("pid %d alive", inst.Pid)
-			select {
-			case <-exitchan:
-				inst.logger.Printf("pid checker for %d exited", inst.Pid)
-				return
-			default:
-			}
-		}
-	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		bufSize := 1024 * 1024 * 64
-		buf := make([]byte, bufSize)
-
-		s := bufio.NewScanner(inst.stderr)
-		s.Buffer(buf, bufSize)
-		for s.Scan() {
-			msgchan <- s.Text()
-		}
-		if !errors.Is(s.Err(), os.ErrClosed) {
-			inst.logger.Printf("stderr scanner exited with error %s", s.Err().Error())
-		}
-	}()
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		bufSize := 1024 * 1024 * 64
-		buf := make([]byte, bufSize)
-
-		s := bufio.NewScanner(inst.stdout)
-		s.Buffer(buf, bufSize)
-		for s.Scan() {
-			msgchan <- s.Text()
-		}
-		if !errors.Is(s.Err(), os.ErrClosed) {
-			inst.logger.Printf("stdout scanner exited with error %s", s.Err().Error())
-		}
-	}()
-
-	pidCheckFailed := false
+	processExited := false
 	shutdownOrdered := false
+	var terminateTimer <-chan time.Time
 msgloop:
 	for {
 		select {
-		case <-pidcheckchan:
-			inst.logger.Println("Pid check failed, closing off instance runtime")
-			pidCheckFailed = true
+		case <-inst.proc.Done():
+			inst.logger.Println("Process exited, closing off instance runtime")
+			processExited = true
+			// last words (reports mostly) might still be sitting in the pipes
+			for drained := false; !drained; {
+				select {
+				case msg := <-inst.proc.Lines():
+					if processHosterMessage(inst, msg) {
+						inst.logger.Printf(": %q", msg)
+					}
+				case <-time.After(200 * time.Millisecond):
+					drained = true
+				}
+			}
 			break msgloop
+		case <-terminateTimer:
+			terminateTimer = nil
+			grace := time.Duration(tryCfgGetD(tryGetIntGen("terminateGraceSeconds"), 10, inst.cfgs...)) * time.Second
+			inst.logger.Println("Process did not exit after shutdown was ordered, terminating")
+			go inst.proc.Terminate(grace)
 		case cmd := <-inst.commands:
 			switch cmd.command {
 			case icNone:
@@ -213,49 +127,66 @@ msgloop:
 			case icShutdown:
 				inst.logger.Println("exit sent")
 				instWriteFmt(inst, "shutdown now")
+				if !shutdownOrdered {
+					terminateTimer = time.After(time.Duration(tryCfgGetD(tryGetIntGen("shutdownTimeoutSeconds"), 60, inst.cfgs...)) * time.Second)
+				}
 				shutdownOrdered = true
-				inst.logger.Printf("atomic state store: %d", int64(instanceStateExiting))
-				inst.state.Store(int64(instanceStateExiting))
+				instanceSetState(inst, instanceStateExiting)
 				err := recoverSave(inst)
 				if err != nil {
 					inst.logger.Printf("Failed to save instance recovery json: %s", err.Error())
 				}
+			case icRawCommand:
+				s, ok := cmd.data.(string)
+				if !ok {
+					inst.logger.Printf("wrong icRawCommand data type! (%T)", cmd.data)
+					continue
+				}
+				inst.logger.Printf("raw command %q", s)
+				instWriteFmt(inst, "%s", s)
 			case icRunnerStop:
 				inst.logger.Println("runner stopping")
-				inst.logger.Printf("atomic state store: %d", int64(instanceStateExiting))
-				inst.state.Store(int64(instanceStateExiting))
+				err := recoverSave(inst)
+				if err != nil {
+					inst.logger.Printf("Failed to save recovery state: %s", err.Error())
+				}
+				instanceSetState(inst, instanceStateExiting)
 				break msgloop
 			default:
 				inst.logger.Printf("unhandled command %#+v", cmd)
 			}
-		case msg := <-msgchan:
+		case msg := <-inst.proc.Lines():
 			if processHosterMessage(inst, msg) {
 				inst.logger.Printf(": %q", msg)
 			}
 		}
 	}
 	inst.logger.Println("Runner cleaning up runtime...")
-	close(exitchan)
-
-	closePipes(inst)
-
-	if !inst.recovered {
-		var waitStatus syscall.WaitStatus
-		var rusage syscall.Rusage
-		wret, err := syscall.Wait4(inst.Pid, &waitStatus, syscall.WNOHANG, &rusage)
-		if err != nil {
-			inst.logger.Println("Failed to wait4:", err)
+	inst.proc.Close()
+	if processExited {
+		inst.Exit = inst.proc.ExitStatus()
+		if inst.Exit != nil {
+			inst.logger.Printf("Process finished with %s", inst.Exit)
 		}
-		if wret != 0 && wret != inst.Pid {
-			inst.logger.Printf("wait4 returned wrong pid_t, got %d but called for pid %d!", wret, inst.Pid)
+	}
+	oomKilled := false
+	if processExited && inst.CgroupPath != "" {
+		if u := cgroupReadUsage(inst.CgroupPath); u != nil && u.OOMKills > 0 {
+			oomKilled = true
+			inst.logger.Printf("Process was killed by OOM (%d kills, peak %d bytes)", u.OOMKills, u.MemoryPeak)
+			notifyErrorf("Instance %d (queue %q, map %q) was OOM killed, memory peak %d MiB of %d MiB",
+				inst.Id, inst.QueueName, inst.Settings.MapName, u.MemoryPeak/1024/1024, u.MemoryMax/1024/1024)
+		}
+		err = cgroupRemove(inst.CgroupPath)
+		if err != nil {
+			inst.logger.Printf("Failed to remove cgroup: %s", err.Error())
 		}
 	}
-	inst.logger.Println("Waiting for subroutines...")
-	wg.Wait()
-	if !pidCheckFailed && !shutdownOrdered {
+	if !processExited && !shutdownOrdered {
 		inst.logger.Println("Runner exits without archival")
-		inst.logger.Printf("atomic state store: %d", int64(instanceStateExited))
-		inst.state.Store(int64(instanceStateExited))
+		inst.ExitReason = "runner stopped"
+		instanceSetState(inst, instanceStateExited)
+		dbInstanceSave(inst)
 		return
 	}
 	if inst.GameId > 0 {
@@ -266,16 +197,28 @@ msgloop:
 	err = archiveInstance(inst.ConfDir)
 	if err != nil {
 		inst.logger.Printf("Runner failed to archive itself: %s", err.Error())
+	} else {
+		publishInstanceEvent(inst, instanceEventArchived, map[string]any{
+			"gameId": inst.GameId,
+		})
 	}
 	inst.logger.Println("Runner exits")
-	inst.logger.Printf("atomic state store: %d", int64(instanceStateExited))
-	inst.state.Store(int64(instanceStateExited))
+	if oomKilled {
+		inst.ExitReason = "process exited (oom killed)"
+	} else if processExited {
+		inst.ExitReason = "process exited"
+	} else {
+		inst.ExitReason = "shutdown ordered"
+	}
+	instanceSetState(inst, instanceStateExited)
+	dbInstanceSave(inst)
 }
 
 func DbLogAction(f string, args ...any) (string, error) {
 	ecode := "A-" + genRandomString(14)
 	msg := ecode + " " + fmt.Sprintf(f, args...)
 	err := addEventLog(msg)
+	notifyModerationf("%s", msg)
 	return ecode, err
 }
 
@@ -295,13 +238,10 @@ func addEventLog(msg string) error {
 
 func instWriteFmt(inst *instance, format string, args ...any) {
 	str := fmt.Sprintf(format, args...) + "\n"
-	n, err := inst.stdin.WriteString(str)
+	err := inst.proc.Write(str)
 	if err != nil {
 		inst.logger.Printf("Failed to write string %q to the stdin: %s", str, err.Error())
 	}
-	if n != len(str) {
-		inst.logger.Printf("Write to stdin n %d does not match %d", n, len(str))
-	}
 }
 
 // reason := "" +
@@ -19,6 +19,21 @@ func routineWebServer(closechan <-chan struct{}) {
 	m.HandleFunc("/reload", webHandleReload)
 	m.HandleFunc("/alive", webHandleAlive)
 	m.HandleFunc("/request", webHandleRequestRoom)
+	m.HandleFunc("/metrics", webHandleMetrics)
+	m.HandleFunc("GET /events", apiAuth(apiRoleView, apiHandleEvents))
+	m.HandleFunc("GET /instances/ports", apiAuth(apiRoleView, apiHandlePorts))
+	m.HandleFunc("GET /binaries", apiAuth(apiRoleView, apiHandleBinaries))
+	m.HandleFunc("GET /queues/{name}/preview", apiAuth(apiRoleView, apiHandleQueuePreview))
+	m.HandleFunc("GET /queues/{name}/joincheck", apiAuth(apiRoleModerate, apiHandleQueueJoinCheck))
+	m.HandleFunc("GET /joindecisions", apiAuth(apiRoleModerate, apiHandleJoinDecisions))
+	m.HandleFunc("GET /drain", apiAuth(apiRoleView, apiHandleDrainStatus))
+	m.HandleFunc("POST /drain", apiAuth(apiRoleAdmin, apiHandleDrainStart))
+	m.HandleFunc("DELETE /drain", apiAuth(apiRoleAdmin, apiHandleDrainCancel))
+	m.HandleFunc("GET /instances/{id}", apiAuth(apiRoleView, apiHandleInstance))
+	m.HandleFunc("GET /instances/{id}/joincheck", apiAuth(apiRoleModerate, apiHandleInstanceJoinCheck))
+	m.HandleFunc("POST /instances/{id}/shutdown", apiAuth(apiRoleModerate, apiHandleInstanceShutdown))
+	m.HandleFunc("POST /instances/{id}/broadcast", apiAuth(apiRoleModerate, apiHandleInstanceBroadcast))
+	m.HandleFunc("POST /instances/{id}/command", apiAuth(apiRoleAdmin, apiHandleInstanceCommand))
 	var wg sync.WaitGroup
 	wg.Add(1)
 	srv := http.Server{
@@ -49,20 +64,7 @@ func webHandleInstances(w http.ResponseWriter, r *http.Request) {
 	ret := map[int64]any{}
 	instancesLock.Lock()
 	for _, v := range instances {
-		cfgs := []any{}
-		for _, c := range v.cfgs {
-			a, _ := c.Get()
-			cfgs = append(cfgs, a)
-		}
-		inst := map[string]any{
-			"state":    v.state.Load(),
-			"pid":      v.Pid,
-			"game id":  v.GameId,
-			"lobby id": v.LobbyId,
-			"settings": v.Settings,
-			"cfgs":     cfgs,
-		}
-		ret[v.Id] = inst
+		ret[v.Id] = instanceDescribe(v)
 	}
 	instancesLock.Unlock()
 	b, err := json.MarshalIndent(ret, "", "\t")
@@ -77,21 +79,67 @@ func webHandleInstances(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("\n"))
 }
 
+func instanceDescribe(v *instance) map[string]any {
+	cfgs := []any{}
+	for _, c := range v.cfgs {
+		a, _ := c.Get()
+		cfgs = append(cfgs, a)
+	}
+	return map[string]any{
+		"state":          v.state.Load(),
+		"pid":            v.Pid,
+		"exit":           v.Exit,
+		"resources":      cgroupReadUsage(v.CgroupPath),
+		"game id":        v.GameId,
+		"lobby id":       v.LobbyId,
+		"queue":          v.QueueName,
+		"binary version": v.BinaryVersion,
+		"map reason":     v.MapReason,
+		"settings":       v.Settings,
+		"cfgs":           cfgs,
+	}
+}
+
 func webHandleReload(w http.ResponseWriter, r *http.Request) {
+	errs, warnings := configSplitWarnings(configValidateFile("config.json"))
+	if len(errs) > 0 {
+		log.Printf("Refusing to reload config with %d problems", len(errs))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Config is invalid, not reloaded\n"))
+		for _, err := range errs {
+			w.Write([]byte(err.Error()))
+			w.Write([]byte("\n"))
+		}
+		return
+	}
 	err := cfg.SetFromFileJSON("config.json")
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	// binaries might need to be checksummed and started
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Minute))
+	binErrs := binaryRegistryValidate()
+	mapPrefetchRequest()
+	notifyReloadRequest()
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Config reloaded"))
 	w.Write([]byte("\n"))
+	for _, err := range warnings {
+		w.Write([]byte("warning: " + err.Error()))
+		w.Write([]byte("\n"))
+	}
+	for _, err := range binErrs {
+		w.Write([]byte(err.Error()))
+		w.Write([]byte("\n"))
+	}
 }
 
 func webHandleAlive(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Autohoster backend online, room creation allowed: " + fmt.Sprint(!disallowInstanceCreation.Load())))
+	w.Write([]byte(", draining: " + fmt.Sprint(draining.Load())))
 	w.Write([]byte("\n"))
 }
 
@@ -100,27 +148,26 @@ func webHandleRequestRoom(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		log.Printf("HTTP room request: failed to read body: %s", err.Error())
-		discordPostError("HTTP room request: failed to read body: %s", err.Error())
+		notifyErrorf("HTTP room request: failed to read body: %s", err.Error())
 		return
 	}
 	c, err := lac.FromBytesJSON(b)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		log.Printf("HTTP room request: failed to unmarshal json: %s", err.Error())
-		discordPostError("HTTP room request: failed to unmarshal json: %s", err.Error())
+		notifyErrorf("HTTP room request: failed to unmarshal json: %s", err.Error())
 		return
 	}
-	gi, err := generateInstance(c)
+	gi, err := generateInstance(c, "")
 	if err != nil {
 		log.Printf("HTTP room request: failed to generate instance: %s", err.Error())
-		discordPostError("HTTP room request: failed to generate instance: %s", err.Error())
+		notifyErrorf("HTTP room request: failed to generate instance: %s", err.Error())
 		if gi != nil {
 			releaseInstance(gi)
 		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	gi.QueueName = ""
 	go spawnRunner(gi)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(fmt.Sprintf("Room created, join with host.wz2100-autohost.net:%d", gi.Settings.GamePort)))
@@ -2,7 +2,6 @@ package main
 
 import (
 	"log"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,6 +20,50 @@ const (
 	instanceStateExited
 )
 
+func (s instanceState) String() string {
+	switch s {
+	case instanceStateInitial:
+		return "initial"
+	case instanceStateStarting:
+		return "starting"
+	case instanceStateInLobby:
+		return "inLobby"
+	case instanceStateInGame:
+		return "inGame"
+	case instanceStateExiting:
+		return "exiting"
+	case instanceStateExited:
+		return "exited"
+	default:
+		return "unknown?!"
+	}
+}
+
+func instanceSetState(inst *instance, st instanceState) {
+	inst.logger.Printf("atomic state store: %d", int64(st))
+	prev := instanceState(inst.state.Swap(int64(st)))
+	if prev != st {
+		dbInstanceLogState(inst, prev, st)
+		publishInstanceEvent(inst, instanceEventStateChanged, map[string]any{
+			"from": prev.String(),
+			"to":   st.String(),
+		})
+	}
+}
+
+func instanceSwapState(inst *instance, from, to instanceState) bool {
+	inst.logger.Printf("atomic state swap from %d to %d", int64(from), int64(to))
+	if !inst.state.CompareAndSwap(int64(from), int64(to)) {
+		return false
+	}
+	dbInstanceLogState(inst, from, to)
+	publishInstanceEvent(inst, instanceEventStateChanged, map[string]any{
+		"from": from.String(),
+		"to":   to.String(),
+	})
+	return true
+}
+
 type adminsPolicy int
 
 const (
@@ -38,6 +81,7 @@ type joinDispatch struct {
 
 type instanceSettings struct {
 	GamePort         int
+	MapKey           string
 	MapName          string
 	MapHash          string
 	PlayerCount      int
@@ -48,29 +92,41 @@ type instanceSettings struct {
 }
 
 type instance struct {
-	Id                  int64
-	LobbyId             int
-	GameId              int
-	DebugTriggered      bool
-	ConfDir             string
-	BinPath             string
-	Admins              []string
-	AdminsPolicy        adminsPolicy
-	OnJoinDispatch      map[string]joinDispatch
-	QueueName           string
-	AutodetectedVersion string
-	state               atomic.Int64
-	StateSaved          int
-	cfg                 lac.Conf
-	cfgs                []lac.Conf
-	RestoreCfgs         []map[string]any
-	Settings            instanceSettings
-	logger              *log.Logger
-	stdin               *os.File
-	stdout              *os.File
-	stderr              *os.File
-	Pid                 int
-	recovered           bool
-	commands            chan instanceCommand
-	wg                  sync.WaitGroup
+	Id                   int64
+	LobbyId              int
+	GameId               int
+	DebugTriggered       bool
+	ConfDir              string
+	BinPath              string
+	BinaryVersion        string
+	MapReason            string
+	Admins               []string
+	AdminsPolicy         adminsPolicy
+	OnJoinDispatch       map[string]joinDispatch
+	lobbyRoster          map[int]lobbyPlayer
+	lobbyNames           map[string]string
+	balancedRoster       string
+	balancedGen          atomic.Int64
+	QueueName            string
+	AutodetectedVersion  string
+	ExitReason           string
+	state                atomic.Int64
+	StateSaved           int
+	joinCount            atomic.Int64
+	JoinCountSaved       int
+	lobbyOccupants       atomic.Int64
+	LobbyOccupantsSaved  int
+	scheduleShutdownSent bool
+	drainShutdownSent    bool
+	cfg                  lac.Conf
+	cfgs                 []lac.Conf
+	RestoreCfgs          []map[string]any
+	Settings             instanceSettings
+	logger               *log.Logger
+	proc                 *supervisor
+	Pid                  int
+	Exit                 *supervisorExit
+	CgroupPath           string
+	commands             chan instanceCommand
+	wg                   sync.WaitGroup
 }
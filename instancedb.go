@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// instance registry in the database, best effort, failures are only logged
+
+func dbInstanceEnabled() bool {
+	return dbpool != nil && cfg.GetDSBool(true, "recordInstances")
+}
+
+func dbInstanceSave(inst *instance) {
+	if !dbInstanceEnabled() {
+		return
+	}
+	var gameId *int
+	if inst.GameId > 0 {
+		gameId = &inst.GameId
+	}
+	var lobbyId *int
+	if inst.LobbyId > 0 {
+		lobbyId = &inst.LobbyId
+	}
+	_, err := dbpool.Exec(context.Background(), `insert into instances
+	(id, queue, port, map_name, map_hash, pid, version, state, lobby_id, game_id, exit_reason, binary_version, map_reason)
+values
+	($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, nullif($11, ''), nullif($12, ''), nullif($13, ''))
+on conflict (id) do update set
+	queue = $2, port = $3, map_name = $4, map_hash = $5, pid = $6, version = $7,
+	state = $8, lobby_id = $9, game_id = $10, exit_reason = nullif($11, ''), binary_version = nullif($12, ''),
+	map_reason = nullif($13, ''), time_updated = now()`,
+		inst.Id, inst.QueueName, inst.Settings.GamePort, inst.Settings.MapName, inst.Settings.MapHash,
+		inst.Pid, inst.AutodetectedVersion, instanceState(inst.state.Load()).String(), lobbyId, gameId, inst.ExitReason, inst.BinaryVersion,
+		inst.MapReason)
+	if err != nil {
+		inst.logger.Printf("Failed to save instance to database: %s", err.Error())
+	}
+}
+
+func dbInstanceLogState(inst *instance, from, to instanceState) {
+	if !dbInstanceEnabled() {
+		return
+	}
+	_, err := dbpool.Exec(context.Background(), `update instances set state = $2, time_updated = now() where id = $1`,
+		inst.Id, to.String())
+	if err != nil {
+		inst.logger.Printf("Failed to update instance state in database: %s", err.Error())
+		return
+	}
+	_, err = dbpool.Exec(context.Background(), `insert into instance_states (instance, state_from, state_to) values ($1, $2, $3)`,
+		inst.Id, from.String(), to.String())
+	if err != nil {
+		inst.logger.Printf("Failed to log instance state to database: %s", err.Error())
+	}
+}
+
+func dbInstanceMarkDead(instanceID int64, reason string) {
+	if !dbInstanceEnabled() {
+		return
+	}
+	_, err := dbpool.Exec(context.Background(), `update instances set state = $2, exit_reason = coalesce(nullif(exit_reason, ''), $3), time_updated = now() where id = $1`,
+		instanceID, instanceStateExited.String(), reason)
+	if err != nil {
+		log.Printf("Failed to mark instance %d dead in database: %s", instanceID, err.Error())
+	}
+}
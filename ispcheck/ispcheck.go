@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/maxsupermanhd/lac/v2"
@@ -19,6 +20,9 @@ type ISPChecker struct {
 	hcl   *http.Client
 	l     sync.Mutex
 	cache map[string]LookupResponse
+
+	statLookups   atomic.Uint64
+	statCacheHits atomic.Uint64
 }
 
 func NewISPChecker(cfg lac.Conf) *ISPChecker {
@@ -63,9 +67,11 @@ func (ch *ISPChecker) Lookup(ip string) (*LookupResponse, error) {
 
 	rspC, ok := ch.cache[ip]
 	if ok {
+		ch.statCacheHits.Add(1)
 		return &rspC, nil
 	}
 
+	ch.statLookups.Add(1)
 	rsp, err := ch.lookup(ip)
 	if err != nil {
 		return nil, err
@@ -78,6 +84,11 @@ func (ch *ISPChecker) Lookup(ip string) (*LookupResponse, error) {
 	return rsp, err
 }
 
+// Stats returns number of remote lookups and cache hits since creation
+func (ch *ISPChecker) Stats() (lookups, cacheHits uint64) {
+	return ch.statLookups.Load(), ch.statCacheHits.Load()
+}
+
 func (ch *ISPChecker) lookup(ip string) (*LookupResponse, error) {
 	url := fmt.Sprintf(cfgGetUrlFmt(ch.cfg), ip)
 	r, err := ch.hcl.Get(url)
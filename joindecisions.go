@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// every join decision is stored in join_decisions so moderators can see why
+// someone was rejected or put into spectators, best effort like instance registry.
+// Decisions older than joinDecisionsRetentionDays (default 90, 0 keeps
+// everything) are deleted hourly.
+
+func dbJoinDecisionsEnabled() bool {
+	return dbpool != nil && cfg.GetDSBool(true, "recordJoinDecisions")
+}
+
+// pubkeyHash matches identities.hash
+func pubkeyHash(pubkey []byte) string {
+	h := sha256.Sum256(pubkey)
+	return hex.EncodeToString(h[:])
+}
+
+func dbJoinDecisionSave(inst *instance, f *joinFacts, res *joinCheckResult) {
+	if !dbJoinDecisionsEnabled() {
+		return
+	}
+	_, err := dbpool.Exec(context.Background(), `insert into join_decisions
+	(instance, queue, pubkey_hash, account, ip, name, action, stages, rules, allow_chat, messages, reason)
+values
+	($1, nullif($2, ''), $3, $4, $5, $6, $7, $8, $9, $10, $11, nullif($12, ''))`,
+		inst.Id, inst.QueueName, pubkeyHash(f.pubkey), f.Account, f.IP, f.Name, res.action.String(),
+		res.Stages, res.Rules, res.jd.AllowChat, res.jd.Messages, res.Reason)
+	if err != nil {
+		inst.logger.Printf("Failed to save join decision to database: %s", err.Error())
+	}
+}
+
+func dbJoinDecisionsPrune() {
+	days := cfg.GetDSInt(90, "joinDecisionsRetentionDays")
+	if dbpool == nil || days <= 0 {
+		return
+	}
+	total := int64(0)
+	for {
+		// batched so one delete does not hold locks on a huge backlog
+		tag, err := dbpool.Exec(context.Background(), `delete from join_decisions where id in (
+	select id from join_decisions where time < now() - $1 * interval '1 day' limit 10000)`, days)
+		if err != nil {
+			log.Printf("Failed to prune join decisions: %s", err.Error())
+			return
+		}
+		total += tag.RowsAffected()
+		if tag.RowsAffected() < 10000 {
+			break
+		}
+	}
+	if total > 0 {
+		log.Printf("Pruned %d join decisions older than %d days", total, days)
+	}
+}
+
+func routineJoinDecisionsPruner(closechan <-chan struct{}) {
+	for {
+		dbJoinDecisionsPrune()
+		select {
+		case <-closechan:
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+var sqlLikeReplacer = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// sqlLikeEscape makes s match literally inside like pattern with escape '\'
+func sqlLikeEscape(s string) string {
+	return sqlLikeReplacer.Replace(s)
+}
+
+type joinDecision struct {
+	ID         int64     `json:"id"`
+	Instance   int64     `json:"instance"`
+	Queue      *string   `json:"queue"`
+	PubkeyHash string    `json:"pubkeyHash"`
+	Account    *int      `json:"account"`
+	IP         *string   `json:"ip"`
+	Name       *string   `json:"name"`
+	Action     string    `json:"action"`
+	Stages     []string  `json:"stages"`
+	Rules      *string   `json:"rules"`
+	AllowChat  bool      `json:"allowChat"`
+	Messages   []string  `json:"messages"`
+	Reason     *string   `json:"reason"`
+	Time       time.Time `json:"time"`
+}
+
+// apiHandleJoinDecisions looks up decisions by pubkey (base64), hash, account, ip, name or instance, newest first
+func apiHandleJoinDecisions(w http.ResponseWriter, r *http.Request, _ string) {
+	if dbpool == nil {
+		apiRespondError(w, http.StatusServiceUnavailable, "no database")
+		return
+	}
+	q := r.URL.Query()
+	where := []string{}
+	args := []any{}
+	addFilter := func(cond string, v any) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if v := q.Get("pubkey"); v != "" {
+		// query parsing turns unescaped + of base64 into spaces
+		pubkey, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(v, " ", "+"))
+		if err != nil {
+			apiRespondError(w, http.StatusBadRequest, "pubkey must be base64 encoded")
+			return
+		}
+		addFilter("pubkey_hash = $%d", pubkeyHash(pubkey))
+	}
+	if v := q.Get("hash"); v != "" {
+		addFilter("pubkey_hash = $%d", strings.ToLower(v))
+	}
+	for _, k := range []string{"account", "instance"} {
+		v := q.Get(k)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			apiRespondError(w, http.StatusBadRequest, k+" must be a number")
+			return
+		}
+		addFilter(k+" = $%d", n)
+	}
+	if v := q.Get("ip"); v != "" {
+		addFilter("ip = $%d", v)
+	}
+	if v := q.Get("name"); v != "" {
+		addFilter(`name ilike '%%' || $%d || '%%' escape '\'`, sqlLikeEscape(v))
+	}
+	if len(where) == 0 {
+		apiRespondError(w, http.StatusBadRequest, "at least one of pubkey, hash, account, instance, ip or name is required")
+		return
+	}
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			apiRespondError(w, http.StatusBadRequest, "limit must be between 1 and 500")
+			return
+		}
+		limit = n
+	}
+	args = append(args, limit)
+	rows, err := dbpool.Query(r.Context(), `select
+	id, instance, queue, pubkey_hash, account, ip, name, action, stages, rules, allow_chat, messages, reason, time
+from join_decisions
+where `+strings.Join(where, " and ")+`
+order by time desc
+limit $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		apiRespondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer rows.Close()
+	ret := []joinDecision{}
+	for rows.Next() {
+		var d joinDecision
+		err = rows.Scan(&d.ID, &d.Instance, &d.Queue, &d.PubkeyHash, &d.Account, &d.IP, &d.Name, &d.Action,
+			&d.Stages, &d.Rules, &d.AllowChat, &d.Messages, &d.Reason, &d.Time)
+		if err != nil {
+			apiRespondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		ret = append(ret, d)
+	}
+	if rows.Err() != nil {
+		apiRespondError(w, http.StatusInternalServerError, rows.Err().Error())
+		return
+	}
+	apiRespondJSON(w, http.StatusOK, ret)
+}
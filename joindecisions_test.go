@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestSqlLikeEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"Player":     "Player",
+		"100%":       `100\%`,
+		"x_x":        `x\_x`,
+		`back\slash`: `back\\slash`,
+		`%_\`:        `\%\_\\`,
+	} {
+		if got := sqlLikeEscape(in); got != want {
+			t.Errorf("sqlLikeEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
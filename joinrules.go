@@ -0,0 +1,1098 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// join rules are evaluated in order for every joining player, configured per
+// queue (or map, or settingsFallback, first layer with the key wins) as
+//
+//	"joinRules": [
+//		{"defaults": ["blacklist", "ban", "terminated"]},
+//		{"name": "noProxies", "when": {"linked": false, "any": [{"proxy": true}, {"asn": ["AS9009"]}]},
+//			"action": "reject", "message": "Proxies are not allowed.\\nEvent ID: {{.EventID}}",
+//			"log": "[antiproxy] {{.Name}} from {{.IP}} rejected"},
+//		{"name": "highRated", "when": {"rating": {"category": 3, "min": 1500}}, "action": "approve"},
+//		{"name": "leavers", "when": {"earlyLeaves": {"min": 3, "hours": 72}}, "action": "spectate",
+//			"message": "You left {{.EarlyLeaves}} games early recently"}
+//	]
+//
+// conditions of "when" must all match, empty "when" always matches:
+//
+//	linked, proxy, banned, movedOut, terminated  bool
+//	banForbids    ["joining", "playing", "chatting"], active ban forbids all listed
+//	asn           list, player's ASN contains any element
+//	cidr          list, ip is inside any network
+//	nameContains  list, lowercase name contains any element
+//	earlyLeaves   {"min": 3, "hours": 72}, games left during first minute
+//	rating        {"category": 3, "min": 1200, "max": 1800, "missing": false},
+//	              category defaults to first of ratingCategories, "missing" is
+//	              the result for players without a rating
+//	not           condition object
+//	any           list of condition objects, at least one must match
+//
+// actions: approve (stop, join as player unless an earlier rule already moved
+// to spectators), spectate (move to spectators, skipped if already spectating),
+// mute (disallow chat), reject and ban (stop, refuse join).
+// message (string or list) and log are text/template with fields of joinFacts,
+// log is written to event log before messages are rendered so they can use
+// {{.EventID}}. Without joinRules default rules are built from legacy keys
+// (blacklist, allowNonLinked*, ratingBounds, antiSpamThreshold*, bannedASNs, ipmute, ipnoplay).
+//
+// {"defaults": true} puts all default rules at its position, a list picks them
+// by name: blacklist, ban, isp, roomPrefs, ratingBounds, rateLimit, movedOut,
+// ipmute, ipNoPlay, terminated. Custom rules are not required to handle bans
+// but config validation warns about it.
+
+type joinRule struct {
+	Name     string
+	When     *joinCond
+	Action   string
+	Messages []*template.Template
+	Log      *template.Template
+	// names of default rules this entry stands for, nil for regular rules
+	include []string
+}
+
+type joinCondCount struct {
+	min   int
+	hours int
+}
+
+type joinCondRating struct {
+	category int
+	min      *int
+	max      *int
+	missing  bool
+}
+
+type joinCond struct {
+	linked       *bool
+	proxy        *bool
+	banned       *bool
+	movedOut     *bool
+	terminated   *bool
+	banForbids   []string
+	asn          []string
+	cidr         []*net.IPNet
+	nameContains []string
+	earlyLeaves  *joinCondCount
+	rating       *joinCondRating
+	not          *joinCond
+	any          []*joinCond
+}
+
+var (
+	joinRuleActions      = []string{"approve", "spectate", "mute", "reject", "ban"}
+	joinBanForbidKinds   = []string{"joining", "playing", "chatting"}
+	joinDefaultRuleNames = []string{"blacklist", "ban", "isp", "roomPrefs", "ratingBounds", "rateLimit", "movedOut", "ipmute", "ipNoPlay", "terminated"}
+)
+
+func joinParseTemplate(name, s string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(s)
+}
+
+func joinParseStrings(v any) ([]string, error) {
+	a, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("must be a list of strings")
+	}
+	ret := []string{}
+	for _, e := range a {
+		s, ok := e.(string)
+		if !ok {
+			return nil, errors.New("must be a list of strings")
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+func joinParseInt(v any) (int, error) {
+	f, ok := v.(float64)
+	if !ok || f != float64(int(f)) {
+		return 0, errors.New("must be an integer")
+	}
+	return int(f), nil
+}
+
+func parseJoinCond(v any) (*joinCond, error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("condition is not an object")
+	}
+	c := &joinCond{}
+	for k, cv := range m {
+		var err error
+		switch k {
+		case "linked", "proxy", "banned", "movedOut", "terminated":
+			b, ok := cv.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a bool", k)
+			}
+			switch k {
+			case "linked":
+				c.linked = &b
+			case "proxy":
+				c.proxy = &b
+			case "banned":
+				c.banned = &b
+			case "movedOut":
+				c.movedOut = &b
+			case "terminated":
+				c.terminated = &b
+			}
+		case "banForbids":
+			c.banForbids, err = joinParseStrings(cv)
+			for _, f := range c.banForbids {
+				if !slices.Contains(joinBanForbidKinds, f) {
+					err = fmt.Errorf("unknown ban restriction %q", f)
+				}
+			}
+		case "asn":
+			c.asn, err = joinParseStrings(cv)
+		case "nameContains":
+			c.nameContains, err = joinParseStrings(cv)
+			for i := range c.nameContains {
+				c.nameContains[i] = strings.ToLower(c.nameContains[i])
+			}
+		case "cidr":
+			var nets []string
+			nets, err = joinParseStrings(cv)
+			for _, n := range nets {
+				_, pnt, perr := net.ParseCIDR(n)
+				if perr != nil {
+					err = perr
+					break
+				}
+				c.cidr = append(c.cidr, pnt)
+			}
+		case "earlyLeaves":
+			em, ok := cv.(map[string]any)
+			if !ok {
+				return nil, errors.New("earlyLeaves must be an object")
+			}
+			c.earlyLeaves = &joinCondCount{min: 1, hours: 72}
+			for ek, ev := range em {
+				n, err := joinParseInt(ev)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("earlyLeaves.%s must be a positive integer", ek)
+				}
+				switch ek {
+				case "min":
+					c.earlyLeaves.min = n
+				case "hours":
+					c.earlyLeaves.hours = n
+				default:
+					return nil, fmt.Errorf("earlyLeaves.%s: unknown key", ek)
+				}
+			}
+		case "rating":
+			rm, ok := cv.(map[string]any)
+			if !ok {
+				return nil, errors.New("rating must be an object")
+			}
+			c.rating = &joinCondRating{}
+			for rk, rv := range rm {
+				switch rk {
+				case "category", "min", "max":
+					n, err := joinParseInt(rv)
+					if err != nil {
+						return nil, fmt.Errorf("rating.%s %w", rk, err)
+					}
+					switch rk {
+					case "category":
+						c.rating.category = n
+					case "min":
+						c.rating.min = &n
+					case "max":
+						c.rating.max = &n
+					}
+				case "missing":
+					c.rating.missing, ok = rv.(bool)
+					if !ok {
+						return nil, errors.New("rating.missing must be a bool")
+					}
+				default:
+					return nil, fmt.Errorf("rating.%s: unknown key", rk)
+				}
+			}
+		case "not":
+			c.not, err = parseJoinCond(cv)
+		case "any":
+			a, ok := cv.([]any)
+			if !ok || len(a) == 0 {
+				return nil, errors.New("any must be a non-empty list")
+			}
+			for i, av := range a {
+				sc, err := parseJoinCond(av)
+				if err != nil {
+					return nil, fmt.Errorf("any %d: %w", i, err)
+				}
+				c.any = append(c.any, sc)
+			}
+		default:
+			return nil, fmt.Errorf("unknown condition %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	return c, nil
+}
+
+func parseJoinRule(v any, n int) (r joinRule, err error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return r, errors.New("rule is not an object")
+	}
+	r.Name = "rule" + strconv.Itoa(n)
+	r.When = &joinCond{}
+	if d, ok := m["defaults"]; ok {
+		return parseJoinDefaults(d, len(m))
+	}
+	for k, rv := range m {
+		switch k {
+		case "name":
+			r.Name, ok = rv.(string)
+			if !ok || r.Name == "" {
+				return r, errors.New("name must be a non-empty string")
+			}
+		case "when":
+			r.When, err = parseJoinCond(rv)
+			if err != nil {
+				return r, fmt.Errorf("when: %w", err)
+			}
+		case "action":
+			r.Action, _ = rv.(string)
+			if !slices.Contains(joinRuleActions, r.Action) {
+				return r, fmt.Errorf("action must be one of %s", strings.Join(joinRuleActions, ", "))
+			}
+		case "message":
+			msgs := []string{}
+			if s, ok := rv.(string); ok {
+				msgs = append(msgs, s)
+			} else if msgs, err = joinParseStrings(rv); err != nil {
+				return r, errors.New("message must be a string or a list of strings")
+			}
+			for i, s := range msgs {
+				t, err := joinParseTemplate(fmt.Sprintf("message %d", i), s)
+				if err != nil {
+					return r, err
+				}
+				r.Messages = append(r.Messages, t)
+			}
+		case "log":
+			s, ok := rv.(string)
+			if !ok {
+				return r, errors.New("log must be a string")
+			}
+			r.Log, err = joinParseTemplate("log", s)
+			if err != nil {
+				return r, err
+			}
+		default:
+			return r, fmt.Errorf("%s: unknown key", k)
+		}
+	}
+	if r.Action == "" {
+		return r, errors.New("action is not set")
+	}
+	return r, nil
+}
+
+func parseJoinDefaults(v any, keys int) (r joinRule, err error) {
+	r.Name = "defaults"
+	r.When = &joinCond{}
+	if keys != 1 {
+		return r, errors.New("defaults can not be combined with other keys")
+	}
+	if b, ok := v.(bool); ok && b {
+		r.include = joinDefaultRuleNames
+		return r, nil
+	}
+	names, err := joinParseStrings(v)
+	if err != nil || len(names) == 0 {
+		return r, errors.New("defaults must be true or a list of default rule names")
+	}
+	for _, n := range names {
+		if !slices.Contains(joinDefaultRuleNames, n) {
+			return r, fmt.Errorf("unknown default rule %q, known are %s", n, strings.Join(joinDefaultRuleNames, ", "))
+		}
+	}
+	r.include = names
+	return r, nil
+}
+
+// joinRulesHandleBans tells if rules refuse banned players in any way
+func joinRulesHandleBans(rules []joinRule) bool {
+	for _, r := range rules {
+		if slices.Contains(r.include, "ban") || r.When.banned != nil || len(r.When.banForbids) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// joinExpandDefaults replaces {"defaults": ...} entries with matching default rules
+func joinExpandDefaults(inst *instance, rules []joinRule) []joinRule {
+	var defaults []joinRule
+	ret := []joinRule{}
+	for _, r := range rules {
+		if r.include == nil {
+			ret = append(ret, r)
+			continue
+		}
+		if defaults == nil {
+			defaults = joinDefaultRules(inst)
+		}
+		for _, d := range defaults {
+			if slices.Contains(r.include, d.Name) {
+				ret = append(ret, d)
+			}
+		}
+	}
+	return ret
+}
+
+// parseJoinRules builds rules from "joinRules" config value
+func parseJoinRules(v any) ([]joinRule, error) {
+	a, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("must be a list of rules")
+	}
+	ret := []joinRule{}
+	for i, rv := range a {
+		r, err := parseJoinRule(rv, i)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+func joinMustRule(r map[string]any) joinRule {
+	ret, err := parseJoinRule(r, 0)
+	if err != nil {
+		panic(fmt.Sprintf("default join rule %v: %s", r["name"], err.Error()))
+	}
+	return ret
+}
+
+// joinConfigListMerged collects enabled keys of a bool map, earlier layers override later ones
+func joinConfigListMerged(inst *instance, confpath ...string) []any {
+	enabled := map[string]bool{}
+	for i := len(inst.cfgs) - 1; i >= 0; i-- {
+		o, ok := inst.cfgs[i].GetKeys(confpath...)
+		if !ok {
+			continue
+		}
+		for _, k := range o {
+			s, ok := inst.cfgs[i].GetBool(append(confpath, k)...)
+			if !ok {
+				continue
+			}
+			enabled[k] = s
+		}
+	}
+	ret := []any{}
+	for k, v := range enabled {
+		if !v {
+			continue
+		}
+		_, _, err := net.ParseCIDR(k)
+		if err != nil {
+			inst.logger.Printf("ipmatch ip %q is not in CIDR notation: %s", k, err)
+			continue
+		}
+		ret = append(ret, k)
+	}
+	slices.SortFunc(ret, func(a, b any) int { return strings.Compare(a.(string), b.(string)) })
+	return ret
+}
+
+func joinStringsAny(s []string) []any {
+	ret := make([]any, len(s))
+	for i := range s {
+		ret[i] = s[i]
+	}
+	return ret
+}
+
+// joinDefaultRules reproduces hardcoded join checks from legacy settings
+func joinDefaultRules(inst *instance) []joinRule {
+	ret := []joinRule{}
+	blacklist := tryCfgGetD(tryGetSliceStringGen("blacklist", "name"), []string{}, inst.cfgs...)
+	if len(blacklist) > 0 {
+		ret = append(ret, joinMustRule(map[string]any{
+			"name":   "blacklist",
+			"when":   map[string]any{"nameContains": joinStringsAny(blacklist)},
+			"action": "ban",
+			"log":    "[adolfmeasures] Join name {{.Name}} triggered adolf suppression system, ip was {{.IP}}",
+			"message": "You were banned from joining Autohoster.\\n" +
+				"Ban reason: 4.1.7. Any manifestations of Nazism, nationalism, incitement " +
+				"of interracial, interethnic, interfaith discord and hostility, " +
+				"calls for the overthrow of the government by force.\\n\\n{{.Contact}}" +
+				"Event ID: {{.EventID}}",
+		}))
+	}
+	ret = append(ret, joinMustRule(map[string]any{
+		"name":   "ban",
+		"when":   map[string]any{"banForbids": []any{"joining"}},
+		"action": "reject",
+		"message": "You were banned from joining Autohoster.\\n" +
+			"Ban reason: {{.Ban.Reason}}\\n\\n{{.Contact}}" +
+			"Ban issued: {{.Ban.Issued}}\\n" +
+			"Ban expires: {{.Ban.Expires}}\\n" +
+			"Event ID: M-{{.Ban.ID}}",
+	}), joinMustRule(map[string]any{
+		"name":    "ban",
+		"when":    map[string]any{"banForbids": []any{"chatting"}},
+		"action":  "mute",
+		"message": "You are banned from chatting in this room (ban ID: M-{{.Ban.ID}})",
+	}), joinMustRule(map[string]any{
+		"name":    "ban",
+		"when":    map[string]any{"banForbids": []any{"playing"}},
+		"action":  "spectate",
+		"message": "You are banned from participating in this game (ban ID: M-{{.Ban.ID}})",
+	}))
+	if !tryCfgGetD(tryGetBoolGen("allowNonLinkedHide"), false, inst.cfgs...) {
+		ispAny := []any{map[string]any{"proxy": true}}
+		asns := []string{}
+		for _, c := range inst.cfgs {
+			sl, ok := c.GetSliceString("bannedASNs")
+			if ok {
+				asns = append(asns, sl...)
+			}
+		}
+		if len(asns) > 0 {
+			ispAny = append(ispAny, map[string]any{"asn": joinStringsAny(asns)})
+		}
+		ret = append(ret, joinMustRule(map[string]any{
+			"name":   "isp",
+			"when":   map[string]any{"linked": false, "any": ispAny},
+			"action": "reject",
+			"log":    "[antiproxy] join attempt from {{printf \"%q\" .Name}} did not pass isp checks: proxy {{.Proxy}} asn {{.ASN}} (ip was {{.IP}})",
+			"message": "You were rejected from joining Autohoster.\\n" +
+				"Reason: 2.1.1. Disruption or other interference with the system with or without defined purpose.\\n\\n" +
+				"If you believe it is a mistake, feel free to contact us: https://wz2100-autohost.net/about#contact\\n\\n" +
+				"Please provide event ID: {{.EventID}} with your request.",
+		}))
+	}
+	if !tryCfgGetD(tryGetBoolGen("allowNonLinkedJoin"), true, inst.cfgs...) {
+		ret = append(ret, joinMustRule(map[string]any{
+			"name":   "roomPrefs",
+			"when":   map[string]any{"linked": false},
+			"action": "reject",
+			"message": "You can not join this game.\\n\\n" +
+				"You must join with linked player identity. Link one at:\\n" +
+				"https://wz2100-autohost.net/wzlinkcheck\\n\\n" +
+				"Do not bother admins/moderators about this.",
+		}))
+	}
+	if !tryCfgGetD(tryGetBoolGen("allowNonLinkedPlay"), true, inst.cfgs...) {
+		ret = append(ret, joinMustRule(map[string]any{
+			"name":    "roomPrefs",
+			"when":    map[string]any{"linked": false},
+			"action":  "spectate",
+			"message": "You are not allowed to participate in this game due to being not registered",
+		}))
+	}
+	if !tryCfgGetD(tryGetBoolGen("allowNonLinkedChat"), true, inst.cfgs...) {
+		ret = append(ret, joinMustRule(map[string]any{
+			"name":   "roomPrefs",
+			"when":   map[string]any{"linked": false},
+			"action": "mute",
+			"message": []any{"You are not allowed to chat in this room due to being not registered",
+				"Link your identity on https://wz2100-autohost.net/wzlinkcheck"},
+		}))
+	}
+	ret = append(ret, joinRatingBoundsRules(inst)...)
+	asThrCnt := tryCfgGetD(tryGetIntGen("antiSpamThresholdCount"), 3, inst.cfgs...)
+	asThrDur := tryCfgGetD(tryGetIntGen("antiSpamThresholdDuration"), 3*24, inst.cfgs...)
+	if asThrCnt > 0 && asThrDur > 0 {
+		ret = append(ret, joinMustRule(map[string]any{
+			"name":    "rateLimit",
+			"when":    map[string]any{"earlyLeaves": map[string]any{"min": float64(asThrCnt), "hours": float64(asThrDur)}},
+			"action":  "spectate",
+			"message": "You were automatically rate limited for leaving the game early. Do not contact admins/moderators about this, they will not help you",
+		}))
+	}
+	ret = append(ret, joinMustRule(map[string]any{
+		"name":    "movedOut",
+		"when":    map[string]any{"movedOut": true},
+		"action":  "spectate",
+		"message": "You not allowed to participate in the game because moderator moved you out earlier",
+	}))
+	if ipmute := joinConfigListMerged(inst, "ipmute"); len(ipmute) > 0 {
+		ret = append(ret, joinMustRule(map[string]any{
+			"name":   "ipmute",
+			"when":   map[string]any{"linked": false, "cidr": ipmute},
+			"action": "mute",
+		}))
+	}
+	if ipnoplay := joinConfigListMerged(inst, "ipnoplay"); len(ipnoplay) > 0 {
+		ret = append(ret, joinMustRule(map[string]any{
+			"name":   "ipNoPlay",
+			"when":   map[string]any{"linked": false, "cidr": ipnoplay},
+			"action": "spectate",
+		}))
+	}
+	ret = append(ret, joinMustRule(map[string]any{
+		"name":    "terminated",
+		"when":    map[string]any{"terminated": true},
+		"action":  "spectate",
+		"message": "You not allowed to participate in the game because your account was terminated. Contact administration for more details.",
+	}))
+	return ret
+}
+
+// rating bounds restrict who can play per rating category, out of range players spectate:
+//
+//	"ratingBounds": {
+//		"3": {"min": 1200, "max": 1600, "allowUnrated": false, "message": "..."}
+//	}
+//
+// taken whole from the first layer that has it, message is a template like in join rules.
+// Custom joinRules get them appended unless already included with defaults,
+// a matching approve rule stops before reaching them.
+func joinRatingBoundsRules(inst *instance) []joinRule {
+	var bounds map[string]any
+	for _, c := range inst.cfgs {
+		var ok bool
+		bounds, ok = c.GetMapStringAny("ratingBounds")
+		if ok {
+			break
+		}
+	}
+	categories := make([]string, 0, len(bounds))
+	for k := range bounds {
+		categories = append(categories, k)
+	}
+	slices.Sort(categories)
+	ret := []joinRule{}
+	for _, k := range categories {
+		b, _ := bounds[k].(map[string]any)
+		category, err := strconv.Atoi(k)
+		if err != nil || b == nil {
+			inst.logger.Printf("Invalid ratingBounds category %q", k)
+			continue
+		}
+		cond := map[string]any{"category": float64(category)}
+		min, hasMin := b["min"].(float64)
+		max, hasMax := b["max"].(float64)
+		rangeStr := ""
+		switch {
+		case hasMin && hasMax:
+			cond["min"], cond["max"] = min, max
+			rangeStr = fmt.Sprintf("%d-%d", int(min), int(max))
+		case hasMin:
+			cond["min"] = min
+			rangeStr = fmt.Sprintf("at least %d", int(min))
+		case hasMax:
+			cond["max"] = max
+			rangeStr = fmt.Sprintf("at most %d", int(max))
+		default:
+			continue
+		}
+		cond["missing"], _ = b["allowUnrated"].(bool)
+		msg, ok := b["message"].(string)
+		if !ok {
+			msg = fmt.Sprintf("This game is for players rated %s in rating category %d, ", rangeStr, category) +
+				"{{if .Rated}}your rating is {{.Rating}}{{else}}you do not have a rating yet{{end}}. You can still spectate."
+		}
+		r, err := parseJoinRule(map[string]any{
+			"name":    "ratingBounds",
+			"when":    map[string]any{"not": map[string]any{"rating": cond}},
+			"action":  "spectate",
+			"message": msg,
+		}, 0)
+		if err != nil {
+			inst.logger.Printf("Invalid ratingBounds for category %d: %s", category, err.Error())
+			continue
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// joinRulesFor returns rules of the instance and where they came from
+func joinRulesFor(inst *instance) ([]joinRule, string) {
+	names := geniLayerNames(inst)
+	for i, c := range inst.cfgs {
+		v, ok := c.Get("joinRules")
+		if !ok {
+			continue
+		}
+		rules, err := parseJoinRules(v)
+		if err != nil {
+			inst.logger.Printf("Invalid joinRules in %s, using default rules: %s", names[i], err.Error())
+			notifyErrorf("Instance %d has invalid joinRules in %s, using default rules: %s", inst.Id, names[i], err.Error())
+			break
+		}
+		if !slices.ContainsFunc(rules, func(r joinRule) bool { return slices.Contains(r.include, "ratingBounds") }) {
+			rules = append(rules, joinRatingBoundsRules(inst)...)
+		}
+		return joinExpandDefaults(inst, rules), names[i]
+	}
+	return joinDefaultRules(inst), "default"
+}
+
+type joinBan struct {
+	ID              int       `json:"id"`
+	Reason          string    `json:"reason"`
+	Issued          time.Time `json:"issued"`
+	Expires         string    `json:"expires"`
+	ForbidsJoining  bool      `json:"forbidsJoining"`
+	ForbidsPlaying  bool      `json:"forbidsPlaying"`
+	ForbidsChatting bool      `json:"forbidsChatting"`
+}
+
+// joinFacts is what rules are checked against and what templates see,
+// expensive facts are looked up only when a condition needs them
+type joinFacts struct {
+	inst   *instance
+	pubkey []byte
+	dryRun bool
+
+	Name     string   `json:"name"`
+	IP       string   `json:"ip"`
+	Pubkey   string   `json:"pubkey"`
+	Account  *int     `json:"account"`
+	Ban      *joinBan `json:"ban"`
+	MovedOut bool     `json:"movedOut"`
+
+	ispLooked bool
+	ispErr    error
+	ASN       string `json:"asn,omitempty"`
+	Proxy     bool   `json:"proxy"`
+
+	terminatedLooked bool
+	Terminated       bool `json:"terminated"`
+
+	EarlyLeavesByHours map[int]int  `json:"earlyLeaves,omitempty"`
+	Ratings            map[int]*int `json:"ratings,omitempty"`
+
+	// last looked up values, for templates
+	EarlyLeaves int  `json:"-"`
+	Rating      int  `json:"-"`
+	Rated       bool `json:"-"`
+
+	EventID string `json:"-"`
+	Contact string `json:"-"`
+}
+
+func joinGatherFacts(inst *instance, ip, name string, pubkey []byte, pubkeyB64 string, dryRun bool) *joinFacts {
+	f := &joinFacts{
+		inst:               inst,
+		pubkey:             pubkey,
+		dryRun:             dryRun,
+		Name:               name,
+		IP:                 ip,
+		Pubkey:             pubkeyB64,
+		MovedOut:           joincheckWasMovedOutGlobal.present(pubkeyB64, inst.Id),
+		EarlyLeavesByHours: map[int]int{},
+		Ratings:            map[int]*int{},
+		Contact:            rejectContactMsg,
+	}
+	var (
+		banid            *int
+		banissued        *time.Time
+		banexpires       *time.Time
+		banexpired       *bool
+		banreason        *string
+		forbids_joining  *bool
+		forbids_playing  *bool
+		forbids_chatting *bool
+	)
+	err := dbpool.QueryRow(context.Background(), `select
+	identities.account, bans.id, time_issued, time_expires, coalesce(time_expires < now(), 'false'), reason, forbids_joining, forbids_playing, forbids_chatting
+from identities
+left outer join bans on bans.identity = identities.id or bans.account = identities.account
+where
+	identities.hash = encode(sha256($1), 'hex')
+order by time_expires desc
+limit 1`, pubkey).Scan(&f.Account, &banid, &banissued, &banexpires, &banexpired, &banreason, &forbids_joining, &forbids_playing, &forbids_chatting)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			inst.logger.Printf("Failed to request bans from database: %s", err.Error())
+		}
+	}
+	if banid != nil && banexpired != nil && !*banexpired {
+		f.Ban = &joinBan{
+			ID:              *banid,
+			Expires:         "never",
+			ForbidsJoining:  forbids_joining != nil && *forbids_joining,
+			ForbidsPlaying:  forbids_playing != nil && *forbids_playing,
+			ForbidsChatting: forbids_chatting != nil && *forbids_chatting,
+		}
+		if banreason != nil {
+			f.Ban.Reason = *banreason
+		}
+		if banissued != nil {
+			f.Ban.Issued = *banissued
+		}
+		if banexpires != nil {
+			f.Ban.Expires = (*banexpires).String()
+		}
+	}
+	return f
+}
+
+func (f *joinFacts) lookupISP() error {
+	if !f.ispLooked {
+		f.ispLooked = true
+		rsp, err := ISPchecker.Lookup(f.IP)
+		if err != nil {
+			f.inst.logger.Printf("Failed to lookup ISP: %s", err.Error())
+			f.ispErr = err
+		} else {
+			f.ASN, f.Proxy = rsp.ASN, rsp.IsProxy
+		}
+	}
+	return f.ispErr
+}
+
+func (f *joinFacts) lookupEarlyLeaves(hours int) int {
+	c, ok := f.EarlyLeavesByHours[hours]
+	if !ok {
+		dbpool.QueryRow(context.Background(), `select
+	count(g.id)
+from games as g
+join players as p on p.game = g.id
+join identities as i on p.identity = i.id
+left join accounts as a on i.account = a.id
+where g.game_time < 60000 and g.time_started + $1::interval > now() and (i.pkey = $2 or a.id = coalesce($3, -1))`, fmt.Sprintf("%d hours", hours), f.pubkey, f.Account).Scan(&c)
+		f.EarlyLeavesByHours[hours] = c
+	}
+	f.EarlyLeaves = c
+	return c
+}
+
+func (f *joinFacts) lookupRating(category int) *int {
+	r, ok := f.Ratings[category]
+	if !ok {
+		if f.Account != nil {
+			err := dbpool.QueryRow(context.Background(), `select rating from ratings where account = $1 and category = $2`, *f.Account, category).Scan(&r)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				f.inst.logger.Printf("Failed to request rating from database: %s", err.Error())
+			}
+		}
+		f.Ratings[category] = r
+	}
+	f.Rating, f.Rated = 0, r != nil
+	if r != nil {
+		f.Rating = *r
+	}
+	return r
+}
+
+func (f *joinFacts) lookupTerminated() bool {
+	if !f.terminatedLooked {
+		f.terminatedLooked = true
+		dbpool.QueryRow(context.Background(), `select terminated
+from accounts as a
+join identities as i on i.account = a.id
+where i.pkey = $1`, f.pubkey).Scan(&f.Terminated)
+	}
+	return f.Terminated
+}
+
+// eval checks conditions in fixed order stopping at first mismatch, checks describe what was compared
+func (c *joinCond) eval(f *joinFacts) (bool, []string) {
+	checks := []string{}
+	check := func(ok bool, format string, args ...any) bool {
+		checks = append(checks, fmt.Sprintf(format, args...)+" "+map[bool]string{true: "(match)", false: "(no match)"}[ok])
+		return ok
+	}
+	if c.linked != nil && !check((f.Account != nil) == *c.linked, "linked %v, want %v", f.Account != nil, *c.linked) {
+		return false, checks
+	}
+	if c.banned != nil && !check((f.Ban != nil) == *c.banned, "banned %v, want %v", f.Ban != nil, *c.banned) {
+		return false, checks
+	}
+	if len(c.banForbids) > 0 {
+		ok := f.Ban != nil
+		for _, k := range c.banForbids {
+			ok = ok && map[string]bool{"joining": f.Ban.ForbidsJoining, "playing": f.Ban.ForbidsPlaying, "chatting": f.Ban.ForbidsChatting}[k]
+		}
+		if !check(ok, "active ban forbids %s", strings.Join(c.banForbids, ", ")) {
+			return false, checks
+		}
+	}
+	if len(c.nameContains) > 0 && !check(stringContainsSlices(strings.ToLower(f.Name), c.nameContains), "name %q contains one of %q", f.Name, c.nameContains) {
+		return false, checks
+	}
+	if len(c.cidr) > 0 {
+		ip := net.ParseIP(f.IP)
+		matched := ""
+		for _, n := range c.cidr {
+			if ip != nil && n.Contains(ip) {
+				matched = n.String()
+				break
+			}
+		}
+		if !check(matched != "", "ip %s in %s", f.IP, map[bool]string{true: matched, false: "listed networks"}[matched != ""]) {
+			return false, checks
+		}
+	}
+	if c.movedOut != nil && !check(f.MovedOut == *c.movedOut, "moved out %v, want %v", f.MovedOut, *c.movedOut) {
+		return false, checks
+	}
+	if c.proxy != nil {
+		if err := f.lookupISP(); err != nil {
+			check(false, "proxy unknown, isp lookup failed: %s", err.Error())
+			return false, checks
+		}
+		if !check(f.Proxy == *c.proxy, "proxy %v, want %v", f.Proxy, *c.proxy) {
+			return false, checks
+		}
+	}
+	if len(c.asn) > 0 {
+		if err := f.lookupISP(); err != nil {
+			check(false, "asn unknown, isp lookup failed: %s", err.Error())
+			return false, checks
+		}
+		if !check(stringContainsSlices(f.ASN, c.asn), "asn %q contains one of %q", f.ASN, c.asn) {
+			return false, checks
+		}
+	}
+	if c.earlyLeaves != nil {
+		n := f.lookupEarlyLeaves(c.earlyLeaves.hours)
+		if !check(n >= c.earlyLeaves.min, "%d early leaves in %d hours, want at least %d", n, c.earlyLeaves.hours, c.earlyLeaves.min) {
+			return false, checks
+		}
+	}
+	if c.rating != nil {
+		category := c.rating.category
+		if category == 0 && len(f.inst.Settings.RatingCategories) > 0 {
+			category = f.inst.Settings.RatingCategories[0]
+		}
+		r := f.lookupRating(category)
+		if r == nil {
+			if !check(c.rating.missing, "no rating in category %d", category) {
+				return false, checks
+			}
+		} else {
+			ok := (c.rating.min == nil || *r >= *c.rating.min) && (c.rating.max == nil || *r <= *c.rating.max)
+			bounds := ""
+			if c.rating.min != nil {
+				bounds += fmt.Sprintf(" min %d", *c.rating.min)
+			}
+			if c.rating.max != nil {
+				bounds += fmt.Sprintf(" max %d", *c.rating.max)
+			}
+			if !check(ok, "rating %d in category %d, want%s", *r, category, bounds) {
+				return false, checks
+			}
+		}
+	}
+	if c.terminated != nil && !check(f.lookupTerminated() == *c.terminated, "terminated %v, want %v", f.Terminated, *c.terminated) {
+		return false, checks
+	}
+	if c.not != nil {
+		ok, sub := c.not.eval(f)
+		if !check(!ok, "not [%s]", strings.Join(sub, "; ")) {
+			return false, checks
+		}
+	}
+	if len(c.any) > 0 {
+		subs := []string{}
+		matched := false
+		for _, sc := range c.any {
+			ok, sub := sc.eval(f)
+			subs = append(subs, "["+strings.Join(sub, "; ")+"]")
+			if ok {
+				matched = true
+				break
+			}
+		}
+		if !check(matched, "any of %s", strings.Join(subs, " or ")) {
+			return false, checks
+		}
+	}
+	return true, checks
+}
+
+type joinRuleTrace struct {
+	Rule    string   `json:"rule"`
+	Action  string   `json:"action"`
+	Matched bool     `json:"matched"`
+	Checks  []string `json:"checks"`
+	Effect  string   `json:"effect,omitempty"`
+}
+
+type joinCheckResult struct {
+	Rules     string          `json:"rules"`
+	Decision  string          `json:"decision"`
+	Stage     string          `json:"stage"`
+	Stages    []string        `json:"stages"`
+	Reason    string          `json:"reason,omitempty"`
+	Messages  []string        `json:"messages"`
+	AllowChat bool            `json:"allowChat"`
+	Trace     []joinRuleTrace `json:"trace"`
+	Facts     *joinFacts      `json:"facts"`
+
+	action joinCheckActionLevel
+	jd     joinDispatch
+}
+
+func joinRender(inst *instance, t *template.Template, f *joinFacts) string {
+	var sb strings.Builder
+	err := t.Execute(&sb, f)
+	if err != nil {
+		inst.logger.Printf("Failed to render join rule %s: %s", t.Name(), err.Error())
+		return t.Root.String()
+	}
+	return sb.String()
+}
+
+// joinEvaluate runs rules against facts, dry run does not write to event log
+func joinEvaluate(inst *instance, f *joinFacts, rules []joinRule, source string) *joinCheckResult {
+	res := &joinCheckResult{
+		Rules:  source,
+		Stage:  "none",
+		Stages: []string{},
+		Facts:  f,
+		action: joinCheckActionLevelApprove,
+		jd: joinDispatch{
+			Issued:    time.Now(),
+			Messages:  []string{},
+			AllowChat: true,
+		},
+	}
+	renderMessages := func(r joinRule) []string {
+		ret := []string{}
+		for _, t := range r.Messages {
+			ret = append(ret, joinRender(inst, t, f))
+		}
+		return ret
+	}
+	for _, r := range rules {
+		matched, checks := r.When.eval(f)
+		tr := joinRuleTrace{Rule: r.Name, Action: r.Action, Matched: matched, Checks: checks}
+		if !matched {
+			res.Trace = append(res.Trace, tr)
+			continue
+		}
+		if r.Log != nil {
+			if f.dryRun {
+				f.EventID = "(dry run)"
+			} else {
+				ecode, err := DbLogAction("%d %s", inst.Id, joinRender(inst, r.Log, f))
+				if err != nil {
+					inst.logger.Printf("Failed to log action in database: %s", err.Error())
+				}
+				f.EventID = ecode
+			}
+		}
+		stop := false
+		switch r.Action {
+		case "approve":
+			// only stops evaluation, does not lift spectate of earlier rules
+			res.jd.Messages = append(res.jd.Messages, renderMessages(r)...)
+			if res.action == joinCheckActionLevelApprove {
+				res.Stage = r.Name
+				tr.Effect = "approved, remaining rules skipped"
+			} else {
+				tr.Effect = "remaining rules skipped, stays in spectators"
+			}
+			stop = true
+		case "spectate":
+			if res.action != joinCheckActionLevelApprove {
+				tr.Effect = "skipped, already spectating"
+				break
+			}
+			res.action = joinCheckActionLevelApproveSpec
+			res.Stage = r.Name
+			res.jd.Messages = append(res.jd.Messages, renderMessages(r)...)
+			tr.Effect = "moved to spectators"
+		case "mute":
+			res.jd.AllowChat = false
+			res.jd.Messages = append(res.jd.Messages, renderMessages(r)...)
+			tr.Effect = "chat disallowed"
+		case "reject", "ban":
+			res.action = joinCheckActionLevelReject
+			if r.Action == "ban" {
+				res.action = joinCheckActionLevelBan
+			}
+			res.Stage = r.Name
+			res.Reason = strings.Join(renderMessages(r), "\\n")
+			tr.Effect = "join refused, remaining rules skipped"
+			stop = true
+		}
+		if !strings.HasPrefix(tr.Effect, "skipped") && !slices.Contains(res.Stages, r.Name) {
+			res.Stages = append(res.Stages, r.Name)
+		}
+		res.Trace = append(res.Trace, tr)
+		if stop {
+			break
+		}
+	}
+	res.Decision = res.action.String()
+	res.Messages = res.jd.Messages
+	res.AllowChat = res.jd.AllowChat
+	return res
+}
+
+// joinDryRun evaluates rules without logging events, useful to find out why someone can't join
+func joinDryRun(inst *instance, r *http.Request) (*joinCheckResult, error) {
+	q := r.URL.Query()
+	// query parsing turns unescaped + of base64 into spaces
+	pubkeyB64 := strings.ReplaceAll(q.Get("pubkey"), " ", "+")
+	pubkey, err := base64.StdEncoding.DecodeString(pubkeyB64)
+	if err != nil || len(pubkey) == 0 {
+		return nil, errors.New("pubkey must be a base64 encoded public key")
+	}
+	ip := q.Get("ip")
+	if net.ParseIP(ip) == nil {
+		return nil, errors.New("ip must be a valid address")
+	}
+	rules, source := joinRulesFor(inst)
+	f := joinGatherFacts(inst, ip, q.Get("name"), pubkey, pubkeyB64, true)
+	return joinEvaluate(inst, f, rules, source), nil
+}
+
+func apiHandleQueueJoinCheck(w http.ResponseWriter, r *http.Request, _ string) {
+	inst, _, err := previewBuildInstance(r.PathValue("name"), r.URL.Query().Get("map"))
+	if errors.Is(err, errPreviewNoQueue) {
+		apiRespondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		apiRespondError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	res, err := joinDryRun(inst, r)
+	if err != nil {
+		apiRespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	apiRespondJSON(w, http.StatusOK, res)
+}
+
+func apiHandleInstanceJoinCheck(w http.ResponseWriter, r *http.Request, _ string) {
+	inst := apiGetInstance(w, r)
+	if inst == nil {
+		return
+	}
+	res, err := joinDryRun(inst, r)
+	if err != nil {
+		apiRespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	apiRespondJSON(w, http.StatusOK, res)
+}
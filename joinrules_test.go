@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maxsupermanhd/lac/v2"
+)
+
+// testJoinInstance builds instance with map, queue and settingsFallback layers
+func testJoinInstance(t *testing.T, layers ...string) *instance {
+	t.Helper()
+	inst := &instance{logger: log.New(io.Discard, "", 0)}
+	for _, l := range layers {
+		c, err := lac.FromBytesJSON([]byte(l))
+		if err != nil {
+			t.Fatal(err)
+		}
+		inst.cfgs = append(inst.cfgs, c)
+	}
+	return inst
+}
+
+func testJoinRuleNames(rules []joinRule) string {
+	ret := []string{}
+	for _, r := range rules {
+		ret = append(ret, r.Name)
+	}
+	return strings.Join(ret, ",")
+}
+
+func TestJoinRulesFor(t *testing.T) {
+	fallback := `{"blacklist": {"name": ["badword"]}}`
+	for _, tc := range []struct {
+		name   string
+		queue  string
+		source string
+		want   string
+	}{
+		{"defaults without joinRules", `{}`, "default", "blacklist,ban,ban,ban,isp,rateLimit,movedOut,terminated"},
+		{"custom rules only", `{"joinRules": [{"name": "x", "action": "approve"}]}`, `queue ""`, "x"},
+		{"all defaults included", `{"joinRules": [{"name": "x", "action": "mute"}, {"defaults": true}]}`, `queue ""`,
+			"x,blacklist,ban,ban,ban,isp,rateLimit,movedOut,terminated"},
+		{"picked defaults keep their position", `{"joinRules": [{"defaults": ["ban", "blacklist"]}, {"name": "x", "action": "approve"}, {"defaults": ["terminated"]}]}`, `queue ""`,
+			"blacklist,ban,ban,ban,x,terminated"},
+		{"defaults that are turned off are skipped", `{"antiSpamThresholdCount": 0, "joinRules": [{"defaults": ["rateLimit", "ipmute", "movedOut"]}]}`, `queue ""`,
+			"movedOut"},
+		{"ratingBounds follow custom rules", `{"ratingBounds": {"3": {"min": 1200}}, "joinRules": [{"name": "x", "action": "mute"}]}`, `queue ""`,
+			"x,ratingBounds"},
+		{"no ratingBounds configured", `{"joinRules": [{"name": "x", "action": "mute"}]}`, `queue ""`, "x"},
+		{"ratingBounds included once", `{"ratingBounds": {"3": {"min": 1200}, "4": {"max": 1000}}, "joinRules": [{"defaults": ["ratingBounds"]}, {"name": "x", "action": "mute"}]}`, `queue ""`,
+			"ratingBounds,ratingBounds,x"},
+		{"invalid rules fall back to defaults", `{"joinRules": [{"defaults": ["bans"]}]}`, "default", "blacklist,ban,ban,ban,isp,rateLimit,movedOut,terminated"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inst := testJoinInstance(t, `{}`, tc.queue, fallback)
+			rules, source := joinRulesFor(inst)
+			if source != tc.source {
+				t.Errorf("source %s, want %s", source, tc.source)
+			}
+			if got := testJoinRuleNames(rules); got != tc.want {
+				t.Errorf("rules %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseJoinRulesDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		rules string
+		err   string
+		bans  bool
+	}{
+		{rules: `[{"defaults": true}]`, bans: true},
+		{rules: `[{"defaults": ["ban"]}]`, bans: true},
+		{rules: `[{"defaults": ["blacklist", "terminated"]}]`},
+		{rules: `[{"name": "b", "when": {"banForbids": ["joining"]}, "action": "reject"}]`, bans: true},
+		{rules: `[{"name": "b", "when": {"banned": true}, "action": "reject"}]`, bans: true},
+		{rules: `[{"name": "x", "when": {"linked": false}, "action": "reject"}]`},
+		{rules: `[{"defaults": false}]`, err: "rule 0: defaults must be true or a list of default rule names"},
+		{rules: `[{"defaults": []}]`, err: "rule 0: defaults must be true or a list of default rule names"},
+		{rules: `[{"defaults": ["bans"]}]`, err: `rule 0: unknown default rule "bans", known are blacklist, ban, isp, roomPrefs, ratingBounds, rateLimit, movedOut, ipmute, ipNoPlay, terminated`},
+		{rules: `[{"name": "x", "action": "mute"}, {"defaults": true, "action": "approve"}]`, err: "rule 1: defaults can not be combined with other keys"},
+	} {
+		var v any
+		err := json.Unmarshal([]byte(tc.rules), &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules, err := parseJoinRules(v)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: got error %v, want %q", tc.rules, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.rules, err)
+			continue
+		}
+		if got := joinRulesHandleBans(rules); got != tc.bans {
+			t.Errorf("%s: handles bans %v, want %v", tc.rules, got, tc.bans)
+		}
+	}
+}
+
+func TestConfigValidateJoinRulesWarning(t *testing.T) {
+	errs := configValidate([]byte(`{"queues": {"q": {"joinRules": [{"name": "x", "action": "approve"}]}}}`))
+	problems, warnings := configSplitWarnings(errs)
+	if len(problems) != 0 {
+		t.Errorf("problems %v", problems)
+	}
+	want := []string{`queues.q.joinRules: rules do not handle bans, banned players can join, add {"defaults": ["ban"]} to keep them out`}
+	got := []string{}
+	for _, w := range warnings {
+		got = append(got, w.Error())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings %q, want %q", got, want)
+	}
+	errs = configValidate([]byte(`{"queues": {"q": {"joinRules": [{"defaults": ["ban"]}, {"name": "x", "action": "approve"}]}}}`))
+	if len(errs) != 0 {
+		t.Errorf("rules with ban handling reported %v", errs)
+	}
+}
+
+// testJoinFacts makes facts that never need database or isp lookups
+func testJoinFacts(inst *instance, name string, account *int) *joinFacts {
+	return &joinFacts{
+		inst:               inst,
+		dryRun:             true,
+		Name:               name,
+		IP:                 "192.0.2.10",
+		Account:            account,
+		ispLooked:          true,
+		terminatedLooked:   true,
+		EarlyLeavesByHours: map[int]int{72: 0},
+		Ratings:            map[int]*int{},
+	}
+}
+
+func TestJoinEvaluate(t *testing.T) {
+	acc := 7
+	rating := func(r int) *int { return &r }
+	custom := `{"ratingCategories": [3], "joinRules": [
+		{"defaults": ["blacklist", "ban"]},
+		{"name": "highRated", "when": {"rating": {"min": 1500}}, "action": "approve", "message": "Welcome, {{.Name}}"},
+		{"name": "unlinked", "when": {"linked": false}, "action": "spectate", "message": "Link your identity to play"}
+	]}`
+	for _, tc := range []struct {
+		name     string
+		queue    string
+		facts    func(f *joinFacts)
+		unlinked bool
+		decision joinCheckActionLevel
+		stage    string
+		stages   []string
+		messages []string
+		reason   string
+		chat     bool
+		effects  []string
+	}{
+		{
+			name:     "high rated approved",
+			queue:    custom,
+			facts:    func(f *joinFacts) { f.Ratings[3] = rating(1600) },
+			decision: joinCheckActionLevelApprove,
+			stage:    "highRated",
+			stages:   []string{"highRated"},
+			messages: []string{"Welcome, Player"},
+			chat:     true,
+			effects:  []string{"", "", "", "", "approved, remaining rules skipped"},
+		},
+		{
+			name:     "low rated linked falls through",
+			queue:    custom,
+			facts:    func(f *joinFacts) { f.Ratings[3] = rating(1000) },
+			decision: joinCheckActionLevelApprove,
+			stage:    "none",
+			stages:   []string{},
+			messages: []string{},
+			chat:     true,
+			effects:  []string{"", "", "", "", "", ""},
+		},
+		{
+			name:  "approve does not lift play ban",
+			queue: custom,
+			facts: func(f *joinFacts) {
+				f.Ratings[3] = rating(1600)
+				f.Ban = &joinBan{ID: 12, ForbidsPlaying: true}
+			},
+			decision: joinCheckActionLevelApproveSpec,
+			stage:    "ban",
+			stages:   []string{"ban", "highRated"},
+			messages: []string{"You are banned from participating in this game (ban ID: M-12)", "Welcome, Player"},
+			chat:     true,
+			effects:  []string{"", "", "", "moved to spectators", "remaining rules skipped, stays in spectators"},
+		},
+		{
+			name:  "join ban rejects before approve",
+			queue: custom,
+			facts: func(f *joinFacts) {
+				f.Ratings[3] = rating(1600)
+				f.Ban = &joinBan{ID: 13, Reason: "griefing", Expires: "never", ForbidsJoining: true, ForbidsChatting: true}
+			},
+			decision: joinCheckActionLevelReject,
+			stage:    "ban",
+			stages:   []string{"ban"},
+			messages: []string{},
+			reason:   "griefing",
+			chat:     true,
+			effects:  []string{"", "join refused, remaining rules skipped"},
+		},
+		{
+			name:     "chat ban mutes",
+			queue:    custom,
+			facts:    func(f *joinFacts) { f.Ban = &joinBan{ID: 14, ForbidsChatting: true} },
+			unlinked: true,
+			decision: joinCheckActionLevelApproveSpec,
+			stage:    "unlinked",
+			stages:   []string{"ban", "unlinked"},
+			messages: []string{"You are banned from chatting in this room (ban ID: M-14)", "Link your identity to play"},
+			chat:     false,
+			effects:  []string{"", "", "chat disallowed", "", "", "moved to spectators"},
+		},
+		{
+			name:     "blacklisted name is banned",
+			queue:    custom,
+			facts:    func(f *joinFacts) { f.Name = "xXbadwordXx" },
+			decision: joinCheckActionLevelBan,
+			stage:    "blacklist",
+			stages:   []string{"blacklist"},
+			messages: []string{},
+			reason:   "Event ID: (dry run)",
+			chat:     true,
+			effects:  []string{"join refused, remaining rules skipped"},
+		},
+		{
+			name:     "default rules rate limit leavers",
+			queue:    `{}`,
+			facts:    func(f *joinFacts) { f.EarlyLeavesByHours[72] = 4 },
+			decision: joinCheckActionLevelApproveSpec,
+			stage:    "rateLimit",
+			stages:   []string{"rateLimit"},
+			messages: []string{"You were automatically rate limited for leaving the game early. Do not contact admins/moderators about this, they will not help you"},
+			chat:     true,
+			effects:  []string{"", "", "", "", "", "moved to spectators", "", ""},
+		},
+		{
+			name:     "default rules keep terminated in spectators once",
+			queue:    `{}`,
+			facts:    func(f *joinFacts) { f.EarlyLeavesByHours[72] = 4; f.Terminated = true },
+			decision: joinCheckActionLevelApproveSpec,
+			stage:    "rateLimit",
+			stages:   []string{"rateLimit"},
+			messages: []string{"You were automatically rate limited for leaving the game early. Do not contact admins/moderators about this, they will not help you"},
+			chat:     true,
+			effects:  []string{"", "", "", "", "", "moved to spectators", "", "skipped, already spectating"},
+		},
+		{
+			name:     "ratingBounds spectate unrated",
+			queue:    `{"ratingBounds": {"3": {"min": 1200}}}`,
+			facts:    func(f *joinFacts) { f.Ratings[3] = nil },
+			decision: joinCheckActionLevelApproveSpec,
+			stage:    "ratingBounds",
+			stages:   []string{"ratingBounds"},
+			messages: []string{"This game is for players rated at least 1200 in rating category 3, you do not have a rating yet. You can still spectate."},
+			chat:     true,
+			effects:  []string{"", "", "", "", "", "moved to spectators", "", "", ""},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inst := testJoinInstance(t, `{}`, tc.queue, `{"blacklist": {"name": ["badword"]}}`)
+			inst.Settings.RatingCategories = []int{3}
+			var account *int
+			if !tc.unlinked {
+				account = &acc
+			}
+			f := testJoinFacts(inst, "Player", account)
+			if tc.facts != nil {
+				tc.facts(f)
+			}
+			rules, source := joinRulesFor(inst)
+			res := joinEvaluate(inst, f, rules, source)
+			if res.action != tc.decision || res.Decision != tc.decision.String() {
+				t.Errorf("decision %s (%s), want %s", res.action, res.Decision, tc.decision)
+			}
+			if res.Stage != tc.stage {
+				t.Errorf("stage %q, want %q", res.Stage, tc.stage)
+			}
+			if !reflect.DeepEqual(res.Stages, tc.stages) {
+				t.Errorf("stages %q, want %q", res.Stages, tc.stages)
+			}
+			if !reflect.DeepEqual(res.Messages, tc.messages) {
+				t.Errorf("messages %q, want %q", res.Messages, tc.messages)
+			}
+			if !strings.Contains(res.Reason, tc.reason) || (tc.reason == "") != (res.Reason == "") {
+				t.Errorf("reason %q, want it to contain %q", res.Reason, tc.reason)
+			}
+			if res.AllowChat != tc.chat || res.jd.AllowChat != tc.chat {
+				t.Errorf("allow chat %v, want %v", res.AllowChat, tc.chat)
+			}
+			effects := []string{}
+			for _, tr := range res.Trace {
+				effects = append(effects, tr.Effect)
+			}
+			if !reflect.DeepEqual(effects, tc.effects) {
+				t.Errorf("trace effects %q, want %q", effects, tc.effects)
+			}
+		})
+	}
+}
+
+func TestJoinDryRunInput(t *testing.T) {
+	inst := testJoinInstance(t, `{}`, `{}`, `{}`)
+	for _, q := range []string{
+		"",
+		"pubkey=&ip=192.0.2.1",
+		"pubkey=not*base64&ip=192.0.2.1",
+		"pubkey=AAAA&ip=",
+		"pubkey=AAAA&ip=example.com",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/instances/1/joincheck?"+q, nil)
+		_, err := joinDryRun(inst, r)
+		if err == nil {
+			t.Errorf("dry run with %q accepted", q)
+		}
+	}
+}
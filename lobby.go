@@ -25,11 +25,35 @@ func routineLobbyKeepalive(closechan <-chan struct{}) {
 	}
 }
 
+type queueSpawnState struct {
+	name      string
+	priority  int
+	minRooms  int
+	maxRooms  int
+	threshold float64
+	rooms     []float64 // fill of every lobby room, -1 if not yet seen in lobby
+}
+
+// filled tells if every room of the queue is past autoscale threshold
+func (q *queueSpawnState) filled() bool {
+	for _, f := range q.rooms {
+		if f < q.threshold {
+			return false
+		}
+	}
+	return true
+}
+
 func populateLobby(lr []lobby.LobbyRoom) {
+	shutdownUnscheduledQueues()
 	if !cfg.GetDSBool(false, "allowSpawn") {
 		log.Println("Room spawning disabled")
 		return
 	}
+	if draining.Load() {
+		log.Println("Room spawning paused, draining")
+		return
+	}
 	maxlobby := cfg.GetDSInt(8, "spawnCutoutLobbyRooms")
 	if len(lr) >= maxlobby {
 		log.Printf("Queue processing paused, too many rooms in lobby (%d >= %d)", len(lr), maxlobby)
@@ -45,41 +69,127 @@ func populateLobby(lr []lobby.LobbyRoom) {
 	}
 	instancesLock.Unlock()
 	if runningRooms >= maxrunning {
-		log.Printf("Queue processing paused, too many running rooms (%d >= %d)", runningRooms, maxlobby)
+		log.Printf("Queue processing paused, too many running rooms (%d >= %d)", runningRooms, maxrunning)
 		return
 	}
 
-	queuesK, ok := cfg.GetKeys("queues")
-	if !ok {
+	queues := collectQueueSpawnStates(lr)
+	if queues == nil {
 		log.Println("Queue processing paused, queues not defined in config")
 		return
 	}
 
-	sort.Strings(queuesK)
+	// rooms we are still allowed to put into the lobby
+	budget := maxlobby - len(lr)
 
+	// first make sure every queue has its minimum of rooms, higher priority first
+	for _, q := range queues {
+		for len(q.rooms) < q.minRooms && budget > 0 {
+			log.Printf("Queue %q has %d of %d minimum rooms in lobby, spawning new one...", q.name, len(q.rooms), q.minRooms)
+			if !spawnQueueRoom(q.name) {
+				break
+			}
+			q.rooms = append(q.rooms, -1)
+			budget--
+		}
+	}
+
+	// then scale up queues that are filling up, leaving some room for everyone else
+	reserve := cfg.GetDSInt(1, "spawnScaleReserve")
+	for _, q := range queues {
+		if budget <= reserve {
+			log.Printf("Queue autoscaling paused, lobby budget %d is at reserve %d", budget, reserve)
+			break
+		}
+		if len(q.rooms) == 0 || len(q.rooms) >= q.maxRooms || !q.filled() {
+			continue
+		}
+		log.Printf("Queue %q rooms are filled past %v, scaling up to %d rooms...", q.name, q.threshold, len(q.rooms)+1)
+		if spawnQueueRoom(q.name) {
+			q.rooms = append(q.rooms, -1)
+			budget--
+		}
+	}
+}
+
+func collectQueueSpawnStates(lr []lobby.LobbyRoom) []*queueSpawnState {
+	queuesK, ok := cfg.GetKeys("queues")
+	if !ok {
+		return nil
+	}
+	fill := map[int]float64{}
+	for _, r := range lr {
+		if r.MaxPlayers == 0 {
+			continue
+		}
+		fill[int(r.GameID)] = float64(r.CurrentPlayers) / float64(r.MaxPlayers)
+	}
+	now := time.Now()
+	queues := []*queueSpawnState{}
 	for _, queueName := range queuesK {
 		if cfg.GetDSBool(false, "queues", queueName, "disabled") {
 			continue
 		}
-		li := isQueueInLobby(queueName)
-		if li != 0 {
-			log.Printf("Queue %q in lobby with instance id %v", queueName, li)
+		active, err := queueScheduleActive(queueName, now)
+		if err != nil {
+			log.Printf("Queue %q has invalid schedule: %s", queueName, err.Error())
 			continue
 		}
-		log.Printf("Queue %q is missing from lobby, spawning new one...", queueName)
-		gi, err := generateInstance(cfg.DupSubTree("queues", queueName))
-		if err != nil {
-			log.Printf("Failed to generate instance: %s", err.Error())
-			giid := int64(-1)
-			if gi != nil {
-				giid = gi.Id
-				releaseInstance(gi)
-			}
-			discordPostError("%s Lobby queue failed to generate instance %d: %s", time.Now(), giid, err.Error())
+		if !active {
+			continue
+		}
+		q := &queueSpawnState{
+			name:      queueName,
+			priority:  cfg.GetDSInt(0, "queues", queueName, "priority"),
+			minRooms:  cfg.GetDSInt(1, "queues", queueName, "minLobbyRooms"),
+			maxRooms:  cfg.GetDSInt(1, "queues", queueName, "maxLobbyRooms"),
+			threshold: float64(cfg.GetDSInt(75, "queues", queueName, "scaleUpThresholdPercent")) / 100,
+			rooms:     []float64{},
+		}
+		if q.maxRooms < q.minRooms {
+			q.maxRooms = q.minRooms
+		}
+		queues = append(queues, q)
+	}
+	instancesLock.Lock()
+	for _, inst := range instances {
+		if inst.state.Load() > int64(instanceStateInLobby) {
 			continue
 		}
-		gi.QueueName = queueName
-		// log.Printf("Generated instance: %s", spew.Sdump(gi))
-		go spawnRunner(gi)
+		for _, q := range queues {
+			if q.name != inst.QueueName {
+				continue
+			}
+			f, ok := fill[inst.LobbyId]
+			if !ok || inst.LobbyId == 0 {
+				f = -1
+			}
+			q.rooms = append(q.rooms, f)
+		}
+	}
+	instancesLock.Unlock()
+	sort.SliceStable(queues, func(i, j int) bool {
+		if queues[i].priority != queues[j].priority {
+			return queues[i].priority > queues[j].priority
+		}
+		return queues[i].name < queues[j].name
+	})
+	return queues
+}
+
+func spawnQueueRoom(queueName string) bool {
+	gi, err := generateInstance(cfg.DupSubTree("queues", queueName), queueName)
+	if err != nil {
+		log.Printf("Failed to generate instance: %s", err.Error())
+		giid := int64(-1)
+		if gi != nil {
+			giid = gi.Id
+			releaseInstance(gi)
+		}
+		notifyErrorf("%s Lobby queue failed to generate instance %d: %s", time.Now(), giid, err.Error())
+		return false
 	}
+	// log.Printf("Generated instance: %s", spew.Sdump(gi))
+	go spawnRunner(gi)
+	return true
 }
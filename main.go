@@ -11,10 +11,33 @@ import (
 	"github.com/natefinch/lumberjack"
 )
 
+var subcommands = map[string]func(args []string){
+	"migrate": func(args []string) {
+		loadConfig()
+		connectToDatabase()
+		commandMigrate(args)
+	},
+	"sandbox-exec": commandSandboxExec,
+	"validate":     commandValidate,
+	"preview": func(args []string) {
+		loadConfig()
+		commandPreview(args)
+	},
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		cmd, ok := subcommands[os.Args[1]]
+		if !ok {
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+		cmd(os.Args[2:])
+		return
+	}
 	log.Println("Hello world")
 	loadConfig()
 	connectToDatabase()
+	migrateOnStartup()
 
 	log.SetOutput(io.MultiWriter(os.Stdout, &lumberjack.Logger{
 		Filename: cfg.GetDSString("logs/backend.log", "logs", "filename"),
@@ -22,26 +45,57 @@ func main() {
 		Compress: true,
 	}))
 
-	go routineDiscordErrorReporter()
+	closeNotifier := startBackgroundRoutine("notifier", routineNotifier)
+	closeAnnouncer := startBackgroundRoutine("announcer", routineAnnouncer)
+
+	binaryRegistryStartup()
 
 	recoverInstances()
 
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 
 	closeWebServer := startBackgroundRoutine("web server", routineWebServer)
 	closeLobbyKeepalive := startBackgroundRoutine("lobby keepalive", routineLobbyKeepalive)
 	closeInstanceCleaner := startBackgroundRoutine("instance cleaner", routineInstanceCleaner)
+	closeDrainer := startBackgroundRoutine("drainer", routineDrainer)
+	closeMapPrefetcher := startBackgroundRoutine("map prefetcher", routineMapPrefetcher)
+	closeJoinDecisionsPruner := startBackgroundRoutine("join decisions pruner", routineJoinDecisionsPruner)
+	mapPrefetchRequest()
 
 	log.Println("Autohoster backend started")
-	<-signals
+	detach := false
+waitloop:
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGUSR1 {
+				drainToggle()
+				continue
+			}
+			fmt.Println()
+			log.Println("Got signal, shutting down...")
+			break waitloop
+		case detach = <-drainExit:
+			log.Println("Drain complete, shutting down...")
+			break waitloop
+		}
+	}
 	signal.Reset()
-	fmt.Println()
-	log.Println("Got signal, shutting down...")
 	disallowInstanceCreation.Store(true)
-	stopAllRunners()
+	closeDrainer()
+	closeMapPrefetcher()
+	closeJoinDecisionsPruner()
+	stopAllRunners(detach)
 	closeInstanceCleaner()
 	closeLobbyKeepalive()
 	closeWebServer()
+	closeAnnouncer()
+	closeNotifier()
+	if detach {
+		drainReexec()
+		log.Println("Handoff failed, exiting with games left running")
+		os.Exit(1)
+	}
 	log.Println("Shutdown complete, bye!")
 }
@@ -20,43 +20,31 @@ var (
 	errNoFreePort         = errors.New("no free ports")
 )
 
-func allocateNewInstance() (inst *instance, err error) {
+func allocateNewInstance(queueName string) (inst *instance, err error) {
 	instancesLock.Lock()
 	defer instancesLock.Unlock()
 	if disallowInstanceCreation.Load() {
 		return nil, errCreationDisallowed
 	}
-
-	ps, ok := cfg.GetString("ports")
-	if !ok {
-		return nil, errNoPortsDeclared
-	}
-	allowed := removeDuplicate(parseNumbersString(ps))
-	selected := 0
-	for _, p := range allowed {
-		used := false
-		for _, i := range instances {
-			if i.Settings.GamePort == p {
-				used = true
-				break
-			}
-		}
-		if !used {
-			selected = p
-			break
-		}
+	if draining.Load() {
+		return nil, errDraining
 	}
-	if selected == 0 {
-		return nil, errNoFreePort
+
+	selected, err := ports.pickNOLOCK(queueName)
+	if err != nil {
+		return nil, err
 	}
 
 	inst = &instance{
-		Id: newInstanceID(),
+		Id:        newInstanceID(),
+		QueueName: queueName,
 		Settings: instanceSettings{
 			GamePort: selected,
 		},
 		commands:       make(chan instanceCommand, 32),
 		OnJoinDispatch: map[string]joinDispatch{},
+		lobbyRoster:    map[int]lobbyPlayer{},
+		lobbyNames:     map[string]string{},
 		wg:             sync.WaitGroup{},
 	}
 
@@ -112,6 +100,7 @@ func cleanInstances() {
 	instances = slices.DeleteFunc(instances, func(i *instance) bool {
 		if i.state.Load() == int64(instanceStateExited) {
 			log.Printf("Cleaned up instance %d", i.Id)
+			ports.markReleased(i.Settings.GamePort)
 			return true
 		}
 		return false
@@ -119,12 +108,13 @@ func cleanInstances() {
 	instancesLock.Unlock()
 }
 
-func stopAllRunners() {
+// stopAllRunners stops runners, detach leaves game processes running regardless of shutdownHostsOnExit
+func stopAllRunners(detach bool) {
 	instancesLock.Lock()
 	defer instancesLock.Unlock()
 	log.Printf("Ordering %d runners to quit processing", len(instances))
 	for _, v := range instances {
-		if cfg.GetDSBool(false, "shutdownHostsOnExit") {
+		if !detach && cfg.GetDSBool(false, "shutdownHostsOnExit") {
 			v.commands <- instanceCommand{command: icShutdown}
 		} else {
 			v.commands <- instanceCommand{command: icRunnerStop}
@@ -136,38 +126,31 @@ func stopAllRunners() {
 	}
 }
 
-func isQueueInLobby(queueName string) int64 {
+func isInstanceInLobby(instanceID int64) bool {
 	instancesLock.Lock()
 	defer instancesLock.Unlock()
-	return isQueueInLobbyNOLOCK(queueName)
+	return isInstanceInLobbyNOLOCK(instanceID)
 }
 
-func isQueueInLobbyNOLOCK(queueName string) int64 {
+func isInstanceInLobbyNOLOCK(instanceID int64) bool {
 	for i := range instances {
-		if instances[i].QueueName != queueName {
+		if instances[i].Id != instanceID {
 			continue
 		}
 		if instances[i].state.Load() <= int64(instanceStateInLobby) {
-			return instances[i].Id
+			return true
 		}
 	}
-	return 0
+	return false
 }
 
-func isInstanceInLobby(instanceID int64) bool {
+func findInstance(instanceID int64) *instance {
 	instancesLock.Lock()
 	defer instancesLock.Unlock()
-	return isInstanceInLobbyNOLOCK(instanceID)
-}
-
-func isInstanceInLobbyNOLOCK(instanceID int64) bool {
 	for i := range instances {
-		if instances[i].Id != instanceID {
-			continue
-		}
-		if instances[i].state.Load() <= int64(instanceStateInLobby) {
-			return true
+		if instances[i].Id == instanceID {
+			return instances[i]
 		}
 	}
-	return false
+	return nil
 }
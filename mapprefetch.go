@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// map prefetcher downloads every map referenced by queues so generation
+// does not wait for network, runs at startup and after config reload
+
+var mapPrefetchTrigger = make(chan struct{}, 1)
+
+func mapPrefetchRequest() {
+	select {
+	case mapPrefetchTrigger <- struct{}{}:
+	default:
+	}
+}
+
+func mapPrefetchHashes() []string {
+	hashes := map[string]bool{}
+	queues, _ := cfg.GetKeys("queues")
+	for _, queueName := range queues {
+		mapnames, _ := cfg.GetKeys("queues", queueName, "maps")
+		for _, mapName := range mapnames {
+			h, ok := cfg.GetString("queues", queueName, "maps", mapName, "hash")
+			if ok && h != "" {
+				hashes[h] = true
+			}
+		}
+	}
+	ret := make([]string, 0, len(hashes))
+	for h := range hashes {
+		ret = append(ret, h)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func mapPrefetch(closechan <-chan struct{}) {
+	err := ms.ReloadBackends()
+	if err != nil {
+		log.Printf("Map prefetch: failed to load map storage backends: %s", err.Error())
+		notifyErrorf("Map storage backends are misconfigured: %s", err.Error())
+		return
+	}
+	hashes := mapPrefetchHashes()
+	ms.SetPinned(hashes)
+	log.Printf("Map prefetch: ensuring %d maps are stored", len(hashes))
+	failed := 0
+	for _, h := range hashes {
+		select {
+		case <-closechan:
+			return
+		default:
+		}
+		_, err := ms.GetMapInfo(h)
+		if err != nil {
+			failed++
+			log.Printf("Map prefetch: failed to get map %s: %s", h, err.Error())
+		}
+	}
+	log.Printf("Map prefetch: done, %d of %d maps failed", failed, len(hashes))
+	if failed > 0 {
+		notifyErrorf("Map prefetch failed to get %d of %d maps, see log", failed, len(hashes))
+	}
+}
+
+func routineMapPrefetcher(closechan <-chan struct{}) {
+	for {
+		select {
+		case <-closechan:
+			return
+		case <-mapPrefetchTrigger:
+			mapPrefetch(closechan)
+		}
+	}
+}
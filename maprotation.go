@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maxsupermanhd/lac/v2"
+)
+
+// map rotation of a queue is controlled by map weights and queue's "mapRotation":
+//
+//	"maps": {
+//		"Sk-Rush": {"hash": "...", "weight": 2},
+//		"Sk-Startup": {"hash": "...", "weight": 0.5}
+//	},
+//	"mapRotation": {
+//		"noRepeatWithin": 3,      // skip maps of last 3 games of the queue
+//		"mode": "leastPlayed",    // "random" (default) or "leastPlayed"
+//		"leastPlayedDays": 7      // history window for leastPlayed
+//	}
+//
+// weight defaults to 1, weight 0 takes map out of rotation. leastPlayed divides
+// weight by 1 + number of games played on the map (games.map_hash) in the window.
+// History needs the database, without it rotation falls back to plain weights.
+
+type mapCandidate struct {
+	name   string
+	hash   string
+	weight float64
+	played int
+}
+
+func mapRotationWeight(c lac.Conf, mapName string) (float64, error) {
+	v, ok := c.Get("maps", mapName, "weight")
+	if !ok {
+		return 1, nil
+	}
+	switch w := v.(type) {
+	case float64:
+		if w < 0 {
+			return 0, fmt.Errorf("map %q has negative weight", mapName)
+		}
+		return w, nil
+	case int:
+		if w < 0 {
+			return 0, fmt.Errorf("map %q has negative weight", mapName)
+		}
+		return float64(w), nil
+	}
+	return 0, fmt.Errorf("map %q weight is not a number", mapName)
+}
+
+// mapRotationRecent returns map hashes of last n games of the queue, newest first
+func mapRotationRecent(queueName string, n int) ([]string, error) {
+	if dbpool == nil {
+		return nil, errors.New("no database")
+	}
+	rows, err := dbpool.Query(context.Background(), `select g.map_hash from games as g
+join instances as i on i.id = g.instance
+where i.queue = $1 and g.map_hash is not null
+order by g.time_started desc limit $2`, queueName, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []string{}
+	for rows.Next() {
+		var h string
+		err = rows.Scan(&h)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, h)
+	}
+	return ret, rows.Err()
+}
+
+// mapRotationPlayCounts counts games played on given map hashes since time
+func mapRotationPlayCounts(hashes []string, since time.Time) (map[string]int, error) {
+	if dbpool == nil {
+		return nil, errors.New("no database")
+	}
+	rows, err := dbpool.Query(context.Background(), `select map_hash, count(*) from games
+where map_hash = any($1) and time_started > $2 group by map_hash`, hashes, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := map[string]int{}
+	for rows.Next() {
+		var h string
+		var c int
+		err = rows.Scan(&h, &c)
+		if err != nil {
+			return nil, err
+		}
+		ret[h] = c
+	}
+	return ret, rows.Err()
+}
+
+// mapRotationPick selects map for the instance, returns map name, hash and human readable reason
+func mapRotationPick(inst *instance, mapnames []string) (string, string, string, error) {
+	layers := []lac.Conf{inst.cfg, cfg.LinkSubTree("settingsFallback")}
+	noRepeat := tryCfgGetD(tryGetIntGen("mapRotation", "noRepeatWithin"), 0, layers...)
+	mode := tryCfgGetD(tryGetStringGen("mapRotation", "mode"), "random", layers...)
+	days := tryCfgGetD(tryGetIntGen("mapRotation", "leastPlayedDays"), 7, layers...)
+
+	sort.Strings(mapnames)
+	cands := []mapCandidate{}
+	hashes := []string{}
+	for _, name := range mapnames {
+		hash, ok := inst.cfg.GetString("maps", name, "hash")
+		if !ok {
+			return "", "", "", fmt.Errorf("map %q hash not defined", name)
+		}
+		w, err := mapRotationWeight(inst.cfg, name)
+		if err != nil {
+			return "", "", "", err
+		}
+		if w == 0 {
+			continue
+		}
+		cands = append(cands, mapCandidate{name: name, hash: hash, weight: w})
+		hashes = append(hashes, hash)
+	}
+	if len(cands) == 0 {
+		return "", "", "", errors.New("all maps have zero weight")
+	}
+	reasons := []string{}
+
+	if noRepeat > 0 {
+		recent, err := mapRotationRecent(inst.QueueName, noRepeat)
+		if err != nil {
+			inst.logger.Printf("Failed to get recent maps of the queue: %s", err.Error())
+			reasons = append(reasons, "recent games unknown ("+err.Error()+")")
+		} else {
+			left := slices.DeleteFunc(slices.Clone(cands), func(c mapCandidate) bool {
+				return slices.Contains(recent, c.hash)
+			})
+			if len(left) == 0 {
+				reasons = append(reasons, fmt.Sprintf("every map was played within last %d games, repeat allowed", noRepeat))
+			} else {
+				if skipped := len(cands) - len(left); skipped > 0 {
+					reasons = append(reasons, fmt.Sprintf("skipped %d maps played within last %d games", skipped, noRepeat))
+				}
+				cands = left
+			}
+		}
+	}
+
+	switch mode {
+	case "random":
+	case "leastPlayed":
+		counts, err := mapRotationPlayCounts(hashes, time.Now().Add(-time.Duration(days)*24*time.Hour))
+		if err != nil {
+			inst.logger.Printf("Failed to count map plays: %s", err.Error())
+			reasons = append(reasons, "play counts unknown ("+err.Error()+")")
+			break
+		}
+		for i := range cands {
+			cands[i].played = counts[cands[i].hash]
+			cands[i].weight /= float64(1 + cands[i].played)
+		}
+	default:
+		return "", "", "", fmt.Errorf("unknown map rotation mode %q", mode)
+	}
+
+	total := 0.0
+	for _, c := range cands {
+		total += c.weight
+	}
+	r := rand.Float64() * total
+	picked := cands[len(cands)-1]
+	for _, c := range cands {
+		if r < c.weight {
+			picked = c
+			break
+		}
+		r -= c.weight
+	}
+	if mode == "leastPlayed" {
+		reasons = append(reasons, fmt.Sprintf("played %d times in last %d days", picked.played, days))
+	}
+	reason := fmt.Sprintf("%s pick from %d maps with chance %.0f%%", mode, len(cands), picked.weight/total*100)
+	if len(reasons) > 0 {
+		reason += ", " + strings.Join(reasons, ", ")
+	}
+	return picked.name, picked.hash, reason, nil
+}
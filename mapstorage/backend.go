@@ -0,0 +1,250 @@
+package mapstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mapsdatabase "github.com/maxsupermanhd/go-wz/maps-database"
+)
+
+// backends are tried in order until one returns the map, configured as
+//
+//	"backends": [
+//		{"type": "dir", "path": "/mnt/maps"},
+//		{"type": "http", "urls": ["https://mirror1/maps/%s.wz", "https://mirror2/%s.wz"], "timeoutSeconds": 30},
+//		{"type": "s3", "endpoint": "http://127.0.0.1:9000", "bucket": "maps", "prefix": "wz/",
+//			"region": "us-east-1", "accessKey": "...", "secretKey": "...", "timeoutSeconds": 30},
+//		{"type": "mapsdatabase"}
+//	]
+//
+// without backends set only public maps database is used
+
+type Backend interface {
+	Name() string
+	Fetch(ctx context.Context, hash string) ([]byte, error)
+}
+
+var ErrNotFound = errors.New("map not found")
+
+// maps are at most few megabytes, anything bigger is not worth downloading
+const maxMapSize = 64 << 20
+
+func readLimited(r io.Reader) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxMapSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxMapSize {
+		return nil, errors.New("map is too big")
+	}
+	return b, nil
+}
+
+type dirBackend struct {
+	root string
+}
+
+func (b *dirBackend) Name() string {
+	return "dir " + b.root
+}
+
+func (b *dirBackend) Fetch(_ context.Context, hash string) ([]byte, error) {
+	f, err := os.Open(path.Join(b.root, hash+".wz"))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readLimited(f)
+}
+
+type httpBackend struct {
+	urls []string
+	hcl  *http.Client
+	// mirror that answered last, tried first next time
+	preferred atomic.Int64
+}
+
+func (b *httpBackend) Name() string {
+	return "http " + strings.Join(b.urls, ", ")
+}
+
+func httpGetMap(ctx context.Context, hcl *http.Client, req *http.Request) ([]byte, error) {
+	rsp, err := hcl.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", rsp.Status)
+	}
+	return readLimited(rsp.Body)
+}
+
+func (b *httpBackend) Fetch(ctx context.Context, hash string) ([]byte, error) {
+	first := int(b.preferred.Load())
+	errs := []error{}
+	notFound := 0
+	for i := range b.urls {
+		n := (first + i) % len(b.urls)
+		u := b.urls[n]
+		if strings.Contains(u, "%s") {
+			u = fmt.Sprintf(u, hash)
+		} else {
+			u = strings.TrimSuffix(u, "/") + "/" + hash + ".wz"
+		}
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		ret, err := httpGetMap(ctx, b.hcl, req)
+		if err == nil {
+			b.preferred.Store(int64(n))
+			return ret, nil
+		}
+		if errors.Is(err, ErrNotFound) {
+			notFound++
+		}
+		// not wrapped, a miss on one mirror does not make the whole fetch a miss
+		errs = append(errs, fmt.Errorf("%s: %v", u, err))
+	}
+	if notFound == len(b.urls) {
+		return nil, ErrNotFound
+	}
+	return nil, errors.Join(errs...)
+}
+
+type mapsdatabaseBackend struct{}
+
+func (mapsdatabaseBackend) Name() string {
+	return "mapsdatabase"
+}
+
+func (mapsdatabaseBackend) Fetch(_ context.Context, hash string) ([]byte, error) {
+	return mapsdatabase.FetchMapBlob(hash)
+}
+
+func cfgString(m map[string]any, k string, required bool) (string, error) {
+	v, ok := m[k]
+	if !ok {
+		if required {
+			return "", fmt.Errorf("%s not set", k)
+		}
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s is not a string", k)
+	}
+	if required && s == "" {
+		return "", fmt.Errorf("%s is empty", k)
+	}
+	return s, nil
+}
+
+func cfgTimeout(m map[string]any) (time.Duration, error) {
+	v, ok := m["timeoutSeconds"]
+	if !ok {
+		return 30 * time.Second, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f <= 0 {
+		return 0, errors.New("timeoutSeconds is not a positive number")
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+func parseBackend(m map[string]any) (Backend, error) {
+	t, err := cfgString(m, "type", true)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := cfgTimeout(m)
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case "dir":
+		p, err := cfgString(m, "path", true)
+		if err != nil {
+			return nil, err
+		}
+		return &dirBackend{root: p}, nil
+	case "http":
+		ua, ok := m["urls"].([]any)
+		if !ok || len(ua) == 0 {
+			return nil, errors.New("urls must be a non-empty array")
+		}
+		b := &httpBackend{hcl: &http.Client{Timeout: timeout}}
+		for _, u := range ua {
+			us, ok := u.(string)
+			if !ok || us == "" {
+				return nil, errors.New("urls must be non-empty strings")
+			}
+			b.urls = append(b.urls, us)
+		}
+		return b, nil
+	case "s3":
+		b := &s3Backend{hcl: &http.Client{Timeout: timeout}}
+		for k, p := range map[string]*string{"endpoint": &b.endpoint, "bucket": &b.bucket, "accessKey": &b.accessKey, "secretKey": &b.secretKey} {
+			*p, err = cfgString(m, k, true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for k, p := range map[string]*string{"region": &b.region, "prefix": &b.prefix, "sessionToken": &b.sessionToken} {
+			*p, err = cfgString(m, k, false)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if b.region == "" {
+			b.region = "us-east-1"
+		}
+		b.endpoint = strings.TrimSuffix(b.endpoint, "/")
+		return b, nil
+	case "mapsdatabase":
+		return mapsdatabaseBackend{}, nil
+	}
+	return nil, fmt.Errorf("unknown backend type %q", t)
+}
+
+// ParseBackends builds backends from "backends" config value, nil means default
+func ParseBackends(v any) ([]Backend, error) {
+	if v == nil {
+		return []Backend{mapsdatabaseBackend{}}, nil
+	}
+	a, ok := v.([]any)
+	if !ok {
+		return nil, errors.New("backends must be an array")
+	}
+	ret := []Backend{}
+	for i, bv := range a {
+		m, ok := bv.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("backend %d is not an object", i)
+		}
+		b, err := parseBackend(m)
+		if err != nil {
+			return nil, fmt.Errorf("backend %d: %w", i, err)
+		}
+		ret = append(ret, b)
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("backends list is empty")
+	}
+	return ret, nil
+}
@@ -0,0 +1,130 @@
+package mapstorage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+type testMirror struct {
+	*httptest.Server
+	status   atomic.Int32
+	requests atomic.Int32
+	lastPath atomic.Value
+}
+
+func newTestMirror(t *testing.T, status int) *testMirror {
+	m := &testMirror{}
+	m.status.Store(int32(status))
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.requests.Add(1)
+		m.lastPath.Store(r.URL.Path)
+		s := int(m.status.Load())
+		w.WriteHeader(s)
+		if s == http.StatusOK {
+			w.Write([]byte("blob"))
+		}
+	}))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func testHTTPBackend(t *testing.T, urls ...string) *httpBackend {
+	t.Helper()
+	ua := []any{}
+	for _, u := range urls {
+		ua = append(ua, u)
+	}
+	b, err := parseBackend(map[string]any{"type": "http", "urls": ua})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*httpBackend)
+}
+
+func TestHTTPBackendURLs(t *testing.T) {
+	m1 := newTestMirror(t, http.StatusOK)
+	m2 := newTestMirror(t, http.StatusOK)
+	b := testHTTPBackend(t, m1.URL+"/maps/%s/blob.wz")
+	_, err := b.Fetch(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := m1.lastPath.Load(); p != "/maps/abc/blob.wz" {
+		t.Errorf("format url requested %v", p)
+	}
+	b = testHTTPBackend(t, m2.URL+"/maps/")
+	_, err = b.Fetch(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := m2.lastPath.Load(); p != "/maps/abc.wz" {
+		t.Errorf("base url requested %v", p)
+	}
+}
+
+func TestHTTPBackendFailover(t *testing.T) {
+	m1 := newTestMirror(t, http.StatusInternalServerError)
+	m2 := newTestMirror(t, http.StatusOK)
+	b := testHTTPBackend(t, m1.URL, m2.URL)
+
+	got, err := b.Fetch(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "blob" {
+		t.Errorf("got %q", got)
+	}
+	if m1.requests.Load() != 1 || m2.requests.Load() != 1 {
+		t.Errorf("requests %d and %d, want both mirrors asked once", m1.requests.Load(), m2.requests.Load())
+	}
+	if b.preferred.Load() != 1 {
+		t.Errorf("preferred mirror is %d after second answered", b.preferred.Load())
+	}
+
+	// mirror that answered last is asked first
+	_, err = b.Fetch(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m1.requests.Load() != 1 || m2.requests.Load() != 2 {
+		t.Errorf("requests %d and %d, want only preferred mirror asked", m1.requests.Load(), m2.requests.Load())
+	}
+
+	// preferred mirror breaks, rotation wraps around to first one
+	m1.status.Store(http.StatusOK)
+	m2.status.Store(http.StatusBadGateway)
+	_, err = b.Fetch(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m1.requests.Load() != 2 || m2.requests.Load() != 3 {
+		t.Errorf("requests %d and %d, want preferred then next mirror asked", m1.requests.Load(), m2.requests.Load())
+	}
+	if b.preferred.Load() != 0 {
+		t.Errorf("preferred mirror is %d after first answered", b.preferred.Load())
+	}
+}
+
+func TestHTTPBackendErrors(t *testing.T) {
+	m1 := newTestMirror(t, http.StatusNotFound)
+	m2 := newTestMirror(t, http.StatusNotFound)
+	b := testHTTPBackend(t, m1.URL, m2.URL)
+	_, err := b.Fetch(context.Background(), "abc")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("all mirrors 404 returned %v, want ErrNotFound", err)
+	}
+
+	// one mirror failing is not a proof that map does not exist
+	m2.status.Store(http.StatusServiceUnavailable)
+	_, err = b.Fetch(context.Background(), "abc")
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("404 and 503 returned %v, want other error", err)
+	}
+	if b.preferred.Load() != 0 {
+		t.Errorf("failed fetches changed preferred mirror to %d", b.preferred.Load())
+	}
+}
@@ -1,23 +1,67 @@
 package mapstorage
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/fs"
+	"log"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
-	mapsdatabase "github.com/maxsupermanhd/go-wz/maps-database"
 	"github.com/maxsupermanhd/lac/v2"
 )
 
+// Mapstorage is a local cache of map blobs in root directory, misses are
+// fetched from configured backends. With maxSizeMB set least recently used
+// maps are evicted once cache grows over the limit, pinned maps are kept.
+// Last use is kept in blob mtime so it survives restarts.
+
 type Mapstorage struct {
-	fslock sync.Mutex
-	cfg    lac.Conf
+	cfg lac.Conf
+
+	lock     sync.Mutex
+	backends []Backend
+	entries  map[string]*cacheEntry
+	pinned   map[string]bool
+	fetching map[string]*hashLock
+}
+
+type hashLock struct {
+	sync.Mutex
+	refs int
+}
+
+type cacheEntry struct {
+	size    int64
+	lastUse time.Time
 }
 
+var ErrHashMismatch = errors.New("map blob hash mismatch")
+
 func NewMapstorage(cfg lac.Conf) (*Mapstorage, error) {
-	m := &Mapstorage{cfg: cfg}
-	return m, os.MkdirAll(m.getRoot(), fs.FileMode(m.cfg.GetDInt(766, "dirPerms")))
+	m := &Mapstorage{
+		cfg:      cfg,
+		entries:  map[string]*cacheEntry{},
+		pinned:   map[string]bool{},
+		fetching: map[string]*hashLock{},
+	}
+	err := os.MkdirAll(m.getRoot(), fs.FileMode(m.cfg.GetDInt(766, "dirPerms")))
+	if err != nil {
+		return m, err
+	}
+	err = m.ReloadBackends()
+	if err != nil {
+		return m, err
+	}
+	return m, m.scan()
 }
 
 func (m *Mapstorage) getRoot() string {
@@ -28,23 +72,261 @@ func (m *Mapstorage) getMapPath(hash string) string {
 	return path.Join(m.getRoot(), hash+".wz")
 }
 
+func (m *Mapstorage) getInfoPath(hash string) string {
+	return path.Join(m.getRoot(), hash+".json")
+}
+
+func (m *Mapstorage) maxSize() int64 {
+	return int64(m.cfg.GetDSInt(0, "maxSizeMB")) * 1024 * 1024
+}
+
+// ReloadBackends rebuilds backend list from config
+func (m *Mapstorage) ReloadBackends() error {
+	v, _ := m.cfg.Get("backends")
+	b, err := ParseBackends(v)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	m.backends = b
+	m.lock.Unlock()
+	return nil
+}
+
+func (m *Mapstorage) scan() error {
+	des, err := os.ReadDir(m.getRoot())
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, de := range des {
+		hash, ok := strings.CutSuffix(de.Name(), ".wz")
+		if !ok || de.IsDir() {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		m.entries[hash] = &cacheEntry{size: fi.Size(), lastUse: fi.ModTime()}
+	}
+	return nil
+}
+
+// SetPinned replaces set of maps that are never evicted
+func (m *Mapstorage) SetPinned(hashes []string) {
+	p := map[string]bool{}
+	for _, h := range hashes {
+		p[strings.ToLower(h)] = true
+	}
+	m.lock.Lock()
+	m.pinned = p
+	m.lock.Unlock()
+}
+
+// lockHash serializes work on one hash so concurrent requests fetch it once
+func (m *Mapstorage) lockHash(hash string) func() {
+	m.lock.Lock()
+	l, ok := m.fetching[hash]
+	if !ok {
+		l = &hashLock{}
+		m.fetching[hash] = l
+	}
+	l.refs++
+	m.lock.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.lock.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.fetching, hash)
+		}
+		m.lock.Unlock()
+	}
+}
+
+func (m *Mapstorage) touch(hash string, size int64) {
+	now := time.Now()
+	m.lock.Lock()
+	m.entries[hash] = &cacheEntry{size: size, lastUse: now}
+	m.lock.Unlock()
+	os.Chtimes(m.getMapPath(hash), now, now)
+}
+
+// evict removes least recently used unpinned maps until cache fits the limit
+func (m *Mapstorage) evict() {
+	limit := m.maxSize()
+	if limit <= 0 {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	total := int64(0)
+	hashes := []string{}
+	for h, e := range m.entries {
+		total += e.size
+		if !m.pinned[h] {
+			hashes = append(hashes, h)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return m.entries[hashes[i]].lastUse.Before(m.entries[hashes[j]].lastUse)
+	})
+	for _, h := range hashes {
+		if total <= limit {
+			return
+		}
+		if _, busy := m.fetching[h]; busy {
+			continue
+		}
+		err := os.Remove(m.getMapPath(h))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Map storage failed to evict %s: %s", h, err.Error())
+			continue
+		}
+		os.Remove(m.getInfoPath(h))
+		total -= m.entries[h].size
+		delete(m.entries, h)
+	}
+	if total > limit {
+		log.Printf("Map storage is over the limit (%d of %d bytes) with pinned maps only", total, limit)
+	}
+}
+
+func verifyHash(hash string, blob []byte) error {
+	h := sha256.Sum256(blob)
+	got := hex.EncodeToString(h[:])
+	if !strings.EqualFold(got, hash) {
+		return fmt.Errorf("%w: requested %s, got %s", ErrHashMismatch, hash, got)
+	}
+	return nil
+}
+
+func (m *Mapstorage) fetch(hash string) ([]byte, error) {
+	m.lock.Lock()
+	backends := m.backends
+	m.lock.Unlock()
+	errs := []error{}
+	for _, b := range backends {
+		ret, err := b.Fetch(context.Background(), hash)
+		if err == nil {
+			err = verifyHash(hash, ret)
+		}
+		if err == nil {
+			return ret, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("Map storage backend %s failed to fetch %s: %s", b.Name(), hash, err.Error())
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// GetMap returns map blob by its sha256, downloading it from backends if needed
 func (m *Mapstorage) GetMap(hash string) ([]byte, error) {
+	hash = strings.ToLower(hash)
+	unlock := m.lockHash(hash)
+	ret, err := m.getMapLocked(hash)
+	unlock()
+	if err == nil {
+		m.evict()
+	}
+	return ret, err
+}
+
+func (m *Mapstorage) getMapLocked(hash string) ([]byte, error) {
 	p := m.getMapPath(hash)
-	m.fslock.Lock()
 	ret, err := os.ReadFile(p)
-	m.fslock.Unlock()
 	if err == nil {
-		return ret, nil
+		if verifyHash(hash, ret) == nil {
+			m.touch(hash, int64(len(ret)))
+			return ret, nil
+		}
+		// corrupted or replaced, fetch again
+	} else if !os.IsNotExist(err) {
+		return nil, err
 	}
-	if !os.IsNotExist(err) {
+	ret, err = m.fetch(hash)
+	if err != nil {
 		return nil, err
 	}
-	ret, err = mapsdatabase.FetchMapBlob(hash)
+	info, err := ParseMapInfo(ret)
+	if err != nil {
+		return nil, fmt.Errorf("parsing map %s: %w", hash, err)
+	}
+	info.Hash = hash
+	err = m.writeInfo(info)
 	if err != nil {
 		return nil, err
 	}
-	m.fslock.Lock()
 	err = os.WriteFile(p, ret, fs.FileMode(m.cfg.GetDInt(644, "filePerms")))
-	m.fslock.Unlock()
-	return ret, err
+	if err != nil {
+		return nil, err
+	}
+	m.touch(hash, int64(len(ret)))
+	return ret, nil
+}
+
+func (m *Mapstorage) writeInfo(info *MapInfo) error {
+	infob, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.getInfoPath(info.Hash), infob, fs.FileMode(m.cfg.GetDInt(644, "filePerms")))
+}
+
+func (m *Mapstorage) readInfo(hash string) (*MapInfo, error) {
+	b, err := os.ReadFile(m.getInfoPath(hash))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info MapInfo
+	err = json.Unmarshal(b, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// LookupMapInfo returns stored metadata without fetching anything, nil if map is not stored
+func (m *Mapstorage) LookupMapInfo(hash string) (*MapInfo, error) {
+	hash = strings.ToLower(hash)
+	unlock := m.lockHash(hash)
+	defer unlock()
+	return m.readInfo(hash)
+}
+
+// GetMapInfo returns map metadata, fetching and parsing the map if needed
+func (m *Mapstorage) GetMapInfo(hash string) (*MapInfo, error) {
+	hash = strings.ToLower(hash)
+	unlock := m.lockHash(hash)
+	info, err := m.readInfo(hash)
+	if err != nil || info != nil {
+		unlock()
+		return info, err
+	}
+	blob, err := m.getMapLocked(hash)
+	if err == nil {
+		info, err = m.readInfo(hash)
+		if err == nil && info == nil {
+			// blob was stored before metadata existed
+			info, err = ParseMapInfo(blob)
+			if err == nil {
+				info.Hash = hash
+				err = m.writeInfo(info)
+			}
+		}
+	}
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	m.evict()
+	return info, nil
 }
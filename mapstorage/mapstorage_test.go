@@ -0,0 +1,98 @@
+package mapstorage
+
+import (
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/maxsupermanhd/lac/v2"
+)
+
+func TestEvict(t *testing.T) {
+	root := t.TempDir()
+	// 5 maps of 300 KiB against 1 MiB limit, oldest first
+	hashes := []string{"aa", "bb", "cc", "dd", "ee"}
+	start := time.Now().Add(-time.Hour)
+	for i, h := range hashes {
+		p := path.Join(root, h+".wz")
+		err := os.WriteFile(p, make([]byte, 300<<10), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path.Join(root, h+".json"), []byte("{}"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mt := start.Add(time.Duration(i) * time.Minute)
+		err = os.Chtimes(p, mt, mt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := lac.FromBytesJSON([]byte(`{"root": "` + root + `", "maxSizeMB": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMapstorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.entries) != len(hashes) {
+		t.Fatalf("scan found %d maps, want %d", len(m.entries), len(hashes))
+	}
+
+	// oldest is pinned, second oldest is being fetched right now
+	m.SetPinned([]string{"AA"})
+	unlock := m.lockHash("bb")
+	m.evict()
+	unlock()
+
+	want := []string{"aa", "bb", "ee"}
+	got := []string{}
+	for h := range m.entries {
+		got = append(got, h)
+	}
+	sort.Strings(got)
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+	for _, h := range hashes {
+		_, err := os.Stat(path.Join(root, h+".wz"))
+		_, errInfo := os.Stat(path.Join(root, h+".json"))
+		kept := m.entries[h] != nil
+		if kept != (err == nil) || kept != (errInfo == nil) {
+			t.Errorf("%s: in cache %v, blob stat %v, info stat %v", h, kept, err, errInfo)
+		}
+	}
+
+	// nothing else to evict once busy map is released and fits
+	m.evict()
+	if len(m.entries) != 3 {
+		t.Errorf("second eviction left %d maps", len(m.entries))
+	}
+}
+
+func TestEvictPinnedOverLimit(t *testing.T) {
+	root := t.TempDir()
+	for _, h := range []string{"aa", "bb"} {
+		err := os.WriteFile(path.Join(root, h+".wz"), make([]byte, 600<<10), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := lac.FromBytesJSON([]byte(`{"root": "` + root + `", "maxSizeMB": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMapstorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetPinned([]string{"aa", "bb"})
+	m.evict()
+	if len(m.entries) != 2 {
+		t.Errorf("evicted pinned maps, %d left", len(m.entries))
+	}
+}
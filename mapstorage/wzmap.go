@@ -0,0 +1,201 @@
+package mapstorage
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// .wz maps are zip archives in one of two layouts:
+//
+// legacy: <name>.xplayers.lev (or .addon.lev) in the root describing levels,
+// data in game.map inside directory named after level's .gam file
+//
+// flat (4.1+): level.json with name, players and tileset, data in game.map
+//
+// game.map starts with "map " magic followed by little endian version, width and height
+
+type MapInfo struct {
+	Hash    string `json:"hash"`
+	Name    string `json:"name"`
+	Players int    `json:"players"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Tileset string `json:"tileset"`
+	Layout  string `json:"layout"`
+}
+
+var (
+	levTechSuffix  = regexp.MustCompile(`-T[1-3]$`)
+	levDatasetTile = regexp.MustCompile(`(?:CAM_|_C)([1-3])$`)
+	levTilesets    = map[string]string{"1": "arizona", "2": "urban", "3": "rockies"}
+)
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// map data files are small, anything huge is not a map
+	return io.ReadAll(io.LimitReader(r, 64<<20))
+}
+
+func parseGameMapHeader(b []byte) (int, int, error) {
+	if len(b) < 16 || string(b[:4]) != "map " {
+		return 0, 0, errors.New("game.map has no map header")
+	}
+	w := binary.LittleEndian.Uint32(b[8:12])
+	h := binary.LittleEndian.Uint32(b[12:16])
+	if w == 0 || h == 0 || w > 1024 || h > 1024 {
+		return 0, 0, fmt.Errorf("game.map has invalid dimensions %dx%d", w, h)
+	}
+	return int(w), int(h), nil
+}
+
+type levEntry struct {
+	level   string
+	players int
+	dataset string
+	game    string
+}
+
+func parseLev(b []byte) ([]levEntry, error) {
+	ret := []levEntry{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 2 {
+			continue
+		}
+		switch f[0] {
+		case "level":
+			ret = append(ret, levEntry{level: f[1]})
+		case "players":
+			if len(ret) == 0 {
+				continue
+			}
+			n, err := strconv.Atoi(f[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid players %q", f[1])
+			}
+			ret[len(ret)-1].players = n
+		case "dataset":
+			if len(ret) == 0 {
+				continue
+			}
+			ret[len(ret)-1].dataset = f[1]
+		case "game":
+			if len(ret) == 0 {
+				continue
+			}
+			ret[len(ret)-1].game = strings.Trim(f[1], `"`)
+		}
+	}
+	return ret, s.Err()
+}
+
+// levFileNames returns .lev files in archive root, .xplayers.lev first so
+// archives that also carry addon levels always resolve to the same map
+func levFileNames(files map[string]*zip.File) []string {
+	ret := []string{}
+	for n := range files {
+		if !strings.Contains(n, "/") && strings.HasSuffix(n, ".lev") {
+			ret = append(ret, n)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		xi, xj := strings.HasSuffix(ret[i], ".xplayers.lev"), strings.HasSuffix(ret[j], ".xplayers.lev")
+		if xi != xj {
+			return xi
+		}
+		return ret[i] < ret[j]
+	})
+	return ret
+}
+
+// ParseMapInfo extracts name, player count, dimensions and tileset from .wz archive
+func ParseMapInfo(blob []byte) (*MapInfo, error) {
+	z, err := zip.NewReader(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		return nil, fmt.Errorf("not a zip archive: %w", err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range z.File {
+		files[strings.TrimPrefix(path.Clean(f.Name), "/")] = f
+	}
+	info := &MapInfo{}
+	gameMapPath := ""
+	if f, ok := files["level.json"]; ok {
+		b, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var lvl struct {
+			Name    string `json:"name"`
+			Players int    `json:"players"`
+			Tileset string `json:"tileset"`
+		}
+		err = json.Unmarshal(b, &lvl)
+		if err != nil {
+			return nil, fmt.Errorf("level.json: %w", err)
+		}
+		info.Layout = "flat"
+		info.Name, info.Players, info.Tileset = lvl.Name, lvl.Players, strings.ToLower(lvl.Tileset)
+		gameMapPath = "game.map"
+	} else {
+		for _, n := range levFileNames(files) {
+			b, err := readZipFile(files[n])
+			if err != nil {
+				return nil, err
+			}
+			levs, err := parseLev(b)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", n, err)
+			}
+			if len(levs) == 0 {
+				continue
+			}
+			info.Layout = "legacy"
+			info.Name = levTechSuffix.ReplaceAllString(levs[0].level, "")
+			info.Players = levs[0].players
+			if m := levDatasetTile.FindStringSubmatch(levs[0].dataset); m != nil {
+				info.Tileset = levTilesets[m[1]]
+			}
+			gameMapPath = path.Join(strings.TrimSuffix(levs[0].game, ".gam"), "game.map")
+			break
+		}
+	}
+	if info.Layout == "" {
+		return nil, errors.New("no level.json or .lev file found")
+	}
+	if info.Name == "" {
+		return nil, errors.New("map has no name")
+	}
+	if info.Players < 1 || info.Players > 10 {
+		return nil, fmt.Errorf("map has invalid player count %d", info.Players)
+	}
+	f, ok := files[gameMapPath]
+	if !ok {
+		return nil, fmt.Errorf("no %s found", gameMapPath)
+	}
+	b, err := readZipFile(f)
+	if err != nil {
+		return nil, err
+	}
+	info.Width, info.Height, err = parseGameMapHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
@@ -0,0 +1,170 @@
+package mapstorage
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func testGameMap(w, h uint32) string {
+	b := make([]byte, 16)
+	copy(b, "map ")
+	binary.LittleEndian.PutUint32(b[4:8], 39)
+	binary.LittleEndian.PutUint32(b[8:12], w)
+	binary.LittleEndian.PutUint32(b[12:16], h)
+	return string(b)
+}
+
+// testArchive builds zip with files in given order, name/content pairs
+func testArchive(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for i := 0; i+1 < len(files); i += 2 {
+		w, err := z.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(files[i+1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := z.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const testLev = `// Made with FlaME
+campaign MULTI_CAM_1
+data "wrf/basic.wrf"
+data "wrf/cam1.wrf"
+
+level Sk-Rush-T1
+players 4
+type 14
+dataset MULTI_CAM_1
+game "multiplay/maps/4c-rush.gam"
+data "wrf/multi/skirmish4.wrf"
+data "wrf/multi/fog1.wrf"
+
+level Sk-Rush-T2
+players 4
+type 18
+dataset MULTI_T2_C1
+game "multiplay/maps/4c-rush.gam"
+`
+
+const testAddonLev = `level Sk-Other-T1
+players 2
+dataset MULTI_CAM_3
+game "multiplay/maps/2c-other.gam"
+`
+
+func TestParseMapInfo(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		files []string
+		want  MapInfo
+		err   string
+	}{
+		{
+			name:  "flat",
+			files: []string{"level.json", `{"name": "Ultimate Scavengers", "players": 10, "tileset": "Urban"}`, "game.map", testGameMap(128, 96)},
+			want:  MapInfo{Name: "Ultimate Scavengers", Players: 10, Width: 128, Height: 96, Tileset: "urban", Layout: "flat"},
+		},
+		{
+			name:  "flat with leading slash",
+			files: []string{"/level.json", `{"name": "NTW", "players": 2, "tileset": "rockies"}`, "/game.map", testGameMap(64, 64)},
+			want:  MapInfo{Name: "NTW", Players: 2, Width: 64, Height: 64, Tileset: "rockies", Layout: "flat"},
+		},
+		{
+			name:  "legacy",
+			files: []string{"4c-rush.xplayers.lev", testLev, "multiplay/maps/4c-rush/game.map", testGameMap(64, 96)},
+			want:  MapInfo{Name: "Sk-Rush", Players: 4, Width: 64, Height: 96, Tileset: "arizona", Layout: "legacy"},
+		},
+		{
+			name: "legacy prefers xplayers over addon",
+			files: []string{
+				"a.addon.lev", testAddonLev,
+				"4c-rush.xplayers.lev", testLev,
+				"multiplay/maps/2c-other/game.map", testGameMap(32, 32),
+				"multiplay/maps/4c-rush/game.map", testGameMap(64, 96),
+			},
+			want: MapInfo{Name: "Sk-Rush", Players: 4, Width: 64, Height: 96, Tileset: "arizona", Layout: "legacy"},
+		},
+		{
+			name:  "legacy ignores nested lev",
+			files: []string{"sub/x.xplayers.lev", testAddonLev, "2c-other.addon.lev", testAddonLev, "multiplay/maps/2c-other/game.map", testGameMap(32, 48)},
+			want:  MapInfo{Name: "Sk-Other", Players: 2, Width: 32, Height: 48, Tileset: "rockies", Layout: "legacy"},
+		},
+		{
+			name: "not a zip",
+			err:  "not a zip archive",
+		},
+		{
+			name:  "no level description",
+			files: []string{"game.map", testGameMap(64, 64)},
+			err:   "no level.json or .lev file found",
+		},
+		{
+			name:  "bad header magic",
+			files: []string{"level.json", `{"name": "x", "players": 2}`, "game.map", "pam " + testGameMap(64, 64)[4:]},
+			err:   "game.map has no map header",
+		},
+		{
+			name:  "truncated header",
+			files: []string{"level.json", `{"name": "x", "players": 2}`, "game.map", "map \x27\x00"},
+			err:   "game.map has no map header",
+		},
+		{
+			name:  "bad dimensions",
+			files: []string{"level.json", `{"name": "x", "players": 2}`, "game.map", testGameMap(2048, 64)},
+			err:   "game.map has invalid dimensions 2048x64",
+		},
+		{
+			name:  "too many players",
+			files: []string{"level.json", `{"name": "x", "players": 11}`, "game.map", testGameMap(64, 64)},
+			err:   "map has invalid player count 11",
+		},
+		{
+			name:  "too many players legacy",
+			files: []string{"x.xplayers.lev", strings.Replace(testLev, "players 4", "players 12", 1), "multiplay/maps/4c-rush/game.map", testGameMap(64, 96)},
+			err:   "map has invalid player count 12",
+		},
+		{
+			name:  "no name",
+			files: []string{"level.json", `{"players": 2}`, "game.map", testGameMap(64, 64)},
+			err:   "map has no name",
+		},
+		{
+			name:  "missing game.map",
+			files: []string{"4c-rush.xplayers.lev", testLev, "multiplay/maps/other/game.map", testGameMap(64, 96)},
+			err:   "no multiplay/maps/4c-rush/game.map found",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			blob := []byte("definitely not a zip")
+			if tc.files != nil {
+				blob = testArchive(t, tc.files...)
+			}
+			got, err := ParseMapInfo(blob)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tc.want {
+				t.Errorf("got %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -47,8 +49,7 @@ var (
 		mExact: "WZEVENT: startMultiplayerGame",
 		fn: func(inst *instance, msg string) bool {
 			inst.logger.Println("game starting")
-			inst.logger.Printf("atomic state swap from %d to %d", int64(instanceStateInLobby), int64(instanceStateInGame))
-			if !inst.state.CompareAndSwap(int64(instanceStateInLobby), int64(instanceStateInGame)) {
+			if !instanceSwapState(inst, instanceStateInLobby, instanceStateInGame) {
 				inst.logger.Printf("atomic swap failed!")
 			}
 			// inst.state.Store(int64(instanceStateInGame))
@@ -56,6 +57,10 @@ var (
 			if err != nil {
 				inst.logger.Printf("Failed to save instance recovery json: %s", err.Error())
 			}
+			publishInstanceEvent(inst, instanceEventGameStarted, map[string]any{
+				"map":     inst.Settings.MapName,
+				"players": inst.Settings.PlayerCount,
+			})
 			return false
 		},
 	}, {
@@ -67,13 +72,19 @@ var (
 				inst.logger.Printf("Failed to parse lobbyid message: %v", err)
 				return true
 			}
-			inst.logger.Printf("atomic state store: %d", int64(instanceStateInLobby))
-			inst.state.Store(int64(instanceStateInLobby))
+			instanceSetState(inst, instanceStateInLobby)
 			err = recoverSave(inst)
 			if err != nil {
 				inst.logger.Printf("Failed to save instance recovery json: %s", err.Error())
 			}
 			inst.logger.Printf("lobbyid %d", inst.LobbyId)
+			dbInstanceSave(inst)
+			publishInstanceEvent(inst, instanceEventLobbyAssigned, map[string]any{
+				"lobbyId": inst.LobbyId,
+				"port":    inst.Settings.GamePort,
+				"map":     inst.Settings.MapName,
+				"players": inst.Settings.PlayerCount,
+			})
 			return false
 		},
 	}, {
@@ -117,11 +128,13 @@ var (
 				inst.logger.Printf("Action approve for %q %q", msgip, msgname)
 				instWriteFmt(inst, "join approve "+msgjoinid+" 7 "+reason)
 				inst.OnJoinDispatch[msgb64pubkey] = jd
+				inst.lobbyNames[msgb64pubkey] = string(msgname)
 
 			case joinCheckActionLevelApproveSpec:
 				inst.logger.Printf("Action approvespec for %q %q", msgip, msgname)
 				instWriteFmt(inst, "join approvespec "+msgjoinid+" 7 "+reason)
 				inst.OnJoinDispatch[msgb64pubkey] = jd
+				inst.lobbyNames[msgb64pubkey] = string(msgname)
 
 			case joinCheckActionLevelReject:
 				inst.logger.Printf("Action reject for %q %q", msgip, msgname)
@@ -132,6 +145,12 @@ var (
 				instWriteFmt(inst, "join reject "+msgjoinid+" 7 "+reason)
 				instWriteFmt(inst, "ban ip "+msgip)
 			}
+			publishInstanceEvent(inst, instanceEventJoinDecision, map[string]any{
+				"name":      string(msgname),
+				"pubkey":    msgb64pubkey,
+				"action":    action.String(),
+				"allowChat": jd.AllowChat,
+			})
 			return false
 		},
 	}, {
@@ -144,7 +163,47 @@ var (
 				inst.logger.Printf("Failed to parse join message: %v", err)
 				return true
 			}
+
+			inst.joinCount.Add(1)
+			inst.lobbyOccupants.Add(1)
+			err = recoverSave(inst)
+			if err != nil {
+				inst.logger.Printf("Failed to save instance recovery json: %s", err.Error())
+			}
+			publishInstanceEvent(inst, instanceEventPlayerJoined, map[string]any{
+				"pubkey": msgb64pubkey,
+			})
 			messageHandlerProcessIdentityJoin(inst, msgb64pubkey)
+			// join id of player join is the player index
+			plid, err := strconv.Atoi(msgjoinid)
+			if err == nil {
+				lobbyRosterSet(inst, plid, msgb64pubkey, "")
+			}
+			return false
+		},
+	}, {
+		match:   hosterMessageMatchTypePrefix,
+		mPrefix: "WZEVENT: player leave: ",
+		fn: func(inst *instance, msg string) bool {
+			// WZEVENT: player leave: <plid> <b64pubkey> ...
+			var msgplid int
+			var msgb64pubkey string
+			i, err := fmt.Sscanf(msg, "WZEVENT: player leave: %d %s", &msgplid, &msgb64pubkey)
+			if err != nil || i != 2 {
+				inst.logger.Printf("Failed to parse leave message: %v", err)
+				return true
+			}
+			if inst.lobbyOccupants.Add(-1) < 0 {
+				inst.lobbyOccupants.Store(0)
+			}
+			err = recoverSave(inst)
+			if err != nil {
+				inst.logger.Printf("Failed to save instance recovery json: %s", err.Error())
+			}
+			if p, ok := inst.lobbyRoster[msgplid]; ok && p.Pubkey == msgb64pubkey {
+				lobbyRosterRemove(inst, msgplid)
+			}
+			delete(inst.lobbyNames, msgb64pubkey)
 			return false
 		},
 	}, {
@@ -205,6 +264,7 @@ var (
 				return true
 			}
 			joincheckWasMovedOutGlobal.add(msgb64pubkey, inst.Id)
+			lobbyRosterRemove(inst, msgplidfrom)
 			return false
 		},
 	}, {
@@ -221,6 +281,11 @@ var (
 				return true
 			}
 			joincheckWasMovedOutGlobal.remove(msgb64pubkey, inst.Id)
+			msgname, err := base64.StdEncoding.DecodeString(msgb64name)
+			if err != nil {
+				inst.logger.Printf("Failed to decode base64 name: %s", err.Error())
+			}
+			lobbyRosterSet(inst, msgplidto, msgb64pubkey, string(msgname))
 			return false
 		},
 	}, {
@@ -302,14 +367,14 @@ var (
 		match:   hosterMessageMatchTypePrefix,
 		mPrefix: "WZCMD error: ",
 		fn: func(inst *instance, msg string) bool {
-			discordPostError("instance `%d` spewed a WZCMD error: %q", inst.Id, msg)
+			notifyErrorf("instance `%d` spewed a WZCMD error: %q", inst.Id, msg)
 			return true
 		},
 	}, {
 		match:   hosterMessageMatchTypePrefix,
 		mPrefix: "error   |",
 		fn: func(inst *instance, msg string) bool {
-			discordPostError("instance `%d` spewed a regular error: %q", inst.Id, msg)
+			notifyErrorf("instance `%d` spewed a regular error: %q", inst.Id, msg)
 			return true
 		},
 	}}
@@ -409,7 +474,7 @@ func messageHandlerProcessChat(inst *instance, msg string) bool {
 	err = addChatLog(msgip, string(msgname), msgpubkey, string(msgcontent), msgtype)
 	if err != nil {
 		inst.logger.Printf("Failed to log chat of instance `%d`: %s (%q: %q), was fed %q", inst.Id, err.Error(), string(msgname), string(msgcontent), origmsg)
-		discordPostError("Failed to log chat of instance `%d`: %s (%q: %q), was fed %q", inst.Id, err.Error(), string(msgname), string(msgcontent), origmsg)
+		notifyErrorf("Failed to log chat of instance `%d`: %s (%q: %q), was fed %q", inst.Id, err.Error(), string(msgname), string(msgcontent), origmsg)
 	}
 	if msgtype == "WZCHATCMD" && (string(msgcontent) == "/stat" || string(msgcontent) == "/stats") {
 		instWriteFmt(inst, `chat direct %s %s`, msgb64pubkey, "All Autohoster's games are available at the website: https://wz2100-autohost.net/games (with detailed dtatistics, charts and replay)")
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minimal prometheus text exposition, we don't need the whole client library for a handful of counters
+
+type metricCounterVec struct {
+	name   string
+	help   string
+	labels []string
+	lock   sync.Mutex
+	vals   map[string]uint64
+}
+
+func newMetricCounterVec(name, help string, labels ...string) *metricCounterVec {
+	return &metricCounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		vals:   map[string]uint64{},
+	}
+}
+
+func (m *metricCounterVec) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metricCounterVec) add(n uint64, labelValues ...string) {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s called with %d label values, expected %d", m.name, len(labelValues), len(m.labels)))
+	}
+	k := metricFormatLabels(m.labels, labelValues)
+	m.lock.Lock()
+	m.vals[k] += n
+	m.lock.Unlock()
+}
+
+func (m *metricCounterVec) write(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+	m.lock.Lock()
+	keys := make([]string, 0, len(m.vals))
+	for k := range m.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s%s %d\n", m.name, k, m.vals[k])
+	}
+	m.lock.Unlock()
+}
+
+func metricFormatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, len(labels))
+	for i := range labels {
+		parts[i] = labels[i] + `="` + r.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func metricWriteGauge(b *strings.Builder, name, help string, vals map[string]float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s%s %v\n", name, k, vals[k])
+	}
+}
+
+var (
+	metricJoinChecks = newMetricCounterVec("autohoster_joincheck_outcomes_total",
+		"Join check results by deciding stage and resulting action", "stage", "action")
+	metricReportFrames = newMetricCounterVec("autohoster_report_frames_total",
+		"Game report frames processed by result", "result")
+	metricReplayStorageFailures = newMetricCounterVec("autohoster_replay_storage_failures_total",
+		"Replay storage failures by step", "step")
+	metricNotifications = newMetricCounterVec("autohoster_notifications_total",
+		"Notification messages by sink and result", "sink", "result")
+
+	metricCounters = []*metricCounterVec{
+		metricJoinChecks,
+		metricReportFrames,
+		metricReplayStorageFailures,
+		metricNotifications,
+	}
+)
+
+func webHandleMetrics(w http.ResponseWriter, r *http.Request) {
+	b := strings.Builder{}
+
+	perState := map[string]float64{}
+	perQueue := map[string]float64{}
+	for st := instanceStateInitial; st <= instanceStateExited; st++ {
+		perState[metricFormatLabels([]string{"state"}, []string{st.String()})] = 0
+	}
+	instancesLock.Lock()
+	for _, v := range instances {
+		st := instanceState(v.state.Load()).String()
+		perState[metricFormatLabels([]string{"state"}, []string{st})]++
+		perQueue[metricFormatLabels([]string{"queue", "state"}, []string{v.QueueName, st})]++
+	}
+	instancesLock.Unlock()
+	metricWriteGauge(&b, "autohoster_instances", "Instances by state", perState)
+	metricWriteGauge(&b, "autohoster_queue_instances", "Instances by queue and state", perQueue)
+	drainingVal := 0.0
+	if draining.Load() {
+		drainingVal = 1
+	}
+	metricWriteGauge(&b, "autohoster_draining", "Backend is draining", map[string]float64{"": drainingVal})
+
+	portStates := map[string]float64{}
+	for _, st := range []string{"free", "used", "cooldown", "unavailable"} {
+		portStates[metricFormatLabels([]string{"state"}, []string{st})] = 0
+	}
+	totalPorts := 0
+	freePorts := 0
+	for _, p := range ports.describe() {
+		totalPorts++
+		if p.State == "free" {
+			freePorts++
+		}
+		portStates[metricFormatLabels([]string{"state"}, []string{p.State})]++
+	}
+	metricWriteGauge(&b, "autohoster_ports_total", "Ports declared for instances", map[string]float64{"": float64(totalPorts)})
+	metricWriteGauge(&b, "autohoster_ports_free", "Ports not used by any instance", map[string]float64{"": float64(freePorts)})
+	metricWriteGauge(&b, "autohoster_ports", "Ports by allocation state", portStates)
+
+	for _, m := range metricCounters {
+		m.write(&b)
+	}
+
+	if ISPchecker != nil {
+		lookups, hits := ISPchecker.Stats()
+		fmt.Fprintf(&b, "# HELP autohoster_isp_lookups_total ISP lookups by source\n# TYPE autohoster_isp_lookups_total counter\n")
+		fmt.Fprintf(&b, "autohoster_isp_lookups_total{source=\"cache\"} %d\n", hits)
+		fmt.Fprintf(&b, "autohoster_isp_lookups_total{source=\"remote\"} %d\n", lookups)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations reads embedded migrations named <version>_<name>.(up|down).sql
+func loadMigrations() ([]migration, error) {
+	files, err := fs.ReadDir(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, f := range files {
+		base, direction, ok := strings.Cut(strings.TrimSuffix(f.Name(), ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %q has invalid name", f.Name())
+		}
+		versionS, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionS)
+		if err != nil {
+			return nil, fmt.Errorf("migration %q has invalid version: %w", f.Name(), err)
+		}
+		b, err := migrationsFS.ReadFile("migrations/" + f.Name())
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(b)
+		} else {
+			m.down = string(b)
+		}
+	}
+	ret := []migration{}
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d has no up script", m.version)
+		}
+		ret = append(ret, *m)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].version < ret[j].version
+	})
+	return ret, nil
+}
+
+func migrationsApplied(ctx context.Context) (map[int]time.Time, error) {
+	_, err := dbpool.Exec(ctx, `create table if not exists schema_migrations (
+	version int primary key,
+	name text not null,
+	time_applied timestamptz not null default now()
+)`)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[int]time.Time{}
+	var version int
+	var applied time.Time
+	_, err = dbpool.QueryFunc(ctx, `select version, time_applied from schema_migrations`, []any{}, []any{&version, &applied}, func(qfr pgx.QueryFuncRow) error {
+		ret[version] = applied
+		return nil
+	})
+	return ret, err
+}
+
+// migrateUp applies up to n pending migrations, all of them if n <= 0
+func migrateUp(ctx context.Context, n int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := migrationsApplied(ctx)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		if n > 0 && count >= n {
+			break
+		}
+		log.Printf("Applying migration %d %s", m.version, m.name)
+		err = dbpool.BeginFunc(ctx, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, m.up)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, `insert into schema_migrations (version, name) values ($1, $2)`, m.version, m.name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.version, m.name, err)
+		}
+		count++
+	}
+	log.Printf("Applied %d migrations", count)
+	return nil
+}
+
+// migrateDown reverts n latest applied migrations
+func migrateDown(ctx context.Context, n int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := migrationsApplied(ctx)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < n; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		if m.down == "" {
+			return fmt.Errorf("migration %d %s has no down script", m.version, m.name)
+		}
+		log.Printf("Reverting migration %d %s", m.version, m.name)
+		err = dbpool.BeginFunc(ctx, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, m.down)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, `delete from schema_migrations where version = $1`, m.version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.version, m.name, err)
+		}
+		count++
+	}
+	log.Printf("Reverted %d migrations", count)
+	return nil
+}
+
+func migratePending(ctx context.Context) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := migrationsApplied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret := []migration{}
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; !ok {
+			ret = append(ret, m)
+		}
+	}
+	return ret, nil
+}
+
+func migrateStatus(ctx context.Context) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := migrationsApplied(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		t, ok := applied[m.version]
+		if ok {
+			fmt.Printf("%04d %-24s applied %s\n", m.version, m.name, t.Format(time.RFC3339))
+		} else {
+			fmt.Printf("%04d %-24s pending\n", m.version, m.name)
+		}
+	}
+	return nil
+}
+
+// migrateOnStartup is controlled by migrateOnStartup config key: "off" (default), "check" or "apply"
+func migrateOnStartup() {
+	ctx := context.Background()
+	switch mode := cfg.GetDSString("off", "migrateOnStartup"); mode {
+	case "off":
+	case "check":
+		pending, err := migratePending(ctx)
+		if err != nil {
+			log.Fatalf("Failed to check database migrations: %s", err.Error())
+		}
+		if len(pending) > 0 {
+			log.Fatalf("Database has %d pending migrations (first is %d %s), run migrate up", len(pending), pending[0].version, pending[0].name)
+		}
+	case "apply":
+		err := migrateUp(ctx, 0)
+		if err != nil {
+			log.Fatalf("Failed to apply database migrations: %s", err.Error())
+		}
+	default:
+		log.Fatalf("Unknown migrateOnStartup mode %q", mode)
+	}
+}
+
+func commandMigrate(args []string) {
+	fset := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintln(fset.Output(), "Usage: autohoster-backend migrate (up [n] | down [n] | status)")
+	}
+	fset.Parse(args)
+	if fset.NArg() < 1 {
+		fset.Usage()
+		os.Exit(2)
+	}
+	n := 0
+	if fset.NArg() > 1 {
+		var err error
+		n, err = strconv.Atoi(fset.Arg(1))
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid migration count %q", fset.Arg(1))
+		}
+	}
+	ctx := context.Background()
+	var err error
+	switch fset.Arg(0) {
+	case "up":
+		err = migrateUp(ctx, n)
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		err = migrateDown(ctx, n)
+	case "status":
+		err = migrateStatus(ctx)
+	default:
+		err = errors.New("unknown migrate action " + fset.Arg(0))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,8 @@
+drop table if exists eventlog;
+drop table if exists chatlog;
+drop table if exists games_rating_categories;
+drop table if exists players;
+drop table if exists games;
+drop table if exists bans;
+drop table if exists identities;
+drop table if exists accounts;
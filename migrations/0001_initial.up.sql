@@ -0,0 +1,88 @@
+create table if not exists accounts (
+	id serial primary key,
+	username text unique,
+	allow_host_request boolean not null default false,
+	terminated boolean not null default false,
+	time_created timestamptz not null default now()
+);
+
+create table if not exists identities (
+	id serial primary key,
+	name text not null,
+	pkey bytea unique,
+	hash text not null unique,
+	account int references accounts(id) on delete set null
+);
+
+create index if not exists identities_account on identities (account);
+
+create table if not exists bans (
+	id serial primary key,
+	identity int references identities(id) on delete cascade,
+	account int references accounts(id) on delete cascade,
+	time_issued timestamptz not null default now(),
+	time_expires timestamptz,
+	reason text not null default '',
+	forbids_joining boolean not null default true,
+	forbids_playing boolean not null default true,
+	forbids_chatting boolean not null default true
+);
+
+create table if not exists games (
+	id serial primary key,
+	version text,
+	instance bigint,
+	time_started timestamptz not null default now(),
+	time_ended timestamptz,
+	game_time int,
+	setting_scavs int,
+	setting_alliance int,
+	setting_power int,
+	setting_base int,
+	map_name text,
+	map_hash text,
+	mods text,
+	display_category int not null default 0,
+	debug_triggered boolean not null default false,
+	graphs json,
+	research_log json,
+	replay bytea
+);
+
+create index if not exists games_time_started on games (time_started);
+create index if not exists games_map_hash on games (map_hash);
+
+create table if not exists players (
+	game int not null references games(id) on delete cascade,
+	identity int not null references identities(id),
+	position int not null,
+	team int,
+	color int,
+	usertype text,
+	props jsonb,
+	primary key (game, position)
+);
+
+create index if not exists players_identity on players (identity);
+
+create table if not exists games_rating_categories (
+	game int not null references games(id) on delete cascade,
+	category int not null,
+	primary key (game, category)
+);
+
+create table if not exists chatlog (
+	id serial primary key,
+	whensent timestamptz not null default now(),
+	ip text,
+	name text,
+	pkey bytea,
+	msg text,
+	msgtype text
+);
+
+create table if not exists eventlog (
+	id serial primary key,
+	whensent timestamptz not null default now(),
+	msg text not null
+);
@@ -0,0 +1,2 @@
+drop table if exists instance_states;
+drop table if exists instances;
@@ -0,0 +1,27 @@
+create table if not exists instances (
+	id bigint primary key,
+	queue text,
+	port int not null,
+	map_name text,
+	map_hash text,
+	pid int,
+	version text,
+	state text not null,
+	lobby_id int,
+	game_id int,
+	exit_reason text,
+	time_created timestamptz not null default now(),
+	time_updated timestamptz not null default now()
+);
+
+create index if not exists instances_game_id on instances (game_id);
+create index if not exists instances_queue_created on instances (queue, time_created);
+
+create table if not exists instance_states (
+	instance bigint not null references instances(id) on delete cascade,
+	state_from text not null,
+	state_to text not null,
+	time timestamptz not null default now()
+);
+
+create index if not exists instance_states_instance on instance_states (instance, time);
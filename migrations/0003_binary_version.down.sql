@@ -0,0 +1,2 @@
+alter table instances drop column if exists binary_version;
+alter table games drop column if exists binary_version;
@@ -0,0 +1,2 @@
+alter table games add column if not exists binary_version text;
+alter table instances add column if not exists binary_version text;
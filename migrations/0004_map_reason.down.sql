@@ -0,0 +1 @@
+alter table instances drop column if exists map_reason;
@@ -0,0 +1 @@
+alter table instances add column if not exists map_reason text;
@@ -0,0 +1,9 @@
+-- ratings are calculated and written outside of the backend, join rules only read them
+create table if not exists ratings (
+	account int not null references accounts(id) on delete cascade,
+	category int not null,
+	rating int not null,
+	games int not null default 0,
+	time_updated timestamptz not null default now(),
+	primary key (account, category)
+);
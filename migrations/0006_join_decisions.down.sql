@@ -0,0 +1 @@
+drop table if exists join_decisions;
@@ -0,0 +1,20 @@
+create table if not exists join_decisions (
+	id bigserial primary key,
+	instance bigint not null,
+	queue text,
+	pubkey_hash text not null,
+	account int,
+	ip text,
+	name text,
+	action text not null,
+	stages text[] not null,
+	rules text,
+	allow_chat boolean not null,
+	messages text[] not null,
+	reason text,
+	time timestamptz not null default now()
+);
+
+create index if not exists join_decisions_pubkey_hash on join_decisions (pubkey_hash, time);
+create index if not exists join_decisions_account on join_decisions (account, time);
+create index if not exists join_decisions_instance on join_decisions (instance);
@@ -0,0 +1 @@
+drop index if exists join_decisions_time;
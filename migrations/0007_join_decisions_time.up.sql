@@ -0,0 +1 @@
+create index if not exists join_decisions_time on join_decisions (time);
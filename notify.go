@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type notifySeverity int
+
+const (
+	notifySeverityInfo notifySeverity = iota
+	notifySeverityWarning
+	notifySeverityError
+)
+
+func (s notifySeverity) String() string {
+	switch s {
+	case notifySeverityInfo:
+		return "info"
+	case notifySeverityWarning:
+		return "warning"
+	case notifySeverityError:
+		return "error"
+	default:
+		return "unknown?!"
+	}
+}
+
+func parseNotifySeverity(s string) (notifySeverity, bool) {
+	switch s {
+	case "info":
+		return notifySeverityInfo, true
+	case "warning":
+		return notifySeverityWarning, true
+	case "error":
+		return notifySeverityError, true
+	default:
+		return notifySeverityInfo, false
+	}
+}
+
+const (
+	notifyCategoryInfra      = "infra"
+	notifyCategoryModeration = "moderation"
+)
+
+type notifyMessage struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Category string    `json:"category"`
+	Text     string    `json:"text"`
+
+	severity notifySeverity
+}
+
+// notifySink delivers an aggregated batch of messages somewhere
+type notifySink interface {
+	send(msgs []notifyMessage) error
+}
+
+type notifySinkRunner struct {
+	name        string
+	sink        notifySink
+	minSeverity notifySeverity
+	categories  []string
+	aggregate   time.Duration
+	rateLimit   int
+	dedup       time.Duration
+	msgs        chan notifyMessage
+
+	pending    []notifyMessage
+	sent       []time.Time
+	seen       map[string]notifyMessage
+	suppressed map[string]int
+}
+
+var (
+	notifyQueue = make(chan notifyMessage, 128)
+)
+
+func notifyPost(severity notifySeverity, category string, format string, args ...any) {
+	msg := notifyMessage{
+		Time:     time.Now(),
+		Severity: severity.String(),
+		Category: category,
+		Text:     fmt.Sprintf(format, args...),
+		severity: severity,
+	}
+	select {
+	case notifyQueue <- msg:
+		metricNotifications.inc("queue", "queued")
+	default:
+		metricNotifications.inc("queue", "dropped")
+		log.Printf("Notification queue is full, dropped: %s", msg.Text)
+	}
+}
+
+func notifyErrorf(format string, args ...any) {
+	notifyPost(notifySeverityError, notifyCategoryInfra, format, args...)
+}
+
+func notifyModerationf(format string, args ...any) {
+	notifyPost(notifySeverityInfo, notifyCategoryModeration, format, args...)
+}
+
+func notifyLoadSinks() []*notifySinkRunner {
+	ret := []*notifySinkRunner{}
+	names, ok := cfg.GetKeys("notifiers")
+	if !ok {
+		// keep old behaviour of a single error webhook working
+		webhookUrl, ok := cfg.GetString("discordErrorsWebhook")
+		if !ok {
+			log.Println("No notifiers defined and errors discord webhook not set!!!")
+			return ret
+		}
+		return append(ret, &notifySinkRunner{
+			name:        "discordErrorsWebhook",
+			sink:        &notifySinkDiscord{url: webhookUrl},
+			minSeverity: notifySeverityError,
+			aggregate:   60 * time.Second,
+		})
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if cfg.GetDSBool(false, "notifiers", name, "disabled") {
+			continue
+		}
+		r, err := notifyLoadSink(name)
+		if err != nil {
+			log.Printf("Failed to load notifier %q: %s", name, err.Error())
+			continue
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+func notifyLoadSink(name string) (*notifySinkRunner, error) {
+	r := &notifySinkRunner{
+		name:      name,
+		aggregate: time.Duration(cfg.GetDSInt(60, "notifiers", name, "aggregateSeconds")) * time.Second,
+		rateLimit: cfg.GetDSInt(0, "notifiers", name, "rateLimitPerMinute"),
+		dedup:     time.Duration(cfg.GetDSInt(0, "notifiers", name, "dedupSeconds")) * time.Second,
+	}
+	sevs := cfg.GetDSString("error", "notifiers", name, "minSeverity")
+	sev, ok := parseNotifySeverity(sevs)
+	if !ok {
+		return nil, fmt.Errorf("unknown severity %q", sevs)
+	}
+	r.minSeverity = sev
+	r.categories, _ = cfg.GetSliceString("notifiers", name, "categories")
+
+	t, _ := cfg.GetString("notifiers", name, "type")
+	switch t {
+	case "discord", "webhook", "slack", "matrix":
+		url, ok := cfg.GetString("notifiers", name, "url")
+		if !ok || url == "" {
+			return nil, errors.New("url not set")
+		}
+		switch t {
+		case "discord":
+			r.sink = &notifySinkDiscord{url: url}
+		case "webhook":
+			r.sink = &notifySinkWebhook{url: url}
+		default:
+			r.sink = &notifySinkText{url: url}
+		}
+	case "file":
+		p, ok := cfg.GetString("notifiers", name, "path")
+		if !ok || p == "" {
+			return nil, errors.New("path not set")
+		}
+		r.sink = &notifySinkFile{path: p}
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q", t)
+	}
+	return r, nil
+}
+
+// notifyReloadTrigger makes notifier rebuild sinks from config, pending messages are flushed first
+var notifyReloadTrigger = make(chan struct{}, 1)
+
+func notifyReloadRequest() {
+	select {
+	case notifyReloadTrigger <- struct{}{}:
+	default:
+	}
+}
+
+func notifyStartRunners(runners []*notifySinkRunner) (stop func()) {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for _, r := range runners {
+		log.Printf("Notifier %q active (min severity %s, categories %v)", r.name, r.minSeverity, r.categories)
+		r.msgs = make(chan notifyMessage, 128)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.run(done)
+		}()
+	}
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func routineNotifier(closechan <-chan struct{}) {
+	runners := notifyLoadSinks()
+	stop := notifyStartRunners(runners)
+	dispatch := func(msg notifyMessage) {
+		for _, r := range runners {
+			if !r.accepts(msg) {
+				continue
+			}
+			select {
+			case r.msgs <- msg:
+			default:
+				metricNotifications.inc(r.name, "dropped")
+			}
+		}
+	}
+	for {
+		select {
+		case msg := <-notifyQueue:
+			dispatch(msg)
+		case <-notifyReloadTrigger:
+			stop()
+			runners = notifyLoadSinks()
+			stop = notifyStartRunners(runners)
+			log.Printf("Notifiers reloaded, %d active", len(runners))
+		case <-closechan:
+			for len(notifyQueue) > 0 {
+				dispatch(<-notifyQueue)
+			}
+			stop()
+			return
+		}
+	}
+}
+
+func (r *notifySinkRunner) accepts(msg notifyMessage) bool {
+	if msg.severity < r.minSeverity {
+		return false
+	}
+	if len(r.categories) > 0 && !slices.Contains(r.categories, msg.Category) {
+		return false
+	}
+	return true
+}
+
+func (r *notifySinkRunner) run(done <-chan struct{}) {
+	r.seen = map[string]notifyMessage{}
+	r.suppressed = map[string]int{}
+	interval := r.aggregate
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	flusher := time.NewTicker(interval)
+	defer flusher.Stop()
+	for {
+		select {
+		case msg := <-r.msgs:
+			r.add(msg)
+			if r.aggregate <= 0 {
+				r.flush(false)
+			}
+		case <-flusher.C:
+			r.flush(false)
+		case <-done:
+			for len(r.msgs) > 0 {
+				r.add(<-r.msgs)
+			}
+			r.flush(true)
+			return
+		}
+	}
+}
+
+func (r *notifySinkRunner) add(msg notifyMessage) {
+	if r.dedup > 0 {
+		last, ok := r.seen[msg.Text]
+		if ok && msg.Time.Sub(last.Time) < r.dedup {
+			r.suppressed[msg.Text]++
+			metricNotifications.inc(r.name, "deduplicated")
+			return
+		}
+		r.seen[msg.Text] = msg
+		if n := r.suppressed[msg.Text]; n > 0 {
+			delete(r.suppressed, msg.Text)
+			msg.Text += fmt.Sprintf(" (repeated %d more times)", n)
+		}
+	}
+	r.pending = append(r.pending, msg)
+	// do not grow forever if sink is rate limited or down
+	if len(r.pending) > 1024 {
+		metricNotifications.add(uint64(len(r.pending)-1024), r.name, "dropped")
+		r.pending = r.pending[len(r.pending)-1024:]
+	}
+}
+
+func (r *notifySinkRunner) flush(force bool) {
+	now := time.Now()
+	for k, v := range r.seen {
+		if now.Sub(v.Time) <= r.dedup {
+			continue
+		}
+		if n := r.suppressed[k]; n > 0 {
+			v.Time = now
+			v.Text += fmt.Sprintf(" (repeated %d more times)", n)
+			r.pending = append(r.pending, v)
+		}
+		delete(r.seen, k)
+		delete(r.suppressed, k)
+	}
+	if len(r.pending) == 0 {
+		return
+	}
+	if r.rateLimit > 0 && !force {
+		r.sent = slices.DeleteFunc(r.sent, func(t time.Time) bool {
+			return now.Sub(t) > time.Minute
+		})
+		if len(r.sent) >= r.rateLimit {
+			return
+		}
+		r.sent = append(r.sent, now)
+	}
+	err := r.sink.send(r.pending)
+	if err != nil {
+		log.Printf("Notifier %q failed to send %d messages: %s", r.name, len(r.pending), err.Error())
+		metricNotifications.add(uint64(len(r.pending)), r.name, "failed")
+	} else {
+		metricNotifications.add(uint64(len(r.pending)), r.name, "sent")
+	}
+	r.pending = nil
+}
+
+func notifyJoinText(msgs []notifyMessage) string {
+	ret := ""
+	for _, m := range msgs {
+		ret += m.Text + "\n"
+	}
+	return ret
+}
+
+func notifyPostJSON(url string, payload any) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	c := http.Client{Timeout: 5 * time.Second}
+	resp, err := c.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		rspb, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(rspb))
+	}
+	return nil
+}
+
+type notifySinkDiscord struct {
+	url string
+}
+
+func (s *notifySinkDiscord) send(msgs []notifyMessage) error {
+	content := notifyJoinText(msgs)
+	if len(content) < 1995 {
+		return discordSendWithContent(s.url, content)
+	}
+	return discordSendWithFile(s.url, content)
+}
+
+// notifySinkWebhook posts structured messages as generic json
+type notifySinkWebhook struct {
+	url string
+}
+
+func (s *notifySinkWebhook) send(msgs []notifyMessage) error {
+	return notifyPostJSON(s.url, map[string]any{
+		"source":   "autohoster-backend",
+		"messages": msgs,
+	})
+}
+
+// notifySinkText posts {"text": ...} understood by slack and matrix hookshot style webhooks
+type notifySinkText struct {
+	url string
+}
+
+func (s *notifySinkText) send(msgs []notifyMessage) error {
+	return notifyPostJSON(s.url, map[string]any{
+		"text": notifyJoinText(msgs),
+	})
+}
+
+type notifySinkFile struct {
+	path string
+}
+
+func (s *notifySinkFile) send(msgs []notifyMessage) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, fs.FileMode(cfg.GetDInt(644, "filePerms")))
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		_, err = fmt.Fprintf(f, "%s [%s] [%s] %s\n", m.Time.Format(time.RFC3339), m.Severity, m.Category, strings.ReplaceAll(m.Text, "\n", "\\n"))
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
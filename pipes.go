@@ -5,31 +5,10 @@ import (
 	"io"
 	"io/fs"
 	"os"
-	"path"
 	"syscall"
 	"time"
 )
 
-func createPipes(inst *instance) error {
-	var err error
-	inst.stdin, err = createOpenPipe(path.Join(inst.ConfDir, "stdin.pipe"), os.O_RDWR)
-	if err != nil {
-		inst.logger.Printf("Error opening stdin pipe: %s", err.Error())
-		return err
-	}
-	inst.stdout, err = createOpenPipe(path.Join(inst.ConfDir, "stdout.pipe"), os.O_RDWR)
-	if err != nil {
-		inst.logger.Printf("Error opening stdout pipe: %s", err.Error())
-		return err
-	}
-	inst.stderr, err = createOpenPipe(path.Join(inst.ConfDir, "stderr.pipe"), os.O_RDWR)
-	if err != nil {
-		inst.logger.Printf("Error opening stderr pipe: %s", err.Error())
-		return err
-	}
-	return nil
-}
-
 func createOpenPipe(instpath string, flag int) (*os.File, error) {
 	perm := fs.FileMode(cfg.GetDInt(644, "filePerms"))
 	err := syscall.Mkfifo(instpath, uint32(perm))
@@ -39,60 +18,6 @@ func createOpenPipe(instpath string, flag int) (*os.File, error) {
 	return os.OpenFile(instpath, flag, os.ModeNamedPipe)
 }
 
-func openPipes(inst *instance) error {
-	var err error
-	inst.stdin, err = os.OpenFile(path.Join(inst.ConfDir, "stdin.pipe"), os.O_RDWR, os.ModeNamedPipe)
-	if err != nil {
-		inst.logger.Printf("Error opening stdin pipe: %s", err.Error())
-		return err
-	}
-	inst.stdout, err = os.OpenFile(path.Join(inst.ConfDir, "stdout.pipe"), os.O_RDWR, os.ModeNamedPipe)
-	if err != nil {
-		inst.logger.Printf("Error opening stdout pipe: %s", err.Error())
-		return err
-	}
-	inst.stderr, err = os.OpenFile(path.Join(inst.ConfDir, "stderr.pipe"), os.O_RDWR, os.ModeNamedPipe)
-	if err != nil {
-		inst.logger.Printf("Error opening stderr pipe: %s", err.Error())
-		return err
-	}
-	return nil
-}
-
-func closePipes(inst *instance) error {
-	err := inst.stdin.SetDeadline(time.Now().Add(1 * time.Second))
-	if err != nil {
-		inst.logger.Println("Failed to set deadline for stdin:", err)
-		return err
-	}
-	err = inst.stdin.Close()
-	if err != nil {
-		inst.logger.Println("Failed to close stdin:", err)
-		return err
-	}
-	err = inst.stderr.SetDeadline(time.Now().Add(1 * time.Second))
-	if err != nil {
-		inst.logger.Println("Failed to set deadline for stderr:", err)
-		return err
-	}
-	err = inst.stderr.Close()
-	if err != nil {
-		inst.logger.Println("Failed to close stderr:", err)
-		return err
-	}
-	err = inst.stdout.SetDeadline(time.Now().Add(1 * time.Second))
-	if err != nil {
-		inst.logger.Println("Failed to set deadline for stdout:", err)
-		return err
-	}
-	err = inst.stdout.Close()
-	if err != nil {
-		inst.logger.Println("Failed to close stdout:", err)
-		return err
-	}
-	return nil
-}
-
 func checkPipeContainsData(p string) (int64, error) {
 	fi, err := os.Stat(p)
 	if err != nil {
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// queues can reserve part of the ports with their own "ports" setting,
+// such ports are never handed out to other queues or requested rooms
+
+type portPool struct {
+	lock        sync.Mutex
+	releasedAt  map[int]time.Time
+	probeErrors map[int]string
+}
+
+var ports = portPool{
+	releasedAt:  map[int]time.Time{},
+	probeErrors: map[int]string{},
+}
+
+type portAllocationState struct {
+	Port        int        `json:"port"`
+	State       string     `json:"state"`
+	Instance    int64      `json:"instance,omitempty"`
+	ReservedFor string     `json:"reservedFor,omitempty"`
+	Until       *time.Time `json:"cooldownUntil,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func portsCooldown() time.Duration {
+	return time.Duration(cfg.GetDSInt(30, "portCooldownSeconds")) * time.Second
+}
+
+// portsReserved maps every port reserved by some queue to its queue name
+func portsReserved() map[int]string {
+	ret := map[int]string{}
+	queuesK, ok := cfg.GetKeys("queues")
+	if !ok {
+		return ret
+	}
+	sort.Strings(queuesK)
+	for _, queueName := range queuesK {
+		ps, ok := cfg.GetString("queues", queueName, "ports")
+		if !ok {
+			continue
+		}
+		for _, p := range parseNumbersString(ps) {
+			if q, ok := ret[p]; ok && q != queueName {
+				log.Printf("Port %d reserved by both %q and %q", p, q, queueName)
+				continue
+			}
+			ret[p] = queueName
+		}
+	}
+	return ret
+}
+
+// portsCandidates returns ports queue is allowed to use in order of preference
+func portsCandidates(queueName string) ([]int, error) {
+	if queueName != "" {
+		ps, ok := cfg.GetString("queues", queueName, "ports")
+		if ok {
+			return removeDuplicate(parseNumbersString(ps)), nil
+		}
+	}
+	ps, ok := cfg.GetString("ports")
+	if !ok {
+		return nil, errNoPortsDeclared
+	}
+	reserved := portsReserved()
+	return slices.DeleteFunc(removeDuplicate(parseNumbersString(ps)), func(p int) bool {
+		_, ok := reserved[p]
+		return ok
+	}), nil
+}
+
+func (pp *portPool) markReleased(p int) {
+	pp.lock.Lock()
+	pp.releasedAt[p] = time.Now()
+	pp.lock.Unlock()
+}
+
+func (pp *portPool) cooldownUntil(p int) (time.Time, bool) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	r, ok := pp.releasedAt[p]
+	if !ok {
+		return time.Time{}, false
+	}
+	until := r.Add(portsCooldown())
+	if time.Now().After(until) {
+		delete(pp.releasedAt, p)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// probe checks that both udp and tcp can be bound on the port,
+// something outside of the backend might be sitting on it
+func (pp *portPool) probe(p int) error {
+	if !cfg.GetDSBool(true, "portProbe") {
+		return nil
+	}
+	addr := fmt.Sprintf(":%d", p)
+	err := func() error {
+		tl, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		tl.Close()
+		ul, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		ul.Close()
+		return nil
+	}()
+	pp.lock.Lock()
+	if err != nil {
+		pp.probeErrors[p] = err.Error()
+	} else {
+		delete(pp.probeErrors, p)
+	}
+	pp.lock.Unlock()
+	return err
+}
+
+// pickNOLOCK selects free port for the queue, instancesLock must be held
+func (pp *portPool) pickNOLOCK(queueName string) (int, error) {
+	candidates, err := portsCandidates(queueName)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range candidates {
+		used := false
+		for _, i := range instances {
+			if i.Settings.GamePort == p {
+				used = true
+				break
+			}
+		}
+		if used {
+			continue
+		}
+		if _, ok := pp.cooldownUntil(p); ok {
+			continue
+		}
+		if err := pp.probe(p); err != nil {
+			log.Printf("Port %d is not bindable, skipping: %s", p, err.Error())
+			continue
+		}
+		return p, nil
+	}
+	return 0, errNoFreePort
+}
+
+func (pp *portPool) describe() []portAllocationState {
+	reserved := portsReserved()
+	all := []int{}
+	if ps, ok := cfg.GetString("ports"); ok {
+		all = parseNumbersString(ps)
+	}
+	for p := range reserved {
+		all = append(all, p)
+	}
+	all = removeDuplicate(all)
+	sort.Ints(all)
+
+	usedBy := map[int]int64{}
+	instancesLock.Lock()
+	for _, i := range instances {
+		usedBy[i.Settings.GamePort] = i.Id
+	}
+	instancesLock.Unlock()
+
+	ret := make([]portAllocationState, 0, len(all))
+	for _, p := range all {
+		s := portAllocationState{
+			Port:        p,
+			State:       "free",
+			ReservedFor: reserved[p],
+		}
+		if id, ok := usedBy[p]; ok {
+			s.State = "used"
+			s.Instance = id
+		} else if until, ok := pp.cooldownUntil(p); ok {
+			s.State = "cooldown"
+			s.Until = &until
+		} else {
+			pp.lock.Lock()
+			perr, ok := pp.probeErrors[p]
+			pp.lock.Unlock()
+			if ok {
+				s.State = "unavailable"
+				s.Error = perr
+			}
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+func apiHandlePorts(w http.ResponseWriter, r *http.Request, _ string) {
+	apiRespondJSON(w, http.StatusOK, ports.describe())
+}
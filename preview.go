@@ -0,0 +1,236 @@
+package main
+
+import (
+	"autohoster-backend/mapstorage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// preview runs instance generation for a queue up to the point where files
+// would be written, without allocating a port, an instance id or touching
+// instances directory. Random picks (map, settings* number lists) are made
+// the same way real generation makes them, so every call may differ.
+
+type previewValue struct {
+	Value    any      `json:"value"`
+	Layer    string   `json:"layer"`
+	Shadowed []string `json:"shadowed,omitempty"`
+}
+
+type queuePreview struct {
+	Queue         string                    `json:"queue"`
+	Map           string                    `json:"map"`
+	MapHash       string                    `json:"mapHash"`
+	MapReason     string                    `json:"mapReason,omitempty"`
+	MapInfo       *mapstorage.MapInfo       `json:"mapInfo"`
+	Binary        string                    `json:"binary"`
+	BinaryVersion string                    `json:"binaryVersion,omitempty"`
+	Layers        []string                  `json:"layers"`
+	Values        map[string]previewValue   `json:"values"`
+	Preset        map[string]any            `json:"preset"`
+	Config        string                    `json:"config"`
+	Actions       map[string]map[string]any `json:"actions"`
+}
+
+var (
+	// keys where the last layer defining an entry wins (see geniConfig and geniActions)
+	previewLastLayerWins = []string{"config", "actions"}
+	// keys taken as a whole from the first layer that has them (see geniRenderPreset, joinRatingBoundsRules)
+	previewWholeValue = []string{"presetOverride", "ratingBounds"}
+
+	errPreviewNoQueue = errors.New("queue not found")
+)
+
+// previewFlatten collects leaf values of a config layer by dotted path
+func previewFlatten(prefix string, m map[string]any, out map[string]any) {
+	for k, v := range m {
+		p := k
+		if prefix != "" {
+			p = prefix + "." + k
+		}
+		top, _, _ := strings.Cut(p, ".")
+		if prefix == "" && k == "maps" {
+			continue
+		}
+		sub, ok := v.(map[string]any)
+		switch {
+		case !ok, slices.Contains(previewWholeValue, p):
+			out[p] = v
+		case slices.Contains(previewLastLayerWins, top) && prefix != "":
+			out[p] = v
+		default:
+			previewFlatten(p, sub, out)
+		}
+	}
+}
+
+func previewResolveValues(inst *instance, names []string) map[string]previewValue {
+	flat := make([]map[string]any, len(inst.cfgs))
+	paths := map[string]bool{}
+	for i, c := range inst.cfgs {
+		flat[i] = map[string]any{}
+		m, ok := c.GetMapStringAny()
+		if !ok {
+			continue
+		}
+		previewFlatten("", m, flat[i])
+		for p := range flat[i] {
+			paths[p] = true
+		}
+	}
+	ret := map[string]previewValue{}
+	for p := range paths {
+		order := make([]int, len(inst.cfgs))
+		for i := range order {
+			order[i] = i
+		}
+		top, _, _ := strings.Cut(p, ".")
+		if slices.Contains(previewLastLayerWins, top) {
+			slices.Reverse(order)
+		}
+		pv := previewValue{}
+		found := false
+		for _, i := range order {
+			v, ok := flat[i][p]
+			if !ok {
+				continue
+			}
+			if !found {
+				pv.Value = v
+				pv.Layer = names[i]
+				found = true
+			} else {
+				pv.Shadowed = append(pv.Shadowed, names[i])
+			}
+		}
+		ret[p] = pv
+	}
+	return ret
+}
+
+// previewBuildInstance generates instance settings for the queue without side effects, mapName forces map selection
+func previewBuildInstance(queueName, mapName string) (*instance, *mapstorage.MapInfo, error) {
+	queues, _ := cfg.GetKeys("queues")
+	if !slices.Contains(queues, queueName) {
+		return nil, nil, errPreviewNoQueue
+	}
+	inst := &instance{
+		QueueName: queueName,
+		cfg:       cfg.DupSubTree("queues", queueName),
+		logger:    log.New(log.Writer(), fmt.Sprintf("preview %s ", queueName), log.Flags()|log.Lmsgprefix),
+	}
+	if mapName == "" {
+		err := geniPickMap(inst)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		hash, ok := inst.cfg.GetString("maps", mapName, "hash")
+		if !ok {
+			return nil, nil, fmt.Errorf("map %q not found in queue or has no hash", mapName)
+		}
+		inst.Settings.MapKey, inst.Settings.MapName, inst.Settings.MapHash = mapName, mapName, hash
+	}
+	geniLayers(inst)
+
+	// only already stored maps are checked, preview does not download anything
+	info, err := ms.LookupMapInfo(inst.Settings.MapHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info != nil {
+		err = geniApplyMapInfo(inst, info)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	inst.Settings.RatingCategories = tryCfgGetD(tryGetSliceIntGen("ratingCategories"), []int{}, inst.cfgs...)
+	return inst, info, nil
+}
+
+// previewQueue renders what generateInstance would produce for the queue, mapName forces map selection
+func previewQueue(queueName, mapName string) (*queuePreview, error) {
+	inst, info, err := previewBuildInstance(queueName, mapName)
+	if err != nil {
+		return nil, err
+	}
+	names := geniLayerNames(inst)
+
+	preset, err := geniRenderPreset(inst)
+	if err != nil {
+		return nil, err
+	}
+	return &queuePreview{
+		Queue:         queueName,
+		Map:           inst.Settings.MapName,
+		MapInfo:       info,
+		MapHash:       inst.Settings.MapHash,
+		MapReason:     inst.MapReason,
+		Binary:        inst.BinPath,
+		BinaryVersion: inst.BinaryVersion,
+		Layers:        names,
+		Values:        previewResolveValues(inst, names),
+		Preset:        preset,
+		Config:        geniRenderConfig(inst),
+		Actions:       geniCollectActions(inst),
+	}, nil
+}
+
+func apiHandleQueuePreview(w http.ResponseWriter, r *http.Request, _ string) {
+	p, err := previewQueue(r.PathValue("name"), r.URL.Query().Get("map"))
+	if errors.Is(err, errPreviewNoQueue) {
+		apiRespondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		apiRespondError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	apiRespondJSON(w, http.StatusOK, p)
+}
+
+func commandPreview(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: autohoster-backend preview <queue> [map]")
+		os.Exit(2)
+	}
+	mapName := ""
+	if len(args) > 1 {
+		mapName = args[1]
+	}
+	p, err := previewQueue(args[0], mapName)
+	if err != nil {
+		log.Fatalf("Preview failed: %s", err.Error())
+	}
+	keys := make([]string, 0, len(p.Values))
+	for k := range p.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Printf("Queue %q, map %q (%s), binary %s %s\n", p.Queue, p.Map, p.MapHash, p.Binary, p.BinaryVersion)
+	if p.MapReason != "" {
+		fmt.Printf("Map picked by %s\n", p.MapReason)
+	}
+	fmt.Println("Settings:")
+	for _, k := range keys {
+		v := p.Values[k]
+		vb, _ := json.Marshal(v.Value)
+		fmt.Printf("\t%s = %s (from %s", k, vb, v.Layer)
+		if len(v.Shadowed) > 0 {
+			fmt.Printf(", overrides %s", strings.Join(v.Shadowed, ", "))
+		}
+		fmt.Println(")")
+	}
+	presetB, _ := json.MarshalIndent(p.Preset, "", "\t")
+	fmt.Printf("autohost/preset.json:\n%s\n", presetB)
+	fmt.Printf("config:\n%s", p.Config)
+	actionsB, _ := json.MarshalIndent(p.Actions, "", "\t")
+	fmt.Printf("actions:\n%s\n", actionsB)
+}
@@ -39,6 +39,13 @@ func recoverInstances() {
 		confdir := path.Join(instancesPath, d.Name())
 		needsArchival := recoverRunner(confdir)
 		if needsArchival {
+			if instid, err := strconv.ParseInt(d.Name(), 10, 64); err == nil {
+				dbInstanceMarkDead(instid, "found dead on recovery")
+				err := cgroupRemove(cgroupInstancePath(instid))
+				if err != nil {
+					log.Printf("Error removing cgroup of instance %d: %s", instid, err.Error())
+				}
+			}
 			err := archiveInstance(confdir)
 			if err != nil {
 				log.Printf("Error archiving instance %q: %s", confdir, err.Error())
@@ -75,12 +82,14 @@ func recoverRunner(instpath string) bool {
 		log.Printf("Failed to insert instance with id %d", instid)
 		return false
 	}
-	err = openPipes(inst)
+	inst.proc, err = supervisorAttach(inst.ConfDir, inst.Pid, inst.logger)
 	if err != nil {
-		log.Printf("Failed to open pipes for instance %q: %s", instpath, err)
+		log.Printf("Failed to attach to instance %q: %s", instpath, err)
 		releaseInstance(inst)
 		return false
 	}
+	inst.ExitReason = ""
+	dbInstanceSave(inst)
 	go instanceRunner(inst)
 	return false
 }
@@ -115,45 +124,6 @@ func isPidCmdlineAccurate(inst *instance) bool {
 	return true
 }
 
-func isPidAlive(pid int) bool {
-	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
-	if err != nil {
-		return false
-	}
-	var (
-		rpid   int
-		rcomm  string
-		rstate rune
-	)
-	i, err := fmt.Sscanf(string(b), "%d %s %c", &rpid, &rcomm, &rstate)
-	if err != nil || i != 3 {
-		log.Printf("Failed to parse proc stat: %s", err.Error())
-		return false
-	}
-	switch rstate {
-	case 'R': // Running
-		return true
-	case 'S': // Sleeping in an interruptible wait
-		return true
-	case 'D': // Waiting in uninterruptible disk sleep
-		return true
-	case 'W': // Waking
-		return true
-	case 'I': // Idle
-		return true
-	default:
-		// case 'P': // Parked
-		// case 'Z': // Zombie
-		// case 'T': // Stopped
-		// case 't': // Tracing stop
-		// case 'W': // Paging
-		// case 'X': // Dead
-		// case 'x': // Dead
-		// case 'K': // Wakekill
-	}
-	return false
-}
-
 func recoverSave(inst *instance) error {
 	if inst == nil {
 		return errors.New("inst is nil")
@@ -161,6 +131,8 @@ func recoverSave(inst *instance) error {
 	loadedAtomic := int(inst.state.Load())
 	inst.logger.Printf("recoverSave loading atomic: %d", loadedAtomic)
 	inst.StateSaved = loadedAtomic
+	inst.JoinCountSaved = int(inst.joinCount.Load())
+	inst.LobbyOccupantsSaved = int(inst.lobbyOccupants.Load())
 	b, err := json.MarshalIndent(inst, "", "\t")
 	if err != nil {
 		return err
@@ -176,6 +148,8 @@ func recoverLoad(p string) (*instance, error) {
 	inst := &instance{
 		commands:       make(chan instanceCommand, 32),
 		OnJoinDispatch: map[string]joinDispatch{},
+		lobbyRoster:    map[int]lobbyPlayer{},
+		lobbyNames:     map[string]string{},
 		wg:             sync.WaitGroup{},
 	}
 	err = json.Unmarshal(b, &inst)
@@ -194,6 +168,7 @@ func recoverLoad(p string) (*instance, error) {
 	}
 	inst.logger.Printf("atomic state store: %d", int64(inst.StateSaved))
 	inst.state.Store(int64(inst.StateSaved))
-	inst.recovered = true
+	inst.joinCount.Store(int64(inst.JoinCountSaved))
+	inst.lobbyOccupants.Store(int64(inst.LobbyOccupantsSaved))
 	return inst, nil
 }
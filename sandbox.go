@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// sandbox mode starts the game in new user, mount and pid namespaces with
+// filesystem reduced to the instance confdir (writable), the binary, its data
+// directory and system libraries (read-only), optionally with seccomp filter on top.
+//
+//	"sandbox": {
+//		"enabled": true,
+//		"dataDir": "/usr/share/warzone2100",
+//		"readOnlyPaths": ["/usr", "/lib", "/lib64", "/etc/ssl", "/etc/resolv.conf"],
+//		"seccomp": true,
+//		"seccompDeny": ["personality"]
+//	}
+//
+// Go can not run code between clone and exec, so the namespaces are set up by
+// backend binary itself re-executed as "sandbox-exec" helper, it prepares mounts,
+// drops capabilities and then starts the game as its child. Helper stays PID 1 of
+// the new pid namespace because kernel drops signals without a handler sent to it
+// (the game would ignore SIGTERM), so it forwards SIGTERM and SIGINT to the game,
+// reaps everything reparented to it and exits with exit code of the game
+// (128+signal if the game was killed).
+
+var sandboxDefaultReadOnlyPaths = []string{
+	// the game is dynamically linked and resolves lobby address
+	"/usr", "/lib", "/lib64", "/bin",
+	"/etc/ssl", "/etc/ca-certificates", "/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf",
+	"/etc/ld.so.cache", "/etc/localtime",
+}
+
+var sandboxDefaultSeccompDeny = []string{
+	"ptrace", "process_vm_readv", "process_vm_writev",
+	"mount", "umount2", "pivot_root", "chroot", "unshare", "setns",
+	"kexec_load", "init_module", "finit_module", "delete_module",
+	"bpf", "perf_event_open", "userfaultfd", "open_by_handle_at",
+	"keyctl", "add_key", "request_key",
+	"swapon", "swapoff", "reboot", "acct", "syslog",
+}
+
+// syscall numbers for amd64 and arm64, syscall package lacks many of them
+var sandboxSyscallNumbers = map[string][2]int{
+	"ptrace":            {101, 117},
+	"process_vm_readv":  {310, 270},
+	"process_vm_writev": {311, 271},
+	"mount":             {165, 40},
+	"umount2":           {166, 39},
+	"pivot_root":        {155, 41},
+	"chroot":            {161, 51},
+	"unshare":           {272, 97},
+	"setns":             {308, 268},
+	"kexec_load":        {246, 104},
+	"init_module":       {175, 105},
+	"finit_module":      {313, 273},
+	"delete_module":     {176, 106},
+	"bpf":               {321, 280},
+	"perf_event_open":   {298, 241},
+	"userfaultfd":       {323, 282},
+	"open_by_handle_at": {304, 265},
+	"keyctl":            {250, 219},
+	"add_key":           {248, 217},
+	"request_key":       {249, 218},
+	"swapon":            {167, 224},
+	"swapoff":           {168, 225},
+	"reboot":            {169, 142},
+	"acct":              {163, 89},
+	"syslog":            {103, 116},
+	"personality":       {135, 92},
+	"kill":              {62, 129},
+	"ioperm":            {173, -1},
+	"iopl":              {172, -1},
+}
+
+type sandboxSpec struct {
+	ConfDir     string   `json:"confDir"`
+	Binary      string   `json:"binary"`
+	DataDir     string   `json:"dataDir,omitempty"`
+	ReadOnly    []string `json:"readOnly"`
+	Seccomp     bool     `json:"seccomp"`
+	SeccompDeny []string `json:"seccompDeny,omitempty"`
+}
+
+// sandboxSpecForInstance returns nil if sandbox is not enabled for the instance
+func sandboxSpecForInstance(inst *instance) (*sandboxSpec, error) {
+	if !tryCfgGetD(tryGetBoolGen("sandbox", "enabled"), false, inst.cfgs...) {
+		return nil, nil
+	}
+	confDir, err := filepath.Abs(inst.ConfDir)
+	if err != nil {
+		return nil, err
+	}
+	binary, err := filepath.Abs(inst.BinPath)
+	if err != nil {
+		return nil, err
+	}
+	binary, err = filepath.EvalSymlinks(binary)
+	if err != nil {
+		return nil, err
+	}
+	spec := &sandboxSpec{
+		ConfDir:     confDir,
+		Binary:      binary,
+		DataDir:     tryCfgGetD(tryGetStringGen("sandbox", "dataDir"), "", inst.cfgs...),
+		ReadOnly:    tryCfgGetD(tryGetSliceStringGen("sandbox", "readOnlyPaths"), sandboxDefaultReadOnlyPaths, inst.cfgs...),
+		Seccomp:     tryCfgGetD(tryGetBoolGen("sandbox", "seccomp"), true, inst.cfgs...),
+		SeccompDeny: append([]string{}, sandboxDefaultSeccompDeny...),
+	}
+	extraDeny := tryCfgGetD(tryGetSliceStringGen("sandbox", "seccompDeny"), []string{}, inst.cfgs...)
+	for _, n := range extraDeny {
+		if _, err := sandboxSyscallNumber(n); err != nil {
+			return nil, fmt.Errorf("seccompDeny: %w", err)
+		}
+	}
+	spec.SeccompDeny = append(spec.SeccompDeny, extraDeny...)
+	return spec, nil
+}
+
+// wrap turns game invocation into sandbox-exec helper invocation
+func (spec *sandboxSpec) wrap(args []string, sysattr *syscall.SysProcAttr) (string, []string, error) {
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return "", nil, err
+	}
+	sysattr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	// root inside is our own user outside, needed to set up mounts, capabilities are dropped before exec
+	sysattr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	sysattr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	sysattr.GidMappingsEnableSetgroups = false
+	exe := "/proc/self/exe"
+	return exe, append([]string{exe, "sandbox-exec", string(b), "--"}, args...), nil
+}
+
+func commandSandboxExec(args []string) {
+	// prctl and seccomp are per thread, the game must be started from the same one
+	runtime.LockOSThread()
+	log.SetPrefix("sandbox ")
+	if len(args) < 3 || args[1] != "--" {
+		log.Fatal("Usage: autohoster-backend sandbox-exec <spec> -- <binary> [args...]")
+	}
+	var spec sandboxSpec
+	err := json.Unmarshal([]byte(args[0]), &spec)
+	if err != nil {
+		log.Fatalf("Failed to parse sandbox spec: %s", err)
+	}
+	err = sandboxSetupMounts(spec)
+	if err != nil {
+		log.Fatalf("Failed to set up mounts: %s", err)
+	}
+	err = sandboxDropPrivileges()
+	if err != nil {
+		log.Fatalf("Failed to drop privileges: %s", err)
+	}
+	if spec.Seccomp {
+		err = sandboxInstallSeccomp(spec.SeccompDeny)
+		if err != nil {
+			log.Fatalf("Failed to install seccomp filter: %s", err)
+		}
+	}
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	game, err := os.StartProcess(spec.Binary, args[2:], &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		log.Fatalf("Failed to start %q: %s", spec.Binary, err)
+	}
+	pid := game.Pid
+	// reaping is done below for every child, not only the game
+	game.Release()
+	go func() {
+		for sig := range sigs {
+			err := syscall.Kill(pid, sig.(syscall.Signal))
+			if err != nil && !errors.Is(err, syscall.ESRCH) {
+				log.Printf("Failed to forward %s: %s", sig, err)
+			}
+		}
+	}()
+	os.Exit(sandboxReap(pid))
+}
+
+// sandboxReap waits for all children until the game exits and returns its exit code,
+// everything left in the namespace is killed by the kernel once we exit
+func sandboxReap(pid int) int {
+	for {
+		var ws syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &ws, 0, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to wait4: %s", err)
+			return 1
+		}
+		if wpid != pid || (!ws.Exited() && !ws.Signaled()) {
+			continue
+		}
+		if ws.Signaled() {
+			// re-raising it would be ignored, signals to pid 1 without handler are dropped
+			return 128 + int(ws.Signal())
+		}
+		return ws.ExitStatus()
+	}
+}
+
+// statfs flags that can not be cleared in user namespace remount
+var sandboxLockedFlags = map[int64]uintptr{
+	2:    syscall.MS_NOSUID,
+	4:    syscall.MS_NODEV,
+	8:    syscall.MS_NOEXEC,
+	1024: syscall.MS_NOATIME,
+	2048: syscall.MS_NODIRATIME,
+	4096: syscall.MS_RELATIME,
+}
+
+// sandboxBind mirrors host path into new root, missing sources are skipped
+func sandboxBind(p, newroot string, readonly bool) error {
+	src := path.Join("/oldroot", p)
+	dst := path.Join(newroot, p)
+	fi, err := os.Stat(src)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("binding %q: %w", p, err)
+	}
+	// already visible through parent bind, mounting over it still works on read-only parent
+	if _, err := os.Lstat(dst); err != nil {
+		if fi.IsDir() {
+			err = os.MkdirAll(dst, 0755)
+		} else {
+			err = os.MkdirAll(path.Dir(dst), 0755)
+			if err == nil {
+				err = os.WriteFile(dst, nil, 0644)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("creating mount point for %q: %w", p, err)
+		}
+	}
+	err = syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("binding %q: %w", p, err)
+	}
+	if !readonly {
+		return nil
+	}
+	var st syscall.Statfs_t
+	err = syscall.Statfs(dst, &st)
+	if err != nil {
+		return fmt.Errorf("checking %q flags: %w", p, err)
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for stflag, msflag := range sandboxLockedFlags {
+		if int64(st.Flags)&stflag != 0 {
+			flags |= msflag
+		}
+	}
+	err = syscall.Mount("", dst, "", flags, "")
+	if err != nil {
+		return fmt.Errorf("remounting %q read-only: %w", p, err)
+	}
+	return nil
+}
+
+func sandboxSetupMounts(spec sandboxSpec) error {
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	// host root is parked at /oldroot of a scratch tmpfs while new root is assembled
+	base := "/tmp"
+	err = syscall.Mount("tmpfs", base, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("mounting scratch tmpfs: %w", err)
+	}
+	for _, d := range []string{"oldroot", "newroot"} {
+		err = os.Mkdir(path.Join(base, d), 0755)
+		if err != nil {
+			return fmt.Errorf("creating %s: %w", d, err)
+		}
+	}
+	err = syscall.PivotRoot(base, path.Join(base, "oldroot"))
+	if err != nil {
+		return fmt.Errorf("pivoting to scratch tmpfs: %w", err)
+	}
+	err = syscall.Chdir("/")
+	if err != nil {
+		return fmt.Errorf("entering scratch tmpfs: %w", err)
+	}
+	newroot := "/newroot"
+	err = syscall.Mount(newroot, newroot, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("binding new root: %w", err)
+	}
+
+	// fresh /tmp is mounted first so that binds below it (confdir might be there) stay visible
+	for _, d := range []string{"proc", "dev", "tmp"} {
+		err = os.MkdirAll(path.Join(newroot, d), 0755)
+		if err != nil {
+			return fmt.Errorf("creating %s: %w", d, err)
+		}
+	}
+	err = syscall.Mount("proc", path.Join(newroot, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+	if err != nil {
+		return fmt.Errorf("mounting proc: %w", err)
+	}
+	err = syscall.Mount("tmpfs", path.Join(newroot, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+	if err != nil {
+		return fmt.Errorf("mounting tmp: %w", err)
+	}
+	err = syscall.Mount("tmpfs", path.Join(newroot, "dev"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("mounting dev: %w", err)
+	}
+	for _, d := range []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"} {
+		err = sandboxBind(d, newroot, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range spec.ReadOnly {
+		err = sandboxBind(p, newroot, true)
+		if err != nil {
+			return err
+		}
+	}
+	if spec.DataDir != "" {
+		err = sandboxBind(spec.DataDir, newroot, true)
+		if err != nil {
+			return err
+		}
+	}
+	err = sandboxBind(spec.Binary, newroot, true)
+	if err != nil {
+		return err
+	}
+	err = sandboxBind(spec.ConfDir, newroot, false)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Chdir(newroot)
+	if err != nil {
+		return fmt.Errorf("entering new root: %w", err)
+	}
+	err = syscall.PivotRoot(".", ".")
+	if err != nil {
+		return fmt.Errorf("pivoting to new root: %w", err)
+	}
+	err = syscall.Unmount(".", syscall.MNT_DETACH)
+	if err != nil {
+		return fmt.Errorf("detaching old root: %w", err)
+	}
+	err = syscall.Chdir(spec.ConfDir)
+	if err != nil {
+		return fmt.Errorf("entering confdir: %w", err)
+	}
+	return nil
+}
+
+const (
+	sandboxPrSetNoNewPrivs = 38
+	sandboxPrCapbsetDrop   = 24
+	sandboxPrCapAmbient    = 47
+	sandboxPrSetSeccomp    = 22
+)
+
+func sandboxPrctl(option, arg2, arg3 uintptr) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg2, arg3, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// sandboxDropPrivileges empties bounding and ambient sets so exec of the game
+// (uid 0 inside the namespace) gains no capabilities
+func sandboxDropPrivileges() error {
+	for c := uintptr(0); c < 64; c++ {
+		err := sandboxPrctl(sandboxPrCapbsetDrop, c, 0)
+		if errors.Is(err, syscall.EINVAL) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("dropping capability %d: %w", c, err)
+		}
+	}
+	err := sandboxPrctl(sandboxPrCapAmbient, 4, 0) // PR_CAP_AMBIENT_CLEAR_ALL
+	if err != nil && !errors.Is(err, syscall.EINVAL) {
+		return fmt.Errorf("clearing ambient capabilities: %w", err)
+	}
+	return sandboxPrctl(sandboxPrSetNoNewPrivs, 1, 0)
+}
+
+const (
+	sandboxSeccompRetKill  = 0x80000000
+	sandboxSeccompRetErrno = 0x00050000
+	sandboxSeccompRetAllow = 0x7fff0000
+	sandboxBpfLdWAbs       = 0x20
+	sandboxBpfJeqK         = 0x15
+	sandboxBpfJgeK         = 0x35
+	sandboxBpfRetK         = 0x06
+)
+
+func sandboxSyscallNumber(name string) (uint32, error) {
+	nrs, ok := sandboxSyscallNumbers[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown syscall %q", name)
+	}
+	nr := -1
+	switch runtime.GOARCH {
+	case "amd64":
+		nr = nrs[0]
+	case "arm64":
+		nr = nrs[1]
+	}
+	if nr < 0 {
+		return 0, fmt.Errorf("syscall %q is not available on %s", name, runtime.GOARCH)
+	}
+	return uint32(nr), nil
+}
+
+func sandboxAuditArch() (uint32, error) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return 0xc000003e, nil
+	case "arm64":
+		return 0xc00000b7, nil
+	}
+	return 0, fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+}
+
+// sandboxInstallSeccomp loads filter failing denied syscalls with EPERM
+func sandboxInstallSeccomp(deny []string) error {
+	arch, err := sandboxAuditArch()
+	if err != nil {
+		return err
+	}
+	eperm := uint32(sandboxSeccompRetErrno | uint32(syscall.EPERM))
+	prog := []syscall.SockFilter{
+		{Code: sandboxBpfLdWAbs, K: 4}, // seccomp_data.arch
+		{Code: sandboxBpfJeqK, Jt: 1, K: arch},
+		{Code: sandboxBpfRetK, K: sandboxSeccompRetKill},
+		{Code: sandboxBpfLdWAbs, K: 0}, // seccomp_data.nr
+	}
+	if runtime.GOARCH == "amd64" {
+		// x32 abi shares the arch value, deny it altogether
+		prog = append(prog,
+			syscall.SockFilter{Code: sandboxBpfJgeK, Jf: 1, K: 0x40000000},
+			syscall.SockFilter{Code: sandboxBpfRetK, K: eperm})
+	}
+	for _, name := range removeDuplicate(deny) {
+		nr, err := sandboxSyscallNumber(name)
+		if err != nil {
+			return err
+		}
+		prog = append(prog,
+			syscall.SockFilter{Code: sandboxBpfJeqK, Jf: 1, K: nr},
+			syscall.SockFilter{Code: sandboxBpfRetK, K: eperm})
+	}
+	prog = append(prog, syscall.SockFilter{Code: sandboxBpfRetK, K: sandboxSeccompRetAllow})
+	fprog := syscall.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	}
+	err = sandboxPrctl(sandboxPrSetSeccomp, 2, uintptr(unsafe.Pointer(&fprog))) // SECCOMP_MODE_FILTER
+	runtime.KeepAlive(prog)
+	return err
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSandboxReap(t *testing.T) {
+	for _, tc := range []struct {
+		script string
+		want   int
+	}{
+		{"exit 0", 0},
+		{"exit 5", 5},
+		{"kill -TERM $$", 128 + 15},
+	} {
+		pr, err := os.StartProcess("/bin/sh", []string{"sh", "-c", tc.script}, &os.ProcAttr{})
+		if err != nil {
+			t.Skipf("can not start shell: %s", err)
+		}
+		pid := pr.Pid
+		pr.Release()
+		if got := sandboxReap(pid); got != tc.want {
+			t.Errorf("%q: got exit code %d, want %d", tc.script, got, tc.want)
+		}
+	}
+}
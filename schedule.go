@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// queue schedule is declared as
+//
+//	"schedule": {
+//		"timezone": "UTC",
+//		"windows": [
+//			{"days": ["sat", "sun"], "from": "18:00", "to": "23:00"},
+//			{"dateFrom": "2024-10-20", "dateTo": "2024-10-27", "from": "20:00", "to": "02:00"}
+//		]
+//	}
+//
+// window with "to" earlier than "from" spans over midnight, omitted days or dates match any,
+// queue without schedule is always active
+
+type scheduleWindow struct {
+	days     []time.Weekday
+	dateFrom string
+	dateTo   string
+	from     int
+	to       int
+}
+
+var scheduleWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseScheduleClock(s string) (int, error) {
+	var h, m int
+	n, err := fmt.Sscanf(s, "%d:%d", &h, &m)
+	if err != nil || n != 2 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	if h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("time %q out of range", s)
+	}
+	return h*60 + m, nil
+}
+
+func parseScheduleWindow(v any) (w scheduleWindow, err error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return w, errors.New("window is not an object")
+	}
+	if days, ok := m["days"].([]any); ok {
+		for _, d := range days {
+			ds, _ := d.(string)
+			wd, ok := scheduleWeekdays[strings.ToLower(ds)]
+			if !ok {
+				return w, fmt.Errorf("unknown weekday %v", d)
+			}
+			w.days = append(w.days, wd)
+		}
+	}
+	for _, k := range []string{"dateFrom", "dateTo"} {
+		ds, ok := m[k].(string)
+		if !ok {
+			continue
+		}
+		_, err = time.Parse(time.DateOnly, ds)
+		if err != nil {
+			return w, fmt.Errorf("invalid %s: %w", k, err)
+		}
+		if k == "dateFrom" {
+			w.dateFrom = ds
+		} else {
+			w.dateTo = ds
+		}
+	}
+	from, _ := m["from"].(string)
+	to, _ := m["to"].(string)
+	if from == "" {
+		from = "00:00"
+	}
+	if to == "" {
+		to = "24:00"
+	}
+	w.from, err = parseScheduleClock(from)
+	if err != nil {
+		return
+	}
+	w.to, err = parseScheduleClock(to)
+	return
+}
+
+// matchesDay checks if window starting at given local day applies
+func (w scheduleWindow) matchesDay(t time.Time) bool {
+	if len(w.days) > 0 {
+		found := false
+		for _, d := range w.days {
+			if d == t.Weekday() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	date := t.Format(time.DateOnly)
+	if w.dateFrom != "" && date < w.dateFrom {
+		return false
+	}
+	if w.dateTo != "" && date > w.dateTo {
+		return false
+	}
+	return true
+}
+
+func (w scheduleWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return minute >= w.from && minute < w.to && w.matchesDay(t)
+	}
+	// spans over midnight, evening part belongs to today, morning part to yesterday
+	if minute >= w.from {
+		return w.matchesDay(t)
+	}
+	if minute < w.to {
+		return w.matchesDay(t.AddDate(0, 0, -1))
+	}
+	return false
+}
+
+func queueScheduleActive(queueName string, now time.Time) (bool, error) {
+	if _, ok := cfg.Get("queues", queueName, "schedule"); !ok {
+		return true, nil
+	}
+	loc, err := time.LoadLocation(cfg.GetDSString("UTC", "queues", queueName, "schedule", "timezone"))
+	if err != nil {
+		return false, err
+	}
+	windowsA, ok := cfg.Get("queues", queueName, "schedule", "windows")
+	if !ok {
+		return false, errors.New("schedule has no windows")
+	}
+	windows, ok := windowsA.([]any)
+	if !ok {
+		return false, errors.New("schedule windows is not an array")
+	}
+	local := now.In(loc)
+	for i, v := range windows {
+		w, err := parseScheduleWindow(v)
+		if err != nil {
+			return false, fmt.Errorf("window %d: %w", i, err)
+		}
+		if w.contains(local) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// shutdownUnscheduledQueues stops lobby rooms of queues that are out of their schedule,
+// rooms where somebody already joined are left alone
+func shutdownUnscheduledQueues() {
+	queuesK, ok := cfg.GetKeys("queues")
+	if !ok {
+		return
+	}
+	now := time.Now()
+	for _, queueName := range queuesK {
+		active, err := queueScheduleActive(queueName, now)
+		if err != nil {
+			log.Printf("Queue %q has invalid schedule: %s", queueName, err.Error())
+			continue
+		}
+		if active {
+			continue
+		}
+		instancesLock.Lock()
+		for _, inst := range instances {
+			if inst.QueueName != queueName {
+				continue
+			}
+			st := instanceState(inst.state.Load())
+			if st != instanceStateStarting && st != instanceStateInLobby {
+				continue
+			}
+			if inst.joinCount.Load() > 0 {
+				continue
+			}
+			if inst.scheduleShutdownSent {
+				continue
+			}
+			log.Printf("Queue %q is out of schedule, shutting down empty room %d", queueName, inst.Id)
+			select {
+			case inst.commands <- instanceCommand{command: icShutdown}:
+				inst.scheduleShutdownSent = true
+			default:
+			}
+		}
+		instancesLock.Unlock()
+	}
+}
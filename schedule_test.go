@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func testScheduleWindow(t *testing.T, s string) scheduleWindow {
+	t.Helper()
+	var v any
+	err := json.Unmarshal([]byte(s), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := parseScheduleWindow(v)
+	if err != nil {
+		t.Fatalf("parsing %s: %s", s, err)
+	}
+	return w
+}
+
+func testLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("no timezone data for %s: %s", name, err)
+	}
+	return loc
+}
+
+func TestParseScheduleWindowErrors(t *testing.T) {
+	for _, s := range []string{
+		`"18:00"`,
+		`{"days": ["saturday"]}`,
+		`{"days": [1]}`,
+		`{"dateFrom": "2024-13-01"}`,
+		`{"dateTo": "20.10.2024"}`,
+		`{"from": "25:00"}`,
+		`{"from": "12:60"}`,
+		`{"to": "24:01"}`,
+		`{"from": "noon"}`,
+	} {
+		var v any
+		err := json.Unmarshal([]byte(s), &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = parseScheduleWindow(v)
+		if err == nil {
+			t.Errorf("window %s parsed without error", s)
+		}
+	}
+}
+
+func TestScheduleWindowContains(t *testing.T) {
+	utc := time.UTC
+	berlin := testLoadLocation(t, "Europe/Berlin")
+	auckland := testLoadLocation(t, "Pacific/Auckland")
+	at := func(s string) time.Time {
+		r, err := time.Parse(time.DateTime, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	for _, tc := range []struct {
+		name   string
+		window string
+		now    time.Time
+		loc    *time.Location
+		want   bool
+	}{
+		{"whole day by default", `{}`, at("2024-10-23 00:00:00"), utc, true},
+		{"end is exclusive", `{"from": "18:00", "to": "23:00"}`, at("2024-10-23 23:00:00"), utc, false},
+		{"start is inclusive", `{"from": "18:00", "to": "23:00"}`, at("2024-10-23 18:00:00"), utc, true},
+		{"weekday matches", `{"days": ["sat", "sun"], "from": "18:00", "to": "23:00"}`, at("2024-10-26 20:00:00"), utc, true},
+		{"weekday does not match", `{"days": ["sat", "sun"], "from": "18:00", "to": "23:00"}`, at("2024-10-25 20:00:00"), utc, false},
+		{"weekday is case insensitive", `{"days": ["SAT"]}`, at("2024-10-26 20:00:00"), utc, true},
+
+		{"midnight evening part", `{"days": ["sat"], "from": "22:00", "to": "02:00"}`, at("2024-10-26 23:30:00"), utc, true},
+		{"midnight morning part belongs to previous day", `{"days": ["sat"], "from": "22:00", "to": "02:00"}`, at("2024-10-27 01:30:00"), utc, true},
+		{"midnight morning part of wrong day", `{"days": ["sat"], "from": "22:00", "to": "02:00"}`, at("2024-10-26 01:30:00"), utc, false},
+		{"midnight evening part of wrong day", `{"days": ["sat"], "from": "22:00", "to": "02:00"}`, at("2024-10-27 23:30:00"), utc, false},
+		{"midnight gap", `{"from": "22:00", "to": "02:00"}`, at("2024-10-27 12:00:00"), utc, false},
+		{"midnight end is exclusive", `{"from": "22:00", "to": "02:00"}`, at("2024-10-27 02:00:00"), utc, false},
+
+		{"before dateFrom", `{"dateFrom": "2024-10-20", "dateTo": "2024-10-27"}`, at("2024-10-19 12:00:00"), utc, false},
+		{"on dateFrom", `{"dateFrom": "2024-10-20", "dateTo": "2024-10-27"}`, at("2024-10-20 00:00:00"), utc, true},
+		{"on dateTo", `{"dateFrom": "2024-10-20", "dateTo": "2024-10-27"}`, at("2024-10-27 23:59:00"), utc, true},
+		{"after dateTo", `{"dateFrom": "2024-10-20", "dateTo": "2024-10-27"}`, at("2024-10-28 00:00:00"), utc, false},
+		{"morning after dateTo belongs to last day", `{"dateFrom": "2024-10-20", "dateTo": "2024-10-27", "from": "20:00", "to": "02:00"}`, at("2024-10-28 01:00:00"), utc, true},
+		{"morning of dateFrom belongs to day before", `{"dateFrom": "2024-10-20", "dateTo": "2024-10-27", "from": "20:00", "to": "02:00"}`, at("2024-10-20 01:00:00"), utc, false},
+
+		// friday 22:30 UTC is saturday 10:30 in Auckland (NZST, +12)
+		{"weekday in timezone ahead", `{"days": ["sat"], "from": "10:00", "to": "12:00"}`, at("2024-06-14 22:30:00"), auckland, true},
+		{"same instant in UTC", `{"days": ["sat"], "from": "10:00", "to": "12:00"}`, at("2024-06-14 22:30:00"), utc, false},
+
+		// Berlin switches from CET (+1) to CEST (+2) on 2024-03-31 01:00 UTC
+		{"local time before DST", `{"from": "18:00", "to": "23:00"}`, at("2024-03-30 17:30:00"), berlin, true},
+		{"local time after DST", `{"from": "18:00", "to": "23:00"}`, at("2024-03-31 16:30:00"), berlin, true},
+		{"same UTC clock after DST is later locally", `{"from": "18:00", "to": "23:00"}`, at("2024-03-31 21:30:00"), berlin, false},
+		{"skipped hour never matches, before", `{"from": "02:00", "to": "03:00"}`, at("2024-03-31 00:59:00"), berlin, false},
+		{"skipped hour never matches, after", `{"from": "02:00", "to": "03:00"}`, at("2024-03-31 01:00:00"), berlin, false},
+		// back to CET on 2024-10-27 01:00 UTC, 02:30 local happens twice
+		{"repeated hour first pass", `{"from": "02:00", "to": "03:00"}`, at("2024-10-27 00:30:00"), berlin, true},
+		{"repeated hour second pass", `{"from": "02:00", "to": "03:00"}`, at("2024-10-27 01:30:00"), berlin, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := testScheduleWindow(t, tc.window)
+			got := w.contains(tc.now.In(tc.loc))
+			if got != tc.want {
+				t.Errorf("window %s at %s: got %v, want %v", tc.window, tc.now.In(tc.loc), got, tc.want)
+			}
+		})
+	}
+}
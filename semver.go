@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// minimal semver for picking binaries, constraints are npm-like:
+// "4.5.0", "=4.5.0", ">=4.4.0 <4.6.0", "^4.5", "~4.5.1", "4.5.x", "4.4.x || 4.5.x"
+// prereleases are only matched by comparators that mention a prerelease themselves
+
+type semver struct {
+	major, minor, patch int
+	pre                 string
+}
+
+func parseSemver(s string) (semver, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	s, _, _ = strings.Cut(s, "+")
+	var v semver
+	core, pre, _ := strings.Cut(s, "-")
+	v.pre = pre
+	parts := strings.Split(core, ".")
+	if len(parts) != 3 {
+		return v, fmt.Errorf("version %q is not major.minor.patch", s)
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("version %q has invalid number %q", s, p)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+func (v semver) String() string {
+	if v.pre != "" {
+		return fmt.Sprintf("%d.%d.%d-%s", v.major, v.minor, v.patch, v.pre)
+	}
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+func comparePrerelease(a, b string) int {
+	if a == b {
+		return 0
+	}
+	// release is above any of its prereleases
+	if a == "" {
+		return 1
+	}
+	if b == "" {
+		return -1
+	}
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				return cmpInt(an, bn)
+			}
+		case aerr == nil:
+			return -1
+		case berr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return cmpInt(len(as), len(bs))
+}
+
+func cmpInt(a, b int) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func (v semver) compare(o semver) int {
+	if c := cmpInt(v.major, o.major); c != 0 {
+		return c
+	}
+	if c := cmpInt(v.minor, o.minor); c != 0 {
+		return c
+	}
+	if c := cmpInt(v.patch, o.patch); c != 0 {
+		return c
+	}
+	return comparePrerelease(v.pre, o.pre)
+}
+
+type semverComparator struct {
+	op string
+	v  semver
+}
+
+func (c semverComparator) matches(v semver) bool {
+	r := v.compare(c.v)
+	switch c.op {
+	case "=":
+		return r == 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	}
+	return false
+}
+
+// semverConstraint is OR of AND-ed comparator sets
+type semverConstraint [][]semverComparator
+
+// parsePartial handles "4", "4.5", "4.5.x", "4.5.1" returning number of fixed parts
+func parsePartialSemver(s string) (semver, int, error) {
+	s = strings.TrimPrefix(s, "v")
+	core, pre, _ := strings.Cut(s, "-")
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return semver{}, 0, fmt.Errorf("invalid version %q", s)
+	}
+	v := semver{pre: pre}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	fixed := 0
+	for i, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			break
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, 0, fmt.Errorf("invalid version %q", s)
+		}
+		*nums[i] = n
+		fixed++
+	}
+	if pre != "" && fixed != 3 {
+		return v, 0, fmt.Errorf("prerelease needs full version in %q", s)
+	}
+	return v, fixed, nil
+}
+
+func expandSemverComparator(s string) ([]semverComparator, error) {
+	op := ""
+	for _, p := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(s, p) {
+			op = p
+			s = strings.TrimSpace(strings.TrimPrefix(s, p))
+			break
+		}
+	}
+	if s == "*" || s == "x" {
+		return []semverComparator{{op: ">=", v: semver{}}}, nil
+	}
+	v, fixed, err := parsePartialSemver(s)
+	if err != nil {
+		return nil, err
+	}
+	if fixed == 0 {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+	// upper bound of x-range, "4.5" -> 4.6.0-0
+	next := func(level int) semver {
+		switch level {
+		case 1:
+			return semver{major: v.major + 1, pre: "0"}
+		case 2:
+			return semver{major: v.major, minor: v.minor + 1, pre: "0"}
+		}
+		return semver{major: v.major, minor: v.minor, patch: v.patch + 1, pre: "0"}
+	}
+	switch op {
+	case "", "=":
+		if fixed == 3 {
+			return []semverComparator{{"=", v}}, nil
+		}
+		return []semverComparator{{">=", v}, {"<", next(fixed)}}, nil
+	case "^":
+		switch {
+		case v.major > 0 || fixed == 1:
+			return []semverComparator{{">=", v}, {"<", next(1)}}, nil
+		case v.minor > 0 || fixed == 2:
+			return []semverComparator{{">=", v}, {"<", next(2)}}, nil
+		}
+		return []semverComparator{{">=", v}, {"<", next(3)}}, nil
+	case "~":
+		if fixed == 1 {
+			return []semverComparator{{">=", v}, {"<", next(1)}}, nil
+		}
+		return []semverComparator{{">=", v}, {"<", next(2)}}, nil
+	case ">":
+		if fixed < 3 {
+			return []semverComparator{{">=", next(fixed)}}, nil
+		}
+		return []semverComparator{{">", v}}, nil
+	case "<=":
+		if fixed < 3 {
+			return []semverComparator{{"<", next(fixed)}}, nil
+		}
+		return []semverComparator{{"<=", v}}, nil
+	}
+	return []semverComparator{{op, v}}, nil
+}
+
+func parseSemverConstraint(s string) (semverConstraint, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, errors.New("empty constraint")
+	}
+	ret := semverConstraint{}
+	for _, alt := range strings.Split(s, "||") {
+		set := []semverComparator{}
+		fields := strings.Fields(alt)
+		// allow ">= 4.5.0" with space after operator
+		for i := 0; i < len(fields); i++ {
+			f := fields[i]
+			if strings.Trim(f, "<>=^~") == "" && i+1 < len(fields) {
+				f += fields[i+1]
+				i++
+			}
+			cs, err := expandSemverComparator(f)
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, cs...)
+		}
+		if len(set) == 0 {
+			return nil, fmt.Errorf("empty alternative in %q", s)
+		}
+		ret = append(ret, set)
+	}
+	return ret, nil
+}
+
+func (c semverConstraint) matches(v semver) bool {
+	for _, set := range c {
+		ok := true
+		allowPre := v.pre == ""
+		for _, cmp := range set {
+			if !cmp.matches(v) {
+				ok = false
+				break
+			}
+			if cmp.v.pre != "" && cmp.v.pre != "0" && cmp.v.major == v.major && cmp.v.minor == v.minor && cmp.v.patch == v.patch {
+				allowPre = true
+			}
+		}
+		if ok && allowPre {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package main
+
+import "testing"
+
+func TestParseSemver(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: "4.5.0", want: "4.5.0"},
+		{in: "v4.5.1", want: "4.5.1"},
+		{in: " 4.5.1 ", want: "4.5.1"},
+		{in: "4.6.0-beta1", want: "4.6.0-beta1"},
+		{in: "4.6.0-rc.2+build.5", want: "4.6.0-rc.2"},
+		{in: "4.5", err: true},
+		{in: "4.5.0.1", err: true},
+		{in: "4.x.0", err: true},
+		{in: "4.-1.0", err: true},
+		{in: "master", err: true},
+	} {
+		v, err := parseSemver(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseSemver(%q) = %s, want error", tc.in, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSemver(%q): %s", tc.in, err)
+			continue
+		}
+		if v.String() != tc.want {
+			t.Errorf("parseSemver(%q) = %s, want %s", tc.in, v, tc.want)
+		}
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	// every version is lower than the next one
+	ordered := []string{
+		"1.0.0-1",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.2.0",
+		"1.10.0",
+		"2.0.0",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			a, _ := parseSemver(ordered[i])
+			b, _ := parseSemver(ordered[j])
+			if got, want := a.compare(b), cmpInt(i, j); got != want {
+				t.Errorf("compare(%s, %s) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestSemverConstraint(t *testing.T) {
+	for _, tc := range []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{"4.5.0", "4.5.0", true},
+		{"4.5.0", "4.5.1", false},
+		{"=4.5.0", "4.5.0", true},
+		{"4.5", "4.5.9", true},
+		{"4.5", "4.6.0", false},
+		{"4.5.x", "4.5.3", true},
+		{"4.5.x", "4.6.0", false},
+		{"4", "4.9.9", true},
+		{"*", "1.0.0", true},
+
+		{">=4.4.0 <4.6.0", "4.5.1", true},
+		{">=4.4.0 <4.6.0", "4.6.0", false},
+		{">=4.4.0 <4.6.0", "4.3.9", false},
+		{">= 4.4.0 < 4.6.0", "4.4.0", true},
+		{">4.5.0", "4.5.0", false},
+		{">4.5.0", "4.5.1", true},
+		{">4.5", "4.5.9", false},
+		{">4.5", "4.6.0", true},
+		{"<=4.5", "4.5.9", true},
+		{"<=4.5", "4.6.0", false},
+		{"<4.5.0", "4.4.9", true},
+
+		{"^4.5", "4.5.0", true},
+		{"^4.5", "4.9.0", true},
+		{"^4.5", "5.0.0", false},
+		{"^4.5", "4.4.9", false},
+		{"^4.5.2", "4.5.1", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.3", true},
+		{"^0.0.3", "0.0.4", false},
+		{"^0", "0.9.9", true},
+		{"^0", "1.0.0", false},
+		{"~4.5.1", "4.5.9", true},
+		{"~4.5.1", "4.5.0", false},
+		{"~4.5.1", "4.6.0", false},
+		{"~4.5", "4.5.0", true},
+		{"~4", "4.9.0", true},
+		{"~4", "5.0.0", false},
+
+		{"4.4.x || 4.5.x", "4.4.3", true},
+		{"4.4.x || 4.5.x", "4.5.0", true},
+		{"4.4.x || 4.5.x", "4.6.0", false},
+		{"<4.0.0 || >=4.5.0 <4.6.0", "3.2.0", true},
+		{"<4.0.0 || >=4.5.0 <4.6.0", "4.2.0", false},
+
+		// prereleases only match comparators mentioning a prerelease of the same version
+		{"^4.5", "4.6.0-beta1", false},
+		{"4.6.x", "4.6.0-beta1", false},
+		{"*", "4.6.0-beta1", false},
+		{"<4.6.0", "4.6.0-beta1", false},
+		{"=4.6.0-beta1", "4.6.0-beta1", true},
+		{">=4.6.0-beta1", "4.6.0-beta2", true},
+		{">=4.6.0-beta1", "4.6.0-rc1", true},
+		{">=4.6.0-beta1", "4.6.0-alpha1", false},
+		{">=4.6.0-beta1", "4.6.0", true},
+		{">=4.6.0-beta1", "4.7.0-beta1", false},
+		{">=4.6.0-beta1 <4.7.0", "4.6.1", true},
+	} {
+		c, err := parseSemverConstraint(tc.constraint)
+		if err != nil {
+			t.Errorf("parseSemverConstraint(%q): %s", tc.constraint, err)
+			continue
+		}
+		v, err := parseSemver(tc.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.matches(v); got != tc.want {
+			t.Errorf("%q matches %s = %v, want %v", tc.constraint, tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestSemverConstraintErrors(t *testing.T) {
+	for _, s := range []string{"", "   ", "^", "||", "4.5 ||", "4.5.0.1", "abc", "4.5-beta", ">=x.5"} {
+		_, err := parseSemverConstraint(s)
+		if err == nil {
+			t.Errorf("parseSemverConstraint(%q) accepted", s)
+		}
+	}
+}
+
+func TestBinaryPick(t *testing.T) {
+	binariesLock.Lock()
+	prev := binaries
+	binaries = map[string]*binaryInfo{
+		"4.4.2":       {Label: "4.4.2", Path: "/bin/wz-4.4.2"},
+		"4.5.0":       {Label: "4.5.0", Path: "/bin/wz-4.5.0"},
+		"4.5.1":       {Label: "4.5.1", Path: "/bin/wz-4.5.1"},
+		"4.5.2":       {Label: "4.5.2", Path: "/bin/wz-4.5.2", Error: "checksum mismatch"},
+		"4.6.0-beta1": {Label: "4.6.0-beta1", Path: "/bin/wz-4.6.0-beta1"},
+		"master":      {Label: "master", Path: "/bin/wz-master"},
+	}
+	binariesLock.Unlock()
+	t.Cleanup(func() {
+		binariesLock.Lock()
+		binaries = prev
+		binariesLock.Unlock()
+	})
+	for _, tc := range []struct {
+		spec string
+		want string
+	}{
+		{"master", "master"},
+		{"4.4.2", "4.4.2"},
+		{"^4.4", "4.5.1"},
+		{"4.5.x", "4.5.1"},
+		{"~4.4.0", "4.4.2"},
+		{"<4.5.1", "4.5.0"},
+		{">=4.6.0-beta1", "4.6.0-beta1"},
+		{"*", "4.5.1"},
+		// broken or missing binaries and no matches are errors
+		{"4.5.2", ""},
+		{"^5", ""},
+		{"4.7.x", ""},
+		{"nightly", ""},
+	} {
+		bi, err := binaryPick(tc.spec)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("binaryPick(%q) = %s, want error", tc.spec, bi.Label)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("binaryPick(%q): %s", tc.spec, err)
+			continue
+		}
+		if bi.Label != tc.want {
+			t.Errorf("binaryPick(%q) = %s, want %s", tc.spec, bi.Label, tc.want)
+		}
+	}
+}
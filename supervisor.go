@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// supervisor owns the game process: stdio through named pipes in the confdir
+// (so backend restart does not take the game down), liveness, exit status and termination.
+//
+// Processes started by us are reaped with wait4 and get exit code and rusage collected.
+// Re-attached processes are polled: after handoff re-exec they are still our children
+// and get reaped with non-blocking wait4 (exit status known), after a real backend
+// restart they are not so only procfs liveness is checked and exit status is unknown.
+
+type supervisorExit struct {
+	Code     int     `json:"code"`
+	Signal   string  `json:"signal,omitempty"`
+	UserTime float64 `json:"userTimeSeconds"`
+	SysTime  float64 `json:"sysTimeSeconds"`
+	MaxRSS   int64   `json:"maxRssKb"`
+}
+
+func (e *supervisorExit) String() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("killed by %s (user %.1fs sys %.1fs maxrss %dKb)", e.Signal, e.UserTime, e.SysTime, e.MaxRSS)
+	}
+	return fmt.Sprintf("exit code %d (user %.1fs sys %.1fs maxrss %dKb)", e.Code, e.UserTime, e.SysTime, e.MaxRSS)
+}
+
+// supervisorSpawnOpts are extra knobs for starting the process
+type supervisorSpawnOpts struct {
+	// CgroupPath places the process into cgroup v2 directory right at clone
+	CgroupPath string
+	// Sandbox runs the process in namespaces through sandbox-exec helper
+	Sandbox *sandboxSpec
+}
+
+type supervisor struct {
+	Pid       int
+	confDir   string
+	logger    *log.Logger
+	attached  bool
+	stdin     *os.File
+	stdout    *os.File
+	stderr    *os.File
+	writeLock sync.Mutex
+	lines     chan string
+	done      chan struct{}
+	exit      *supervisorExit
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func newSupervisor(confDir string, logger *log.Logger) *supervisor {
+	return &supervisor{
+		confDir: confDir,
+		logger:  logger,
+		lines:   make(chan string, 64),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+}
+
+// supervisorStart spawns binary in its own session with stdio connected to confdir pipes
+func supervisorStart(confDir, binPath string, args []string, opts supervisorSpawnOpts, logger *log.Logger) (*supervisor, error) {
+	sv := newSupervisor(confDir, logger)
+	sysattr := &syscall.SysProcAttr{
+		Setsid: true,  // without it ctrl+c will be sent to wz
+		Noctty: false, // if enabled it will fail with fork/exec : inappropriate ioctl for device
+	}
+	if opts.CgroupPath != "" {
+		cgdir, err := os.Open(opts.CgroupPath)
+		if err != nil {
+			return nil, fmt.Errorf("opening cgroup: %w", err)
+		}
+		defer cgdir.Close()
+		sysattr.UseCgroupFD = true
+		sysattr.CgroupFD = int(cgdir.Fd())
+	}
+	startPath, startArgs := binPath, args
+	if opts.Sandbox != nil {
+		var err error
+		startPath, startArgs, err = opts.Sandbox.wrap(args, sysattr)
+		if err != nil {
+			return nil, fmt.Errorf("preparing sandbox: %w", err)
+		}
+	}
+	err := sv.createPipes()
+	if err != nil {
+		return nil, fmt.Errorf("creating pipes: %w", err)
+	}
+	pr, err := os.StartProcess(startPath, startArgs, &os.ProcAttr{
+		Dir: confDir,
+		Files: []*os.File{
+			sv.stdin,
+			sv.stdout,
+			sv.stderr,
+		},
+		Sys: sysattr,
+	})
+	if err != nil {
+		sv.closePipes()
+		return nil, err
+	}
+	sv.Pid = pr.Pid
+	// reaping is done by us with wait4 to get rusage
+	pr.Release()
+	go sv.reap()
+
+	err = os.WriteFile(path.Join(confDir, "cmdline"), append([]byte(strings.Join(args, "\x00")), 0), 0644)
+	if err != nil {
+		logger.Println("Error writing cmdline file:", err)
+	}
+	err = os.WriteFile(path.Join(confDir, "pid"), []byte(fmt.Sprint(sv.Pid)), 0644)
+	if err != nil {
+		logger.Println("Error writing pid file:", err)
+	}
+	logger.Printf("Started with pid %d", sv.Pid)
+
+	logger.Println("Reopening pipes...")
+	sv.closePipes()
+	err = sv.openPipes()
+	if err != nil {
+		logger.Println("Error reopening pipes:", err)
+	}
+	sv.startReaders()
+	return sv, nil
+}
+
+// supervisorAttach takes over process left running by previous backend instance
+func supervisorAttach(confDir string, pid int, logger *log.Logger) (*supervisor, error) {
+	sv := newSupervisor(confDir, logger)
+	sv.Pid = pid
+	sv.attached = true
+	err := sv.openPipes()
+	if err != nil {
+		return nil, err
+	}
+	go sv.poll()
+	sv.startReaders()
+	return sv, nil
+}
+
+func (sv *supervisor) createPipes() error {
+	var err error
+	sv.stdin, err = createOpenPipe(path.Join(sv.confDir, "stdin.pipe"), os.O_RDWR)
+	if err != nil {
+		sv.logger.Printf("Error opening stdin pipe: %s", err.Error())
+		return err
+	}
+	sv.stdout, err = createOpenPipe(path.Join(sv.confDir, "stdout.pipe"), os.O_RDWR)
+	if err != nil {
+		sv.logger.Printf("Error opening stdout pipe: %s", err.Error())
+		return err
+	}
+	sv.stderr, err = createOpenPipe(path.Join(sv.confDir, "stderr.pipe"), os.O_RDWR)
+	if err != nil {
+		sv.logger.Printf("Error opening stderr pipe: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (sv *supervisor) openPipes() error {
+	var err error
+	sv.stdin, err = os.OpenFile(path.Join(sv.confDir, "stdin.pipe"), os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		sv.logger.Printf("Error opening stdin pipe: %s", err.Error())
+		return err
+	}
+	sv.stdout, err = os.OpenFile(path.Join(sv.confDir, "stdout.pipe"), os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		sv.logger.Printf("Error opening stdout pipe: %s", err.Error())
+		return err
+	}
+	sv.stderr, err = os.OpenFile(path.Join(sv.confDir, "stderr.pipe"), os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		sv.logger.Printf("Error opening stderr pipe: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (sv *supervisor) closePipes() {
+	for _, f := range []*os.File{sv.stdin, sv.stdout, sv.stderr} {
+		if f == nil {
+			continue
+		}
+		err := f.SetDeadline(time.Now().Add(1 * time.Second))
+		if err != nil {
+			sv.logger.Printf("Failed to set deadline for %s: %s", path.Base(f.Name()), err)
+		}
+		err = f.Close()
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			sv.logger.Printf("Failed to close %s: %s", path.Base(f.Name()), err)
+		}
+	}
+}
+
+func (sv *supervisor) startReaders() {
+	for _, f := range []*os.File{sv.stdout, sv.stderr} {
+		sv.wg.Add(1)
+		go func(f *os.File) {
+			defer sv.wg.Done()
+
+			bufSize := 1024 * 1024 * 64
+			buf := make([]byte, bufSize)
+
+			s := bufio.NewScanner(f)
+			s.Buffer(buf, bufSize)
+			for s.Scan() {
+				select {
+				case sv.lines <- s.Text():
+				case <-sv.closing:
+					return
+				}
+			}
+			if s.Err() != nil && !errors.Is(s.Err(), os.ErrClosed) {
+				sv.logger.Printf("%s scanner exited with error %s", path.Base(f.Name()), s.Err().Error())
+			}
+		}(f)
+	}
+}
+
+func (sv *supervisor) reap() {
+	var ws syscall.WaitStatus
+	var ru syscall.Rusage
+	for {
+		wpid, err := syscall.Wait4(sv.Pid, &ws, 0, &ru)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			sv.logger.Println("Failed to wait4:", err)
+			break
+		}
+		if wpid != sv.Pid {
+			sv.logger.Printf("wait4 returned wrong pid_t, got %d but called for pid %d!", wpid, sv.Pid)
+			continue
+		}
+		if !ws.Exited() && !ws.Signaled() {
+			continue
+		}
+		sv.exit = newSupervisorExit(ws, ru)
+		break
+	}
+	sv.logger.Printf("pid %d closed", sv.Pid)
+	close(sv.done)
+}
+
+func newSupervisorExit(ws syscall.WaitStatus, ru syscall.Rusage) *supervisorExit {
+	e := &supervisorExit{
+		Code:     ws.ExitStatus(),
+		UserTime: time.Duration(ru.Utime.Nano()).Seconds(),
+		SysTime:  time.Duration(ru.Stime.Nano()).Seconds(),
+		MaxRSS:   ru.Maxrss,
+	}
+	if ws.Signaled() {
+		e.Signal = ws.Signal().String()
+	}
+	return e
+}
+
+func (sv *supervisor) poll() {
+	child := true
+	for {
+		select {
+		case <-sv.closing:
+			sv.logger.Printf("pid checker for %d exited", sv.Pid)
+			return
+		case <-time.After(1 * time.Second):
+		}
+		if child {
+			// still our child after handoff re-exec, reap it or it stays a zombie
+			var ws syscall.WaitStatus
+			var ru syscall.Rusage
+			wpid, err := syscall.Wait4(sv.Pid, &ws, syscall.WNOHANG, &ru)
+			switch {
+			case errors.Is(err, syscall.ECHILD):
+				child = false
+			case err != nil:
+				sv.logger.Println("Failed to wait4:", err)
+				continue
+			case wpid == sv.Pid && (ws.Exited() || ws.Signaled()):
+				sv.exit = newSupervisorExit(ws, ru)
+				sv.logger.Printf("pid %d closed", sv.Pid)
+				close(sv.done)
+				return
+			default:
+				continue
+			}
+		}
+		if !isPidAlive(sv.Pid) {
+			sv.logger.Printf("pid %d closed", sv.Pid)
+			close(sv.done)
+			return
+		}
+	}
+}
+
+// Lines delivers stdout and stderr lines
+func (sv *supervisor) Lines() <-chan string {
+	return sv.lines
+}
+
+// Done is closed once process is gone
+func (sv *supervisor) Done() <-chan struct{} {
+	return sv.done
+}
+
+// ExitStatus is only known for our own children and only after Done is closed
+func (sv *supervisor) ExitStatus() *supervisorExit {
+	select {
+	case <-sv.done:
+		return sv.exit
+	default:
+		return nil
+	}
+}
+
+func (sv *supervisor) Write(s string) error {
+	sv.writeLock.Lock()
+	defer sv.writeLock.Unlock()
+	n, err := sv.stdin.WriteString(s)
+	if err != nil {
+		return err
+	}
+	if n != len(s) {
+		return fmt.Errorf("write to stdin n %d does not match %d", n, len(s))
+	}
+	return nil
+}
+
+// Signal sends signal to the whole process group (setsid made pid the group leader)
+func (sv *supervisor) Signal(sig syscall.Signal) error {
+	select {
+	case <-sv.done:
+		return os.ErrProcessDone
+	default:
+	}
+	return syscall.Kill(-sv.Pid, sig)
+}
+
+// Terminate sends SIGTERM and escalates to SIGKILL if process is still around after grace period
+func (sv *supervisor) Terminate(grace time.Duration) {
+	sv.logger.Printf("Sending SIGTERM to pid %d", sv.Pid)
+	err := sv.Signal(syscall.SIGTERM)
+	if err != nil {
+		sv.logger.Printf("Failed to send SIGTERM: %s", err)
+		if errors.Is(err, os.ErrProcessDone) {
+			return
+		}
+	}
+	select {
+	case <-sv.done:
+		return
+	case <-time.After(grace):
+	}
+	sv.logger.Printf("pid %d did not exit %s after SIGTERM, sending SIGKILL", sv.Pid, grace)
+	err = sv.Signal(syscall.SIGKILL)
+	if err != nil {
+		sv.logger.Printf("Failed to send SIGKILL: %s", err)
+	}
+}
+
+// Close releases pipes and readers without touching the process,
+// it can be attached again later
+func (sv *supervisor) Close() {
+	sv.closeOnce.Do(func() {
+		close(sv.closing)
+		sv.closePipes()
+		sv.wg.Wait()
+	})
+}
+
+func isPidAlive(pid int) bool {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	var (
+		rpid   int
+		rcomm  string
+		rstate rune
+	)
+	i, err := fmt.Sscanf(string(b), "%d %s %c", &rpid, &rcomm, &rstate)
+	if err != nil || i != 3 {
+		log.Printf("Failed to parse proc stat: %s", err.Error())
+		return false
+	}
+	switch rstate {
+	case 'R': // Running
+		return true
+	case 'S': // Sleeping in an interruptible wait
+		return true
+	case 'D': // Waiting in uninterruptible disk sleep
+		return true
+	case 'W': // Waking
+		return true
+	case 'I': // Idle
+		return true
+	default:
+		// case 'P': // Parked
+		// case 'Z': // Zombie
+		// case 'T': // Stopped
+		// case 't': // Tracing stop
+		// case 'W': // Paging
+		// case 'X': // Dead
+		// case 'x': // Dead
+		// case 'K': // Wakekill
+	}
+	return false
+}
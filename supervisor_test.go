@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSupervisorPollReapsChild(t *testing.T) {
+	pr, err := os.StartProcess("/bin/sh", []string{"sh", "-c", "exit 3"}, &os.ProcAttr{})
+	if err != nil {
+		t.Skipf("can not start shell: %s", err)
+	}
+	// attached like after handoff re-exec, process is still our child
+	sv := newSupervisor(t.TempDir(), log.New(io.Discard, "", 0))
+	sv.Pid = pr.Pid
+	sv.attached = true
+	pr.Release()
+	go sv.poll()
+	defer sv.Close()
+
+	select {
+	case <-sv.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("poll did not notice exited child")
+	}
+	e := sv.ExitStatus()
+	if e == nil {
+		t.Fatal("exit status of attached child not recorded")
+	}
+	if e.Code != 3 || e.Signal != "" {
+		t.Fatalf("got %s want exit code 3", e)
+	}
+	if isPidAlive(pr.Pid) {
+		t.Fatal("child still around after poll")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// auto balancing splits players into two teams of equal size with closest
+// rating sums once every player slot of the lobby is taken, configured as
+//
+//	"autoBalance": {
+//		"enabled": true,
+//		"category": 3,              // rating category, defaults to first of ratingCategories
+//		"unratedRating": 1000,      // used for players without a rating
+//		"teamCommand": "set team {{.Player}} {{.Team}}"
+//	}
+//
+// teamCommand is written to game stdin for every player (.Player is player
+// index, .Team is 0 or 1), cmdinterface syntax differs between game versions
+// so it is configurable. Split is recalculated whenever set of players changes
+// until the game starts. Odd player counts are free for all and never balanced.
+// Roster is tracked by player index, so position changes are turned off for
+// balanced rooms (see geniRenderPreset), moves to and from spectators are tracked.
+// Ratings are looked up outside of the message handler, result is dropped if
+// roster changed in the meantime.
+
+type lobbyPlayer struct {
+	Pubkey string
+	Name   string
+}
+
+type teamBalancePlayer struct {
+	index  int
+	pubkey string
+	name   string
+	rating int
+	rated  bool
+}
+
+func teamBalanceEnabled(inst *instance) bool {
+	return tryCfgGetD(tryGetBoolGen("autoBalance", "enabled"), false, inst.cfgs...) &&
+		inst.Settings.PlayerCount >= 4 && inst.Settings.PlayerCount%2 == 0
+}
+
+func lobbyRosterSet(inst *instance, index int, pubkey, name string) {
+	if index < 0 || index >= inst.Settings.PlayerCount {
+		// spectator slot
+		return
+	}
+	if name == "" {
+		name = inst.lobbyNames[pubkey]
+	}
+	inst.lobbyRoster[index] = lobbyPlayer{Pubkey: pubkey, Name: name}
+	teamBalanceCheck(inst)
+}
+
+func lobbyRosterRemove(inst *instance, index int) {
+	delete(inst.lobbyRoster, index)
+	// balance the next full roster even if it is the same one again
+	inst.balancedRoster = ""
+	inst.balancedGen.Add(1)
+}
+
+// teamBalanceSplit returns team of every rating minimizing difference of team sums, first player is always on team 0
+func teamBalanceSplit(ratings []int) ([]int, int) {
+	n := len(ratings)
+	total := 0
+	for _, r := range ratings {
+		total += r
+	}
+	bestMask, bestDiff := 0, math.MaxInt
+	for mask := 1; mask < 1<<n; mask += 2 {
+		if bits.OnesCount(uint(mask)) != n/2 {
+			continue
+		}
+		sum := 0
+		for i := 0; i < n; i++ {
+			if mask&(1<<i) != 0 {
+				sum += ratings[i]
+			}
+		}
+		diff := total - 2*sum
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff < bestDiff {
+			bestMask, bestDiff = mask, diff
+		}
+	}
+	teams := make([]int, n)
+	for i := range teams {
+		if bestMask&(1<<i) == 0 {
+			teams[i] = 1
+		}
+	}
+	return teams, bestDiff
+}
+
+// teamBalanceNames lists players of both teams for chat, names come from
+// players so everything but letters, digits and spaces is dropped
+func teamBalanceNames(players []teamBalancePlayer, teams []int) [2][]string {
+	ret := [2][]string{}
+	for i, p := range players {
+		name := strings.TrimSpace(nonAlphanumericRegex.ReplaceAllString(p.name, ""))
+		if name == "" {
+			name = fmt.Sprintf("Player %d", p.index)
+		}
+		rs := fmt.Sprint(p.rating)
+		if !p.rated {
+			rs = "unrated"
+		}
+		ret[teams[i]] = append(ret[teams[i]], fmt.Sprintf("%s (%s)", name, rs))
+	}
+	return ret
+}
+
+// teamBalanceWinChance is elo expected score of team with average rating a against b
+func teamBalanceWinChance(a, b float64) float64 {
+	return 1 / (1 + math.Pow(10, (b-a)/400))
+}
+
+// teamBalanceLookup fills in ratings of players, replaced in tests
+var teamBalanceLookup = teamBalanceRatings
+
+func teamBalanceRatings(players []teamBalancePlayer, category int) error {
+	if dbpool == nil {
+		return errors.New("no database")
+	}
+	for i := range players {
+		pubkey, err := base64.StdEncoding.DecodeString(players[i].pubkey)
+		if err != nil {
+			continue
+		}
+		var rating int
+		err = dbpool.QueryRow(context.Background(), `select r.rating
+from identities as i
+join ratings as r on r.account = i.account and r.category = $2
+where i.hash = encode(sha256($1), 'hex')`, pubkey, category).Scan(&rating)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		players[i].rating, players[i].rated = rating, true
+	}
+	return nil
+}
+
+func teamBalanceCheck(inst *instance) {
+	if !teamBalanceEnabled(inst) || instanceState(inst.state.Load()) != instanceStateInLobby {
+		return
+	}
+	if len(inst.lobbyRoster) < inst.Settings.PlayerCount {
+		return
+	}
+	players := []teamBalancePlayer{}
+	keys := []string{}
+	for idx, p := range inst.lobbyRoster {
+		players = append(players, teamBalancePlayer{index: idx, pubkey: p.Pubkey, name: p.Name})
+		keys = append(keys, fmt.Sprintf("%d:%s", idx, p.Pubkey))
+	}
+	sort.Slice(players, func(i, j int) bool { return players[i].index < players[j].index })
+	sort.Strings(keys)
+	roster := strings.Join(keys, ",")
+	if roster == inst.balancedRoster {
+		return
+	}
+	inst.balancedRoster = roster
+	gen := inst.balancedGen.Add(1)
+	inst.wg.Add(1)
+	go func() {
+		defer inst.wg.Done()
+		teamBalanceApply(inst, gen, players)
+	}()
+}
+
+// teamBalanceApply looks up ratings and writes the split if roster generation gen is still current
+func teamBalanceApply(inst *instance, gen int64, players []teamBalancePlayer) {
+	category := tryCfgGetD(tryGetIntGen("autoBalance", "category"), 0, inst.cfgs...)
+	if category == 0 && len(inst.Settings.RatingCategories) > 0 {
+		category = inst.Settings.RatingCategories[0]
+	}
+	unrated := tryCfgGetD(tryGetIntGen("autoBalance", "unratedRating"), 1000, inst.cfgs...)
+	err := teamBalanceLookup(players, category)
+	if err != nil {
+		inst.logger.Printf("Failed to get ratings for team balancing: %s", err.Error())
+		return
+	}
+	if inst.balancedGen.Load() != gen || instanceState(inst.state.Load()) != instanceStateInLobby {
+		inst.logger.Println("Roster changed while looking up ratings, balancing dropped")
+		return
+	}
+	ratings := make([]int, len(players))
+	for i := range players {
+		if !players[i].rated {
+			players[i].rating = unrated
+		}
+		ratings[i] = players[i].rating
+	}
+	teams, diff := teamBalanceSplit(ratings)
+
+	cmdTmpl, err := template.New("teamCommand").Parse(tryCfgGetD(tryGetStringGen("autoBalance", "teamCommand"), "set team {{.Player}} {{.Team}}", inst.cfgs...))
+	if err != nil {
+		inst.logger.Printf("Invalid autoBalance teamCommand: %s", err.Error())
+		return
+	}
+	sums := [2]int{}
+	for i, p := range players {
+		var sb strings.Builder
+		err = cmdTmpl.Execute(&sb, map[string]any{"Player": p.index, "Team": teams[i]})
+		if err != nil {
+			inst.logger.Printf("Failed to render autoBalance teamCommand: %s", err.Error())
+			return
+		}
+		instWriteFmt(inst, "%s", sb.String())
+		sums[teams[i]] += p.rating
+	}
+	names := teamBalanceNames(players, teams)
+	half := float64(len(players) / 2)
+	avg := [2]float64{float64(sums[0]) / half, float64(sums[1]) / half}
+	chance := teamBalanceWinChance(avg[0], avg[1])
+	inst.logger.Printf("Balanced teams in category %d: %v, sums %v, difference %d", category, teams, sums, diff)
+	for t := range names {
+		instWriteFmt(inst, `chat bcast Team %d (average %.0f): %s`, t+1, avg[t], strings.Join(names[t], ", "))
+	}
+	instWriteFmt(inst, `chat bcast Teams were balanced by rating, predicted win chance %.0f%% / %.0f%%`, chance*100, (1-chance)*100)
+	publishInstanceEvent(inst, instanceEventTeamsBalanced, map[string]any{
+		"category":   category,
+		"teams":      teams,
+		"sums":       sums,
+		"winChance":  chance,
+		"difference": diff,
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/maxsupermanhd/lac/v2"
+)
+
+func TestTeamBalanceSplit(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		ratings []int
+		diff    int
+	}{
+		{"4 equal", []int{1000, 1000, 1000, 1000}, 0},
+		{"4 pairs", []int{1500, 1400, 1100, 1000}, 0},
+		{"4 uneven", []int{2000, 1000, 1000, 1100}, 900},
+		{"6 equal", []int{1200, 1200, 1200, 1200, 1200, 1200}, 0},
+		{"6 one strong", []int{2000, 1000, 1000, 1000, 1000, 1000}, 1000},
+		{"6 strong not first", []int{1000, 1000, 2000, 1000, 1050, 1000}, 950},
+		{"8 equal", []int{1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000}, 0},
+		{"8 ladder", []int{1800, 1700, 1600, 1500, 1400, 1300, 1200, 1100}, 0},
+		{"8 odd sum", []int{1801, 1700, 1600, 1500, 1400, 1300, 1200, 1100}, 1},
+		{"10 equal", []int{1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000}, 0},
+		{"10 one strong", []int{3000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000, 1000}, 2000},
+		{"10 mixed", []int{1532, 987, 1210, 1455, 1003, 1320, 1190, 1601, 876, 1244}, 6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			teams, diff := teamBalanceSplit(tc.ratings)
+			if len(teams) != len(tc.ratings) {
+				t.Fatalf("got %d teams for %d players", len(teams), len(tc.ratings))
+			}
+			if teams[0] != 0 {
+				t.Errorf("first player is on team %d", teams[0])
+			}
+			sums := [2]int{}
+			counts := [2]int{}
+			for i, team := range teams {
+				sums[team] += tc.ratings[i]
+				counts[team]++
+			}
+			if counts[0] != counts[1] {
+				t.Errorf("teams of %d and %d players", counts[0], counts[1])
+			}
+			if got := int(math.Abs(float64(sums[0] - sums[1]))); got != diff {
+				t.Errorf("reported difference %d, team sums differ by %d", diff, got)
+			}
+			if diff != tc.diff {
+				t.Errorf("difference %d, want %d (teams %v)", diff, tc.diff, teams)
+			}
+		})
+	}
+}
+
+func TestTeamBalanceWinChance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b float64
+		want float64
+	}{
+		{1000, 1000, 0.5},
+		{1400, 1000, 10.0 / 11},
+		{1000, 1400, 1.0 / 11},
+		{1800, 1000, 100.0 / 101},
+		{1200, 1000, 0.7597},
+	} {
+		got := teamBalanceWinChance(tc.a, tc.b)
+		if math.Abs(got-tc.want) > 0.0001 {
+			t.Errorf("win chance of %.0f against %.0f is %.4f, want %.4f", tc.a, tc.b, got, tc.want)
+		}
+		if rev := teamBalanceWinChance(tc.b, tc.a); math.Abs(got+rev-1) > 1e-9 {
+			t.Errorf("win chances of %.0f and %.0f sum to %f", tc.a, tc.b, got+rev)
+		}
+	}
+}
+
+func TestTeamBalanceNames(t *testing.T) {
+	players := []teamBalancePlayer{
+		{index: 0, name: "Player One", rating: 1200, rated: true},
+		{index: 1, name: "evil\nshutdown now", rating: 1000},
+		{index: 2, name: "[RU] by_mocart", rating: 1100, rated: true},
+		{index: 3, name: "☃☃", rating: 900, rated: true},
+	}
+	got := teamBalanceNames(players, []int{0, 1, 1, 0})
+	want := [2][]string{
+		{"Player One (1200)", "Player 3 (900)"},
+		{"evilshutdown now (unrated)", "RU bymocart (1100)"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// testBalanceInstance builds lobby instance with stdin written to returned pipe
+func testBalanceInstance(t *testing.T) (*instance, *os.File) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close(); w.Close() })
+	inst := testJoinInstance(t, `{"autoBalance": {"enabled": true, "category": 3}}`)
+	inst.ConfDir = t.TempDir()
+	inst.Settings.PlayerCount = 4
+	inst.OnJoinDispatch = map[string]joinDispatch{}
+	inst.lobbyRoster = map[int]lobbyPlayer{}
+	inst.lobbyNames = map[string]string{}
+	inst.proc = newSupervisor(inst.ConfDir, inst.logger)
+	inst.proc.stdin = w
+	inst.state.Store(int64(instanceStateInLobby))
+	return inst, r
+}
+
+func TestTeamBalanceRoster(t *testing.T) {
+	savedCfg, savedLookup := cfg, teamBalanceLookup
+	cfg = lac.NewConf()
+	ratings := map[string]int{}
+	teamBalanceLookup = func(players []teamBalancePlayer, category int) error {
+		if category != 3 {
+			return fmt.Errorf("wrong category %d", category)
+		}
+		for i := range players {
+			players[i].rating, players[i].rated = ratings[players[i].pubkey], true
+		}
+		return nil
+	}
+	defer func() { cfg, teamBalanceLookup = savedCfg, savedLookup }()
+
+	inst, stdin := testBalanceInstance(t)
+	lines := bufio.NewScanner(stdin)
+	keys := []string{}
+	for i, r := range []int{1500, 1400, 1100, 1000, 1600} {
+		k := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("player%d", i)))
+		keys = append(keys, k)
+		ratings[k] = r
+		inst.lobbyNames[k] = fmt.Sprintf("Player%d", i)
+	}
+	send := func(format string, args ...any) {
+		processHosterMessage(inst, fmt.Sprintf(format, args...))
+		// balancing runs outside of the handler
+		inst.wg.Wait()
+	}
+	expect := func(step string, want ...string) {
+		t.Helper()
+		// everything written before the marker belongs to this step
+		instWriteFmt(inst, "sync")
+		got := []string{}
+		for lines.Scan() && lines.Text() != "sync" {
+			if strings.HasPrefix(lines.Text(), "set team ") {
+				got = append(got, lines.Text())
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("%s: got team commands %q, want %q", step, got, want)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		send("WZEVENT: player join: %d %s", i, keys[i])
+	}
+	send("WZEVENT: player join: 16 %s", keys[4])
+	expect("roster not full, spectator joined")
+	send("WZEVENT: player join: 3 %s", keys[3])
+	expect("roster full", "set team 0 0", "set team 1 1", "set team 2 1", "set team 3 0")
+
+	send("WZEVENT: player leave: 3 %s", keys[3])
+	expect("player left")
+	if _, ok := inst.lobbyNames[keys[3]]; ok {
+		t.Error("name of player that left is still remembered")
+	}
+	send("WZEVENT: player leave: 16 %s", keys[4])
+	send("WZEVENT: player join: 3 %s", keys[4])
+	expect("replacement joined", "set team 0 0", "set team 1 0", "set team 2 1", "set team 3 1")
+
+	send("WZEVENT: movedPlayerToSpec: 2 -> 10 %s hash V UGxheWVyMg== 127.0.0.1", keys[2])
+	expect("moved to spectators")
+	if len(inst.lobbyRoster) != 3 {
+		t.Fatalf("roster has %d players after move to spectators", len(inst.lobbyRoster))
+	}
+	send("WZEVENT: movedSpecToPlayer: 10 -> 2 %s hash V UGxheWVyMg== 127.0.0.1", keys[2])
+	expect("moved back", "set team 0 0", "set team 1 0", "set team 2 1", "set team 3 1")
+
+	inst.state.Store(int64(instanceStateInGame))
+	send("WZEVENT: player leave: 1 %s", keys[1])
+	send("WZEVENT: player join: 1 %s", keys[1])
+	expect("game started")
+}
@@ -0,0 +1,195 @@
+// fakehoster pretends to be a headless warzone2100 for testing the backend.
+//
+// It is selected through the "binary" setting and plays a scenario file line by line.
+// Scenario is read from <configdir>/fakehoster.scenario or FAKEHOSTER_SCENARIO, every
+// stdin line received is recorded to <configdir>/fakehoster.stdin.log.
+//
+// With --version it only prints FAKEHOSTER_VERSION (0.0.0-fake by default) like the game does.
+//
+// Scenario commands:
+//
+//	print <text>            write line to stdout, {port} and {configdir} are substituted
+//	stderr <text>           write line to stderr
+//	sleep <duration>        pause, duration in time.ParseDuration format
+//	expect <prefix>         wait until stdin line starting with prefix arrives (30s timeout)
+//	report <file>           print file contents as __REPORT__ frame
+//	reportextended <file>   print file contents as __REPORTextended__ frame
+//	replay                  write minimal replay file into replay/multiplay
+//	waitshutdown            wait for "shutdown now" on stdin
+//	exit <code>             exit with code
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	configdir string
+	gameport  string
+
+	stdinLock  sync.Mutex
+	stdinLines []string
+	stdinCond            = sync.NewCond(&stdinLock)
+	stdinLog   io.Writer = io.Discard
+)
+
+func main() {
+	log.SetOutput(os.Stderr)
+	log.SetPrefix("fakehoster ")
+	for _, a := range os.Args[1:] {
+		if a == "--version" {
+			v := os.Getenv("FAKEHOSTER_VERSION")
+			if v == "" {
+				v = "0.0.0-fake"
+			}
+			fmt.Printf("Warzone 2100 - Version: %s, Built: fake\n", v)
+			return
+		}
+		if v, ok := strings.CutPrefix(a, "--configdir="); ok {
+			configdir = v
+		}
+		if v, ok := strings.CutPrefix(a, "--gameport="); ok {
+			gameport = v
+		}
+	}
+	if configdir == "" {
+		log.Fatal("no --configdir given")
+	}
+
+	scenarioPath := os.Getenv("FAKEHOSTER_SCENARIO")
+	if scenarioPath == "" {
+		scenarioPath = path.Join(configdir, "fakehoster.scenario")
+	}
+	scenario, err := os.ReadFile(scenarioPath)
+	if err != nil {
+		log.Fatalf("failed to read scenario: %s", err)
+	}
+
+	f, err := os.OpenFile(path.Join(configdir, "fakehoster.stdin.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("failed to open stdin log: %s", err)
+	}
+	defer f.Close()
+	stdinLog = f
+	go readStdin()
+
+	for i, line := range strings.Split(string(scenario), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err := runLine(line)
+		if err != nil {
+			log.Fatalf("scenario line %d (%q): %s", i+1, line, err)
+		}
+	}
+}
+
+func readStdin() {
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		stdinLock.Lock()
+		stdinLines = append(stdinLines, s.Text())
+		fmt.Fprintln(stdinLog, s.Text())
+		stdinCond.Broadcast()
+		stdinLock.Unlock()
+	}
+}
+
+// waitStdin blocks until line with prefix is received, lines are consumed in order
+func waitStdin(prefix string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	go func() {
+		time.Sleep(timeout)
+		stdinCond.Broadcast()
+	}()
+	stdinLock.Lock()
+	defer stdinLock.Unlock()
+	for {
+		for i, l := range stdinLines {
+			if strings.HasPrefix(l, prefix) {
+				stdinLines = stdinLines[i+1:]
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %q", prefix)
+		}
+		stdinCond.Wait()
+	}
+}
+
+func substitute(s string) string {
+	return strings.NewReplacer("{port}", gameport, "{configdir}", configdir).Replace(s)
+}
+
+func readCompactJSON(p string) (string, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = json.Compact(&buf, b)
+	return buf.String(), err
+}
+
+func runLine(line string) error {
+	cmd, arg, _ := strings.Cut(line, " ")
+	switch cmd {
+	case "print":
+		fmt.Fprintln(os.Stdout, substitute(arg))
+	case "stderr":
+		fmt.Fprintln(os.Stderr, substitute(arg))
+	case "sleep":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		time.Sleep(d)
+	case "expect":
+		return waitStdin(substitute(arg), 30*time.Second)
+	case "waitshutdown":
+		err := waitStdin("shutdown now", 30*time.Second)
+		if err != nil {
+			return err
+		}
+		os.Exit(0)
+	case "report", "reportextended":
+		r, err := readCompactJSON(substitute(arg))
+		if err != nil {
+			return err
+		}
+		if cmd == "report" {
+			fmt.Fprintln(os.Stdout, "__REPORT__"+r+"__ENDREPORT__")
+		} else {
+			fmt.Fprintln(os.Stdout, "__REPORTextended__"+r+"__ENDREPORTextended__")
+		}
+	case "replay":
+		dir := path.Join(configdir, "replay", "multiplay")
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path.Join(dir, "fake.wzrp"), []byte("WZrp fake replay"), 0644)
+	case "exit":
+		code, err := strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		os.Exit(code)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}